@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Minimal client for the Redpanda admin API.  We only model the handful
+// of endpoints that the verifier uses.
+type AdminClient struct {
+	urls   []string
+	client *http.Client
+}
+
+func NewAdminClient(hosts string) *AdminClient {
+	var urls []string
+	for _, h := range strings.Split(hosts, ",") {
+		if !strings.HasPrefix(h, "http://") && !strings.HasPrefix(h, "https://") {
+			h = "http://" + h
+		}
+		urls = append(urls, strings.TrimRight(h, "/"))
+	}
+	return &AdminClient{
+		urls:   urls,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (a *AdminClient) sendOne(url string, method string, path string, into interface{}) error {
+	req, err := http.NewRequest(method, url+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s%s: %s: %s", method, url, path, resp.Status, string(body))
+	}
+	if into != nil && len(body) > 0 {
+		return json.Unmarshal(body, into)
+	}
+	return nil
+}
+
+// Send a request to each node in turn until one of them succeeds.  Some
+// requests (e.g. leadership transfers) are only accepted by particular
+// nodes, so trying them all saves us tracking which is which.
+func (a *AdminClient) sendAny(method string, path string, into interface{}) error {
+	var err error
+	for _, url := range a.urls {
+		err = a.sendOne(url, method, path, into)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("Admin API request failed: %v", err)
+	}
+	return err
+}
+
+type AdminReplica struct {
+	NodeID int32 `json:"node_id"`
+	Core   int32 `json:"core"`
+}
+
+type AdminPartition struct {
+	Topic       string         `json:"topic"`
+	PartitionID int32          `json:"partition_id"`
+	Status      string         `json:"status"`
+	LeaderID    int32          `json:"leader_id"`
+	Replicas    []AdminReplica `json:"replicas"`
+}
+
+func (a *AdminClient) GetPartition(topic string, p int32) (AdminPartition, error) {
+	var result AdminPartition
+	err := a.sendAny(http.MethodGet, fmt.Sprintf("/v1/partitions/kafka/%s/%d", topic, p), &result)
+	return result, err
+}
+
+// Tiered storage state of a partition, from the node that leads it
+type AdminCloudStorageStatus struct {
+	Mode                  string `json:"cloud_storage_mode"`
+	MsSinceManifestUpload int64  `json:"ms_since_last_manifest_upload"`
+	MsSinceSegmentUpload  int64  `json:"ms_since_last_segment_upload"`
+	CloudLogSegmentCount  int64  `json:"cloud_log_segment_count"`
+	LocalLogSegmentCount  int64  `json:"local_log_segment_count"`
+	CloudLogStartOffset   *int64 `json:"cloud_log_start_offset"`
+	LocalLogStartOffset   int64  `json:"local_log_start_offset"`
+	CloudLogLastOffset    *int64 `json:"cloud_log_last_offset"`
+	LocalLogLastOffset    int64  `json:"local_log_last_offset"`
+	CloudLogSizeBytes     int64  `json:"cloud_log_size_bytes"`
+	LocalLogSizeBytes     int64  `json:"local_log_size_bytes"`
+}
+
+func (a *AdminClient) GetCloudStorageStatus(topic string, p int32) (AdminCloudStorageStatus, error) {
+	var result AdminCloudStorageStatus
+	err := a.sendAny(http.MethodGet, fmt.Sprintf("/v1/cloud_storage/status/%s/%d", topic, p), &result)
+	return result, err
+}
+
+func (a *AdminClient) TransferLeadership(topic string, p int32, target int32) error {
+	return a.sendAny(http.MethodPost, fmt.Sprintf("/v1/partitions/kafka/%s/%d/transfer_leadership?target=%d", topic, p, target), nil)
+}
+
+// Move leadership of a random partition to a random follower
+func transferRandomLeadership(admin *AdminClient, nPartitions int32) error {
+	p := rand.Int31n(nPartitions)
+	partition, err := admin.GetPartition(*topic, p)
+	if err != nil {
+		return err
+	}
+
+	var candidates []int32
+	for _, r := range partition.Replicas {
+		if r.NodeID != partition.LeaderID {
+			candidates = append(candidates, r.NodeID)
+		}
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("No follower to transfer %s/%d to", *topic, p)
+	}
+
+	target := candidates[rand.Intn(len(candidates))]
+	log.Infof("Transferring leadership of %s/%d from %d to %d", *topic, p, partition.LeaderID, target)
+	return admin.TransferLeadership(*topic, p, target)
+}
+
+// Periodically transfer partition leadership until stop is closed, to
+// drive a basic failure scenario while the workload runs.
+func leadershipTransferLoop(admin *AdminClient, nPartitions int32, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	transfers := 0
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			log.Infof("Leadership transfers: %d ok, %d failed", transfers, failures)
+			return
+		case <-ticker.C:
+			err := transferRandomLeadership(admin, nPartitions)
+			if err != nil {
+				log.Warnf("Leadership transfer failed: %v", err)
+				failures += 1
+			} else {
+				transfers += 1
+			}
+		}
+	}
+}
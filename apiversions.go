@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Before a run starts, ask every broker which API versions it supports,
+// so that a feature the cluster is too old for fails up front with a clear
+// message, rather than part way through with an unsupported version error.
+
+type apiRequirement struct {
+	key     kmsg.Key
+	version int16
+}
+
+var (
+	apiIdempotentProduce    = apiRequirement{kmsg.InitProducerID, 0}
+	apiTimestampOffsets     = apiRequirement{kmsg.ListOffsets, 1}
+	apiOffsetForLeaderEpoch = apiRequirement{kmsg.OffsetForLeaderEpoch, 2}
+	apiDeleteRecords        = apiRequirement{kmsg.DeleteRecords, 0}
+	apiTxnOffsetCommit      = apiRequirement{kmsg.TxnOffsetCommit, 0}
+	apiAddPartitionsToTxn   = apiRequirement{kmsg.AddPartitionsToTxn, 0}
+	apiEndTxn               = apiRequirement{kmsg.EndTxn, 0}
+	apiReadCommittedOffsets = apiRequirement{kmsg.ListOffsets, 2}
+	apiReadCommittedFetch   = apiRequirement{kmsg.Fetch, 4}
+)
+
+// The highest version of each API that every broker supports
+type apiVersions map[kmsg.Key]int16
+
+// Whether to check for log divergence with OffsetForLeaderEpoch
+var leaderEpochChecks = true
+
+// Whether to compare the last stable offset with the high watermark
+var stableOffsetChecks = true
+
+func probeAPIVersions(client *kgo.Client) (apiVersions, error) {
+	ctx, cancel := context.WithTimeout(runCtx, 30*time.Second)
+	defer cancel()
+
+	// An empty metadata request, just to discover the brokers
+	req := kmsg.NewPtrMetadataRequest()
+	req.Topics = []kmsg.MetadataRequestTopic{}
+	meta, err := req.RequestWith(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering brokers: %w", err)
+	}
+
+	versions := make(apiVersions)
+	for i, b := range meta.Brokers {
+		resp, err := kmsg.NewPtrApiVersionsRequest().RequestWith(ctx, client.Broker(int(b.NodeID)))
+		if err == nil {
+			err = kerr.ErrorForCode(resp.ErrorCode)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting API versions from broker %d: %w", b.NodeID, err)
+		}
+
+		brokerVersions := make(apiVersions)
+		for _, k := range resp.ApiKeys {
+			brokerVersions[kmsg.Key(k.ApiKey)] = k.MaxVersion
+		}
+		// Any broker may end up leading a partition, so we can count only
+		// on what they all support
+		if i == 0 {
+			versions = brokerVersions
+		}
+		for k, v := range versions {
+			if bv, ok := brokerVersions[k]; !ok {
+				delete(versions, k)
+			} else if bv < v {
+				versions[k] = bv
+			}
+		}
+	}
+	return versions, nil
+}
+
+func (av apiVersions) supports(req apiRequirement) bool {
+	v, ok := av[req.key]
+	return ok && v >= req.version
+}
+
+// Die, explaining why, if the cluster can't do what a flag asks for
+func (av apiVersions) require(req apiRequirement, cluster string, feature string) {
+	if av.supports(req) {
+		return
+	}
+	v, ok := av[req.key]
+	if !ok {
+		Die("%s needs %s v%d+, which the %s cluster does not support: upgrade the brokers or drop %s",
+			feature, req.key.Name(), req.version, cluster, feature)
+	}
+	Die("%s needs %s v%d+, but the %s cluster supports only up to v%d: upgrade the brokers or drop %s",
+		feature, req.key.Name(), req.version, cluster, v, feature)
+}
+
+// Check the clusters support the features this run uses
+func checkAPISupport() {
+	client := newClient(nil)
+	consume, err := probeAPIVersions(client)
+	closeClient(client)
+	Chk(err, "%v", err)
+
+	produce := consume
+	if crossCluster() {
+		client := newProduceClient(nil)
+		produce, err = probeAPIVersions(client)
+		closeClient(client)
+		Chk(err, "%v", err)
+	}
+
+	if *pCount > 0 {
+		produce.require(apiIdempotentProduce, "produce", "--produce_msgs")
+	}
+	if *deleteRecordsCount > 0 {
+		consume.require(apiDeleteRecords, "consume", "--delete_records")
+	}
+	if len(*pipelineSink) > 0 {
+		for _, req := range []apiRequirement{apiIdempotentProduce, apiAddPartitionsToTxn, apiTxnOffsetCommit, apiEndTxn} {
+			consume.require(req, "consume", "--pipeline_sink")
+		}
+		if *pipelineAbortRate > 0 {
+			// Aborts are checked by reading the sink back read_committed
+			consume.require(apiReadCommittedOffsets, "consume", "--pipeline_abort_rate")
+			consume.require(apiReadCommittedFetch, "consume", "--pipeline_abort_rate")
+		}
+	}
+	if *isolation == "read_committed" {
+		consume.require(apiReadCommittedOffsets, "consume", "--isolation read_committed")
+		consume.require(apiReadCommittedFetch, "consume", "--isolation read_committed")
+	}
+	if *randReadTimestamp {
+		consume.require(apiTimestampOffsets, "consume", "--rand_read_timestamp")
+	}
+	if *badTimestampRate > 0 {
+		consume.require(apiTimestampOffsets, "consume", "--bad_timestamp_rate")
+	}
+	if len(*fromTimestamp) > 0 {
+		consume.require(apiTimestampOffsets, "consume", "--from_timestamp")
+	}
+	if len(*toTimestamp) > 0 {
+		consume.require(apiTimestampOffsets, "consume", "--to_timestamp")
+	}
+
+	// Not something asked for, so just do without.  Acked epochs are the
+	// produce cluster's, so that is where they are checked.
+	if !produce.supports(apiOffsetForLeaderEpoch) {
+		log.Warnf("Produce cluster does not support %s v%d+: skipping log divergence checks",
+			apiOffsetForLeaderEpoch.key.Name(), apiOffsetForLeaderEpoch.version)
+		leaderEpochChecks = false
+	}
+	if !consume.supports(apiReadCommittedOffsets) {
+		log.Warnf("Cluster does not support %s v%d+: skipping last stable offset reports",
+			apiReadCommittedOffsets.key.Name(), apiReadCommittedOffsets.version)
+		stableOffsetChecks = false
+	}
+}
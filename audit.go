@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+// The audit subcommand re-validates a topic against the state left by an
+// earlier run, e.g. days after it produced, without writing to the topic
+// or changing anything about it.  Only the read validation modes run, with
+// the usual results.  Takes an optional state file path, defaulting to
+// the one for --topic.
+
+var auditMode bool
+
+func startAudit(args []string) {
+	if len(*topic) == 0 {
+		Die("audit requires --topic")
+	}
+	if len(args) > 1 {
+		Die("Usage: audit [valid_offsets file]")
+	} else if len(args) == 1 {
+		stateFilePath = args[0]
+	}
+	if _, err := os.Stat(topicOffsetRangeFile()); err != nil {
+		Die("audit needs an existing state file: %v", err)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if explicit["produce_msgs"] && *pCount > 0 {
+		Die("audit only reads: --produce_msgs can't be used with it")
+	}
+	*pCount = 0
+
+	refuse := func(set bool, name string) {
+		if set {
+			Die("%s changes the topic, so can't be used with audit", name)
+		}
+	}
+	refuse(*ephemeralTopic, "--ephemeral_topic")
+	refuse(*deleteRecordsCount > 0, "--delete_records")
+	refuse(*localTrimMode, "--local_trim")
+	refuse(*leadershipTransferInterval > 0, "--leadership_transfer_interval")
+	refuse(len(*controlTopic) > 0, "--control_topic")
+
+	if !*seqRead && *cCount == 0 && len(*consumerGroup) == 0 && !*followerRead {
+		Die("Nothing to audit: enable --seq_read, --rand_read_msgs, --consumer_group or --follower_read")
+	}
+	auditMode = true
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// With --bad_timestamp_rate, some records are produced with client
+// timestamps far in the past (--bad_timestamp_past) or future
+// (--bad_timestamp_future).  The topic's timestamp limits say whether the
+// broker must reject or accept each one, and we check it does.  Accepted
+// records are ordinary records of ours as far as reads are concerned, and
+// we keep their timestamps in state: later, timestamp queries must still
+// resolve around them.  Out of order timestamps are what time indexes (in
+// particular tiered storage's) are most likely to get wrong.
+
+// Past this many, checking time queries takes longer than it is worth
+const maxBadTimestampQueries = 1000
+
+// Set once we load a state holding bad timestamps, so that a run which
+// neither produces them nor has seen any skips loading the state to look
+var loadedBadTimestamps int32
+
+func noteLoadedBadTimestamps(tors *TopicOffsetRanges) {
+	for p := range tors.PartitionRanges {
+		if len(tors.PartitionRanges[p].BadTimestamps) > 0 {
+			atomic.StoreInt32(&loadedBadTimestamps, 1)
+			return
+		}
+	}
+}
+
+// Whether checkBadTimestampQueries has anything to do
+func badTimestampsToCheck() bool {
+	return *badTimestampRate > 0 || atomic.LoadInt32(&loadedBadTimestamps) != 0
+}
+
+type BadTimestampStats struct {
+	Attempts int64
+	Accepted int64
+	Rejected int64
+	// Time queries checked against accepted records
+	Queries int64
+	// Failures that were neither an acceptance nor a rejection
+	Errors map[string]int64 `json:",omitempty"`
+}
+
+// A record we produced with a bad client timestamp, in milliseconds
+type BadTimestamp struct {
+	Offset    int64
+	Timestamp int64
+}
+
+type BadTimestampProducer struct {
+	client *kgo.Client
+	// The topic's limits on how far behind and ahead of the broker's clock
+	// a timestamp may be, -1 for none
+	maxBefore int64
+	maxAfter  int64
+}
+
+// The topic's timestamp limits, in milliseconds
+func timestampLimits(client *kgo.Client) (int64, int64, error) {
+	configs, err := getTopicConfigs(client)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit := func(name string, fallback int64) (int64, error) {
+		c, ok := configs[name]
+		if !ok || c.Value == nil {
+			return fallback, nil
+		}
+		v, err := strconv.ParseInt(*c.Value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad %s '%s': %w", name, *c.Value, err)
+		}
+		return v, nil
+	}
+	// Newer brokers split the older, symmetric limit in two
+	difference, err := limit("message.timestamp.difference.max.ms", -1)
+	if err != nil {
+		return 0, 0, err
+	}
+	before, err := limit("message.timestamp.before.max.ms", difference)
+	if err != nil {
+		return 0, 0, err
+	}
+	after, err := limit("message.timestamp.after.max.ms", difference)
+	return before, after, err
+}
+
+func NewBadTimestampProducer() *BadTimestampProducer {
+	client := newProduceClient(nil)
+	maxBefore, maxAfter, err := timestampLimits(client)
+	closeClient(client)
+	Chk(err, "Error reading timestamp limits of %s: %v", *topic, err)
+	if logAppendTime {
+		// The broker replaces client timestamps, so has no reason to check them
+		maxBefore, maxAfter = -1, -1
+	}
+	log.Infof("Producing records with bad timestamps (topic allows %dms before, %dms after)", maxBefore, maxAfter)
+
+	// Raw produce requests must ask for the acks the client is set up with
+	opts := []kgo.Opt{
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+	}
+	return &BadTimestampProducer{
+		client:    newProduceClient(opts),
+		maxBefore: maxBefore,
+		maxAfter:  maxAfter,
+	}
+}
+
+func (bp *BadTimestampProducer) Close() {
+	closeClient(bp.client)
+}
+
+// Whether a timestamp this far from now must be rejected, and whether it
+// is near enough to the limit that clock skew could decide it either way
+func (bp *BadTimestampProducer) expectReject(skew time.Duration) (bool, bool) {
+	limit := bp.maxAfter
+	if skew < 0 {
+		skew = -skew
+		limit = bp.maxBefore
+	}
+	if limit < 0 {
+		return false, false
+	}
+	margin := skew - time.Duration(limit)*time.Millisecond
+	if margin < 0 {
+		margin = -margin
+	}
+	return skew.Milliseconds() > limit, margin <= *timestampSkew
+}
+
+// Produce a record with a bad timestamp, and check the broker accepted or
+// rejected it as the topic's limits say.  Returns whether it was accepted.
+func (bp *BadTimestampProducer) Produce(rng *rand.Rand, pr *pendingRecord) bool {
+	skew := *badTimestampFuture
+	if rng.Intn(2) == 0 {
+		skew = -*badTimestampPast
+	}
+	reject, borderline := bp.expectReject(skew)
+
+	pr.r.Timestamp = time.Now().Add(skew)
+	applyPayloadFormat(pr.r, pr.expect)
+	if *checksums || *partitionDigest {
+		pr.sum = recordChecksum(pr.r)
+	}
+	pr.sent = time.Now()
+	offset, err := bp.produceRaw(pr.r)
+	releasePayload(pr.r.Value)
+	pr.r.Offset = offset
+
+	rejected := errors.Is(err, kerr.InvalidTimestamp)
+	results.AddBadTimestamp(err, rejected)
+	switch {
+	case err == nil && reject && !borderline:
+		results.Emit()
+		Die("Record with timestamp %v from now accepted at offset %d on %s/%d, beyond the topic's limit", skew, pr.r.Offset, *topic, pr.r.Partition)
+	case rejected && !reject && !borderline:
+		results.Emit()
+		Die("Record with timestamp %v from now rejected on %s/%d, within the topic's limit: %v", skew, *topic, pr.r.Partition, err)
+	case err != nil && !rejected:
+		log.Warnf("Record with timestamp %v from now on %s/%d failed with unexpected error: %v", skew, *topic, pr.r.Partition, err)
+	default:
+		log.Debugf("Record with timestamp %v from now on %s/%d: %v", skew, *topic, pr.r.Partition, err)
+	}
+	return err == nil
+}
+
+// The client stamps every record with the time it is buffered, so a record
+// with a timestamp of our choosing has to go in a produce request of our
+// own, to the partition's leader.  Returns the offset it landed at.
+func (bp *BadTimestampProducer) produceRaw(r *kgo.Record) (int64, error) {
+	t, _, err := getTopicMetadata(bp.client)
+	if err != nil {
+		return -1, err
+	}
+	mp, ok := t.Partitions[r.Partition]
+	if !ok {
+		return -1, fmt.Errorf("partition %d not in metadata", r.Partition)
+	}
+
+	req := kmsg.NewPtrProduceRequest()
+	req.Acks = -1
+	req.TimeoutMillis = 30000
+	reqTopic := kmsg.NewProduceRequestTopic()
+	reqTopic.Topic = *topic
+	part := kmsg.NewProduceRequestTopicPartition()
+	part.Partition = r.Partition
+	part.Records = encodeBatch(r.Key, r.Value, r.Headers, r.Timestamp.UnixMilli())
+	reqTopic.Partitions = append(reqTopic.Partitions, part)
+	req.Topics = append(req.Topics, reqTopic)
+
+	ctx, cancel := context.WithTimeout(runCtx, 30*time.Second)
+	defer cancel()
+	kresp, err := bp.client.Broker(int(mp.Leader)).Request(ctx, req)
+	if err != nil {
+		return -1, err
+	}
+	resp := kresp.(*kmsg.ProduceResponse)
+	if len(resp.Topics) != 1 || len(resp.Topics[0].Partitions) != 1 {
+		return -1, errors.New("Unexpected produce response shape")
+	}
+	rp := resp.Topics[0].Partitions[0]
+	if rp.ErrorCode != 0 {
+		return -1, kerr.ErrorForCode(rp.ErrorCode)
+	}
+	return rp.BaseOffset, nil
+}
+
+// A v2 batch holding a single uncompressed record
+func encodeBatch(key []byte, value []byte, headers []kgo.RecordHeader, ts int64) []byte {
+	rec := kmsg.Record{Key: key, Value: value}
+	for _, h := range headers {
+		rec.Headers = append(rec.Headers, kmsg.Header{Key: h.Key, Value: h.Value})
+	}
+	// The length prefix counts what follows it, and a zero fits in one byte
+	rec.Length = int32(len(rec.AppendTo(nil)) - 1)
+	records := rec.AppendTo(nil)
+
+	batch := kmsg.RecordBatch{
+		PartitionLeaderEpoch: -1,
+		Magic:                2,
+		FirstTimestamp:       ts,
+		MaxTimestamp:         ts,
+		ProducerID:           -1,
+		ProducerEpoch:        -1,
+		FirstSequence:        -1,
+		NumRecords:           1,
+		Records:              records,
+	}
+	// Length counts from the leader epoch on, and the CRC covers
+	// everything after itself
+	data := batch.AppendTo(nil)
+	binary.BigEndian.PutUint32(data[8:12], uint32(len(data)-12))
+	binary.BigEndian.PutUint32(data[17:21], crc32.Checksum(data[21:], castagnoli))
+	return data
+}
+
+func (ors *OffsetRanges) NoteBadTimestamp(o int64, ts time.Time) {
+	ors.BadTimestamps = append(ors.BadTimestamps, BadTimestamp{Offset: o, Timestamp: ts.UnixMilli()})
+}
+
+func mergeBadTimestamps(a []BadTimestamp, b []BadTimestamp) []BadTimestamp {
+	if len(b) == 0 {
+		return a
+	}
+	merged := append(append([]BadTimestamp{}, a...), b...)
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Offset < merged[j].Offset })
+	return merged
+}
+
+func trimBadTimestamps(bts []BadTimestamp, o int64) []BadTimestamp {
+	i := sort.Search(len(bts), func(i int) bool { return bts[i].Offset >= o })
+	if i == len(bts) {
+		return nil
+	}
+	return bts[i:]
+}
+
+// Query the timestamp of each record we produced with a bad one: the
+// earliest offset at or after it must be no later than the record, and
+// hold a timestamp no earlier than the query
+func checkBadTimestampQueries(nPartitions int32) {
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+	found := false
+	for p := range validRanges.PartitionRanges {
+		if len(validRanges.PartitionRanges[p].BadTimestamps) > 0 {
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+
+	client := newClient(nil)
+	start, err := getOffsets(client, nPartitions, -2)
+	ChkEmit(err, "%v", err)
+	closeClient(client)
+
+	queries := 0
+	for p := int32(0); p < nPartitions; p++ {
+		if !ownsPartition(p) {
+			continue
+		}
+		for _, bt := range validRanges.PartitionRanges[p].BadTimestamps {
+			if bt.Offset < start[p] || queries >= maxBadTimestampQueries {
+				continue
+			}
+			queries += 1
+			checkBadTimestampQuery(p, bt)
+		}
+	}
+	if queries > 0 {
+		log.Infof("Checked time queries for %d records with bad timestamps", queries)
+	}
+}
+
+func checkBadTimestampQuery(p int32, bt BadTimestamp) {
+	o, err := listOffsetForTimestamp(p, bt.Timestamp)
+	if err != nil {
+		log.Warnf("Error listing offset for %s/%d at t=%d: %v", *topic, p, bt.Timestamp, err)
+		return
+	}
+	results.AddBadTimestampQuery()
+	if o < 0 || o > bt.Offset {
+		results.Emit()
+		Die("Timestamp query t=%d on %s/%d returned offset %d, after our record with that timestamp at %d", bt.Timestamp, *topic, p, o, bt.Offset)
+	}
+	r, err := readRecordAt(p, o)
+	if err != nil {
+		log.Warnf("Error reading %s/%d at %d for t=%d: %v", *topic, p, o, bt.Timestamp, err)
+		return
+	}
+	if r.Timestamp.UnixMilli() < bt.Timestamp {
+		results.Emit()
+		Die("Timestamp query t=%d on %s/%d returned offset %d with earlier t=%d", bt.Timestamp, *topic, p, r.Offset, r.Timestamp.UnixMilli())
+	}
+	log.Debugf("Resolved t=%d to offset %d on %s/%d (bad timestamp record at %d)", bt.Timestamp, o, *topic, p, bt.Offset)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// The bench-produce subcommand produces --produce_msgs records as fast as
+// the pacing flags allow, with none of the bookkeeping a verifying run
+// does: no keys to format, no state to store, and nothing read back.  Run
+// alongside (or instead of) a verifying run on the same cluster, it tells
+// us whether a slowdown is the cluster's or the verifier's own.
+// --shared_payload takes payload allocation out of the picture too.
+
+type BenchStats struct {
+	Records int64
+	Errors  int64
+	Bytes   int64
+	Seconds float64
+
+	RecordsPerSec float64
+	MBPerSec      float64
+	// Produce to ack latency percentiles
+	LatencyMs map[string]float64
+}
+
+// Log-linear latency buckets, in microseconds: exact below 64us, and
+// within 1/64th above, however large
+const (
+	histSubBuckets = 64
+	histBuckets    = histSubBuckets * 64
+)
+
+type LatencyHistogram struct {
+	counts [histBuckets]int64
+}
+
+func histBucket(us int64) int {
+	if us < histSubBuckets {
+		if us < 0 {
+			return 0
+		}
+		return int(us)
+	}
+	shift := bits.Len64(uint64(us)) - 7
+	return histSubBuckets + shift*histSubBuckets + int(us>>shift) - histSubBuckets
+}
+
+// The highest latency that falls in a bucket
+func histBucketMax(b int) int64 {
+	if b < histSubBuckets {
+		return int64(b)
+	}
+	shift := (b - histSubBuckets) / histSubBuckets
+	mantissa := int64(b-histSubBuckets)%histSubBuckets + histSubBuckets
+	return (mantissa+1)<<shift - 1
+}
+
+func (lh *LatencyHistogram) Observe(d time.Duration) {
+	atomic.AddInt64(&lh.counts[histBucket(d.Microseconds())], 1)
+}
+
+// Latency at each of the given percentiles, in milliseconds
+func (lh *LatencyHistogram) Percentiles(ps []float64) []float64 {
+	total := int64(0)
+	for i := range lh.counts {
+		total += atomic.LoadInt64(&lh.counts[i])
+	}
+	result := make([]float64, len(ps))
+	if total == 0 {
+		return result
+	}
+	for i, p := range ps {
+		rank := int64(p / 100 * float64(total))
+		if rank >= total {
+			rank = total - 1
+		}
+		seen := int64(0)
+		for b := range lh.counts {
+			seen += atomic.LoadInt64(&lh.counts[b])
+			if seen > rank {
+				result[i] = float64(histBucketMax(b)) / 1000
+				break
+			}
+		}
+	}
+	return result
+}
+
+func benchProduce() {
+	if len(*topic) == 0 {
+		Die("bench-produce requires --topic")
+	}
+	client := newProduceClient(nil)
+	t, _, err := getTopicMetadata(client)
+	closeClient(client)
+	Chk(err, "%v", err)
+	nPartitions := int32(len(t.Partitions))
+
+	pacer, err := NewPacer()
+	Chk(err, "%v", err)
+	opts := append(produceOpts(), kgo.RecordPartitioner(kgo.ManualPartitioner()))
+	client = newProduceClient(opts)
+	defer closeClient(client)
+
+	var latency LatencyHistogram
+	var acked, failed, ackedBytes int64
+	var firstErr sync.Once
+	var wg sync.WaitGroup
+
+	// Throughput as we go, for runs long enough to watch
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		last := int64(0)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			n := atomic.LoadInt64(&acked)
+			log.Infof("Bench: %d records acked, %.1f records/s", n, float64(n-last)/10)
+			last = n
+		}
+	}()
+
+	n := int64(*pCount)
+	log.Infof("Bench producing %d records of %d bytes to %d partitions", n, *mSize, nPartitions)
+	start := time.Now()
+	for i := int64(0); i < n && runCtx.Err() == nil; i++ {
+		pacer.Wait()
+		r := kgo.SliceRecord(newPayload())
+		r.Partition = int32(i % int64(nPartitions))
+		size := int64(len(r.Value))
+		sent := time.Now()
+		wg.Add(1)
+		client.Produce(runCtx, r, func(r *kgo.Record, err error) {
+			defer wg.Done()
+			releasePayload(r.Value)
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+				firstErr.Do(func() {
+					log.Warnf("Bench produce to %s/%d failed: %v", *topic, r.Partition, err)
+				})
+				return
+			}
+			latency.Observe(time.Since(sent))
+			atomic.AddInt64(&acked, 1)
+			atomic.AddInt64(&ackedBytes, size)
+		})
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(stop)
+
+	stats := BenchStats{
+		Records:   acked,
+		Errors:    failed,
+		Bytes:     ackedBytes,
+		Seconds:   elapsed.Seconds(),
+		LatencyMs: make(map[string]float64),
+	}
+	stats.RecordsPerSec = float64(acked) / elapsed.Seconds()
+	stats.MBPerSec = float64(ackedBytes) / elapsed.Seconds() / (1024 * 1024)
+	percentiles := []float64{50, 90, 99, 99.9, 100}
+	names := []string{"p50", "p90", "p99", "p999", "max"}
+	for i, ms := range latency.Percentiles(percentiles) {
+		stats.LatencyMs[names[i]] = ms
+	}
+
+	log.Infof("Bench produced %d records (%d errors) in %v: %.1f records/s, %.2f MB/s",
+		acked, failed, elapsed.Round(time.Millisecond), stats.RecordsPerSec, stats.MBPerSec)
+	log.Infof("Bench latency p50 %.1fms, p90 %.1fms, p99 %.1fms, p999 %.1fms, max %.1fms",
+		stats.LatencyMs["p50"], stats.LatencyMs["p90"], stats.LatencyMs["p99"], stats.LatencyMs["p999"], stats.LatencyMs["max"])
+	results.SetBench(stats)
+	results.Emit()
+	if failed > 0 {
+		Die("%d bench records failed", failed)
+	}
+}
+
+// The bench-consume subcommand reads each partition from its start to its
+// high watermark, one partition at a time and without validating anything,
+// to baseline read throughput and latency.  With --admin_api, reads are
+// split by where the broker served them from: below a partition's local
+// log start, records can only have come from tiered storage.
+
+type BenchConsumeStats struct {
+	Records int64
+	Bytes   int64
+	Seconds float64
+
+	RecordsPerSec float64
+	MBPerSec      float64
+	Partitions    map[int32]*BenchPartitionStats
+	// Keyed local, remote, or unknown without --admin_api
+	Sources map[string]*BenchSourceStats
+}
+
+type BenchPartitionStats struct {
+	Records  int64
+	Bytes    int64
+	Errors   int64
+	Seconds  float64
+	MBPerSec float64
+}
+
+type BenchSourceStats struct {
+	Polls   int64
+	Records int64
+	Bytes   int64
+	Seconds float64
+
+	MBPerSec float64
+	// Time spent waiting for each poll to return records
+	LatencyMs map[string]float64
+
+	latency LatencyHistogram
+}
+
+// Where records at an offset are read from, given the partition's local
+// log start, or -1 if we don't know it
+func benchSource(o int64, localStart int64) string {
+	switch {
+	case localStart < 0:
+		return "unknown"
+	case o < localStart:
+		return "remote"
+	default:
+		return "local"
+	}
+}
+
+func benchConsume() {
+	if len(*topic) == 0 {
+		Die("bench-consume requires --topic")
+	}
+	client := newClient(nil)
+	t, _, err := getTopicMetadata(client)
+	Chk(err, "%v", err)
+	nPartitions := int32(len(t.Partitions))
+	start, err := getOffsets(client, nPartitions, -2)
+	ChkEmit(err, "%v", err)
+	hwm, err := getOffsetsIsolated(client, nPartitions, -1, readIsolationLevel())
+	ChkEmit(err, "%v", err)
+	closeClient(client)
+
+	var admin *AdminClient
+	if len(*adminApi) > 0 {
+		admin = NewAdminClient(*adminApi)
+	}
+
+	stats := BenchConsumeStats{
+		Partitions: make(map[int32]*BenchPartitionStats),
+		Sources:    make(map[string]*BenchSourceStats),
+	}
+	source := func(name string) *BenchSourceStats {
+		ss, ok := stats.Sources[name]
+		if !ok {
+			ss = &BenchSourceStats{}
+			stats.Sources[name] = ss
+		}
+		return ss
+	}
+
+	begin := time.Now()
+	for p := int32(0); p < nPartitions && runCtx.Err() == nil; p++ {
+		if !ownsPartition(p) || start[p] >= hwm[p] {
+			continue
+		}
+
+		localStart := int64(-1)
+		if admin != nil {
+			status, err := admin.GetCloudStorageStatus(*topic, p)
+			if err != nil {
+				log.Warnf("Error getting cloud storage status of %s/%d, read source unknown: %v", *topic, p, err)
+			} else {
+				localStart = status.LocalLogStartOffset
+			}
+		}
+		log.Infof("Bench reading %s/%d from %d to %d (local log from %d)", *topic, p, start[p], hwm[p], localStart)
+
+		ps := benchConsumePartition(p, start[p], hwm[p], localStart, source)
+		stats.Partitions[p] = ps
+		stats.Records += ps.Records
+		stats.Bytes += ps.Bytes
+		log.Infof("Bench read %d records from %s/%d in %.1fs: %.2f MB/s",
+			ps.Records, *topic, p, ps.Seconds, ps.MBPerSec)
+	}
+	elapsed := time.Since(begin)
+
+	stats.Seconds = elapsed.Seconds()
+	stats.RecordsPerSec = float64(stats.Records) / elapsed.Seconds()
+	stats.MBPerSec = float64(stats.Bytes) / elapsed.Seconds() / (1024 * 1024)
+	percentiles := []float64{50, 90, 99, 99.9, 100}
+	names := []string{"p50", "p90", "p99", "p999", "max"}
+	for name, ss := range stats.Sources {
+		ss.LatencyMs = make(map[string]float64)
+		for i, ms := range ss.latency.Percentiles(percentiles) {
+			ss.LatencyMs[names[i]] = ms
+		}
+		if ss.Seconds > 0 {
+			ss.MBPerSec = float64(ss.Bytes) / ss.Seconds / (1024 * 1024)
+		}
+		log.Infof("Bench %s reads: %d records, %.2f MB/s, poll latency p50 %.1fms, p99 %.1fms, max %.1fms",
+			name, ss.Records, ss.MBPerSec, ss.LatencyMs["p50"], ss.LatencyMs["p99"], ss.LatencyMs["max"])
+	}
+	log.Infof("Bench read %d records in %v: %.1f records/s, %.2f MB/s",
+		stats.Records, elapsed.Round(time.Millisecond), stats.RecordsPerSec, stats.MBPerSec)
+
+	failed := int64(0)
+	for _, ps := range stats.Partitions {
+		failed += ps.Errors
+	}
+	if failed > 0 {
+		log.Warnf("%d fetch errors during bench-consume", failed)
+	}
+	results.SetBenchConsume(stats)
+	results.Emit()
+}
+
+// Read one partition from `from` up to `upTo`, timing each poll and
+// charging it to the source of its first record
+func benchConsumePartition(p int32, from int64, upTo int64, localStart int64, source func(string) *BenchSourceStats) *BenchPartitionStats {
+	offsets := map[string]map[int32]kgo.Offset{
+		*topic: {p: kgo.NewOffset().At(from)},
+	}
+	client := newClient([]kgo.Opt{kgo.ConsumePartitions(offsets)})
+	defer closeClient(client)
+
+	ps := &BenchPartitionStats{}
+	next := from
+	emptyPolls := 0
+	begin := time.Now()
+	for next < upTo && runCtx.Err() == nil {
+		ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+		polled := time.Now()
+		fetches := client.PollFetches(ctx)
+		latency := time.Since(polled)
+		cancel()
+		fetches.EachError(func(t string, p int32, err error) {
+			if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+				log.Warnf("Error reading %s/%d: %v", t, p, err)
+				ps.Errors += 1
+			}
+		})
+
+		records := fetches.Records()
+		if len(records) == 0 {
+			emptyPolls += 1
+			if emptyPolls > 6 {
+				log.Warnf("No progress reading %s/%d at %d, giving up on it", *topic, p, next)
+				break
+			}
+			continue
+		}
+		emptyPolls = 0
+
+		ss := source(benchSource(records[0].Offset, localStart))
+		ss.Polls += 1
+		ss.Seconds += latency.Seconds()
+		ss.latency.Observe(latency)
+		for _, r := range records {
+			if r.Offset >= upTo {
+				break
+			}
+			size := int64(len(r.Key) + len(r.Value))
+			ps.Records += 1
+			ps.Bytes += size
+			ss.Records += 1
+			ss.Bytes += size
+			next = r.Offset + 1
+		}
+	}
+	ps.Seconds = time.Since(begin).Seconds()
+	if ps.Seconds > 0 {
+		ps.MBPerSec = float64(ps.Bytes) / ps.Seconds / (1024 * 1024)
+	}
+	return ps
+}
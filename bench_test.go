@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistBucket(t *testing.T) {
+	prev := -1
+	for _, us := range []int64{-5, 0, 1, 63, 64, 65, 127, 128, 129, 1000, 1 << 20, 1<<20 + 1, 1e9, math.MaxInt64} {
+		b := histBucket(us)
+		if b < 0 || b >= histBuckets {
+			t.Fatalf("histBucket(%d) = %d, out of range", us, b)
+		}
+		if b < prev {
+			t.Errorf("histBucket(%d) = %d, below the bucket of a smaller latency", us, b)
+		}
+		prev = b
+		max := histBucketMax(b)
+		if us >= 0 && (max < us || float64(max-us) > float64(us)/histSubBuckets) {
+			t.Errorf("histBucket(%d) = %d, whose max %d is not within 1/%d", us, b, max, histSubBuckets)
+		}
+		if b > 0 && us >= 0 && histBucketMax(b-1) >= us {
+			t.Errorf("histBucket(%d) = %d, but the bucket below holds up to %d", us, b, histBucketMax(b-1))
+		}
+	}
+	// Exact below the sub-bucket count
+	for us := int64(0); us < histSubBuckets; us++ {
+		if histBucket(us) != int(us) || histBucketMax(int(us)) != us {
+			t.Errorf("latency %dus not bucketed exactly", us)
+		}
+	}
+}
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	var lh LatencyHistogram
+	if got := lh.Percentiles([]float64{50}); !reflect.DeepEqual(got, []float64{0}) {
+		t.Errorf("empty histogram percentiles %v", got)
+	}
+	for i := 1; i <= 100; i++ {
+		lh.Observe(time.Duration(i) * time.Millisecond)
+	}
+	got := lh.Percentiles([]float64{0, 50, 99, 100})
+	for i, want := range []float64{1, 51, 100, 100} {
+		if got[i] < want || got[i] > want*(1+1.0/histSubBuckets) {
+			t.Errorf("percentile %d: %vms, want about %vms", i, got[i], want)
+		}
+	}
+}
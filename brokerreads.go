@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Reads attributed to the brokers that served them, so that one node
+// returning errors or answering slowly stands out from its peers.  Fetch
+// latency includes the time a broker holds a fetch waiting for data, so is
+// only comparable between brokers within a run.
+type BrokerReadStats struct {
+	Fetches int64
+	// Fetch requests that failed outright, e.g. on a broken connection
+	Errors int64
+	// Partitions in fetch responses that carried an error code, e.g.
+	// NotLeaderForPartition
+	PartitionErrors int64
+	Records         int64
+	Bytes           int64
+
+	TotalLatencyMs int64
+	MaxLatencyMs   int64
+}
+
+type brokerReadHook struct{}
+
+func (brokerReadHook) OnBrokerE2E(meta kgo.BrokerMetadata, key int16, e2e kgo.BrokerE2E) {
+	if key != kmsg.Fetch.Int16() {
+		return
+	}
+	results.AddBrokerFetch(meta.NodeID, e2e.DurationE2E(), e2e.Err())
+}
+
+func (brokerReadHook) OnFetchBatchRead(meta kgo.BrokerMetadata, t string, _ int32, metrics kgo.FetchBatchMetrics) {
+	if t != *topic {
+		return
+	}
+	results.AddBrokerRecords(meta.NodeID, int64(metrics.NumRecords), int64(metrics.UncompressedBytes))
+}
+
+// Count a partition's fetch error against the broker, if the broker sent
+// it rather than the client giving up.  The response doesn't reach us, so
+// the broker is the one we last fetched the partition from.
+func noteFetchPartitionError(p int32, err error) {
+	var ke *kerr.Error
+	if !errors.As(err, &ke) {
+		return
+	}
+	results.AddBrokerPartitionError(fetchSource(p))
+}
+
+func (bs *BrokerReadStats) noteFetch(latency time.Duration, err error) {
+	ms := latency.Milliseconds()
+	bs.Fetches += 1
+	bs.TotalLatencyMs += ms
+	if ms > bs.MaxLatencyMs {
+		bs.MaxLatencyMs = ms
+	}
+	if err != nil {
+		bs.Errors += 1
+	}
+}
+
+// Log a line per broker, in broker order
+func reportBrokerReads() {
+	results.lock.Lock()
+	defer results.lock.Unlock()
+
+	var brokers []int32
+	for b := range results.BrokerReads {
+		brokers = append(brokers, b)
+	}
+	sort.Slice(brokers, func(i, j int) bool { return brokers[i] < brokers[j] })
+	for _, b := range brokers {
+		bs := results.BrokerReads[b]
+		mean := int64(0)
+		if bs.Fetches > 0 {
+			mean = bs.TotalLatencyMs / bs.Fetches
+		}
+		msg := "Broker %d served %d fetches (%d errors, %d partition errors), %d records, %d bytes; fetch latency mean %dms, max %dms"
+		if bs.Errors > 0 || bs.PartitionErrors > 0 {
+			log.Warnf(msg, b, bs.Fetches, bs.Errors, bs.PartitionErrors, bs.Records, bs.Bytes, mean, bs.MaxLatencyMs)
+		} else {
+			log.Infof(msg, b, bs.Fetches, bs.Errors, bs.PartitionErrors, bs.Records, bs.Bytes, mean, bs.MaxLatencyMs)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+)
+
+// Payload buffers are recycled once the client is done with a record, so
+// that producing millions of large records doesn't leave the GC to clean
+// up after every one.  Payloads are all zeros, or random with --checksums,
+// so a recycled buffer needs no clearing; with --shared_payload, every
+// record points at the same read-only buffer and there is nothing to
+// recycle at all.
+
+var payloadPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, *mSize)
+		return &b
+	},
+}
+
+var sharedPayloadOnce sync.Once
+var sharedPayloadBuf []byte
+
+// A --msg_size payload for a new record
+func newPayload() []byte {
+	if *sharedPayload {
+		sharedPayloadOnce.Do(func() {
+			sharedPayloadBuf = make([]byte, *mSize)
+		})
+		return sharedPayloadBuf
+	}
+	return *payloadPool.Get().(*[]byte)
+}
+
+// Give back a payload from newPayload, once nothing will read it again.
+// Values that a record was given in place of its payload, such as
+// tombstones, are left alone.
+func releasePayload(b []byte) {
+	if *sharedPayload || len(b) != *mSize {
+		return
+	}
+	payloadPool.Put(&b)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// With --checksums, records get random payloads, and we keep a CRC of each
+// one's key and value by offset, so that reads catch a record whose key
+// is right but whose content is not: e.g. values swapped between offsets,
+// or a payload corrupted in a way that leaves the key readable.  Checksums
+// are kept in runs over consecutive offsets, so they cost four bytes per
+// record in state rather than an offset as well.
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func recordChecksum(r *kgo.Record) uint32 {
+	return contentChecksum(r.Key, r.Value)
+}
+
+func contentChecksum(key []byte, value []byte) uint32 {
+	sum := crc32.Update(0, castagnoli, key)
+	return crc32.Update(sum, castagnoli, value)
+}
+
+// Checksums of the records at consecutive offsets from Base
+type ChecksumRun struct {
+	Base int64
+	Sums []uint32
+}
+
+func (cr *ChecksumRun) upper() int64 {
+	return cr.Base + int64(len(cr.Sums))
+}
+
+func (ors *OffsetRanges) NoteChecksum(o int64, sum uint32) {
+	// Acks are applied in offset order on each partition, so runs stay sorted
+	if n := len(ors.Checksums); n > 0 && ors.Checksums[n-1].upper() == o {
+		ors.Checksums[n-1].Sums = append(ors.Checksums[n-1].Sums, sum)
+		return
+	}
+	ors.Checksums = append(ors.Checksums, ChecksumRun{Base: o, Sums: []uint32{sum}})
+}
+
+func (ors *OffsetRanges) LookupChecksum(o int64) (uint32, bool) {
+	i := sort.Search(len(ors.Checksums), func(i int) bool { return ors.Checksums[i].upper() > o })
+	if i < len(ors.Checksums) && ors.Checksums[i].Base <= o {
+		return ors.Checksums[i].Sums[o-ors.Checksums[i].Base], true
+	}
+	return 0, false
+}
+
+// Union of two sorted lists of runs.  Where they overlap they describe the
+// same records, so we keep whichever we saw first.
+func mergeChecksums(a []ChecksumRun, b []ChecksumRun) []ChecksumRun {
+	if len(b) == 0 {
+		return a
+	}
+	all := append(append([]ChecksumRun{}, a...), b...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Base < all[j].Base })
+
+	var merged []ChecksumRun
+	for _, cr := range all {
+		if n := len(merged); n > 0 && cr.Base <= merged[n-1].upper() {
+			last := &merged[n-1]
+			if cr.upper() > last.upper() {
+				last.Sums = append(last.Sums, cr.Sums[last.upper()-cr.Base:]...)
+			}
+		} else {
+			merged = append(merged, ChecksumRun{Base: cr.Base, Sums: append([]uint32{}, cr.Sums...)})
+		}
+	}
+	return merged
+}
+
+func trimChecksums(runs []ChecksumRun, o int64) []ChecksumRun {
+	i := sort.Search(len(runs), func(i int) bool { return runs[i].upper() > o })
+	if i == len(runs) {
+		return nil
+	}
+	runs = runs[i:]
+	if runs[0].Base < o {
+		runs[0] = ChecksumRun{Base: o, Sums: runs[0].Sums[o-runs[0].Base:]}
+	}
+	return runs
+}
+
+// Check a record's content against the checksum we recorded when we
+// produced it, if we did
+func validateChecksum(r *kgo.Record, ors *OffsetRanges) {
+	expected, ok := ors.LookupChecksum(r.Offset)
+	if !ok {
+		return
+	}
+	if found := recordChecksum(r); found != expected {
+		badRecord(r, ors, fmt.Sprintf("checksum %08x", expected), fmt.Sprintf("checksum %08x", found),
+			"Bad read at offset %d on partition %s/%d: content checksum %08x, expected %08x", r.Offset, *topic, r.Partition, found, expected)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// While reading in group mode, we periodically fetch the group's committed
+// offsets from its coordinator and compare them with what we know: a
+// committed offset must never fall below one that a commit of ours has
+// confirmed (a lost or regressed commit, e.g. after a coordinator
+// failover), must never be past what we have validated (nothing of ours
+// committed it), and should not lag our validated position by more than
+// we consume between commits.
+
+const (
+	driftRegressed = "regressed"
+	driftAhead     = "ahead"
+	driftLagging   = "lagging"
+)
+
+// A group's committed offset that disagrees with our own position
+type CommitDrift struct {
+	Partition int32
+	Problem   string
+	// The committed offset the coordinator gave us, the last offset our
+	// commits confirmed, and the next offset we would validate
+	Committed  int64
+	LastCommit int64
+	Validated  int64
+}
+
+// Our view of a group's position on each partition, for comparing with
+// the coordinator's
+type groupPositions struct {
+	lock      sync.Mutex
+	committed []int64
+	validated []int64
+	// Committed offsets may trail validated ones by this much
+	slack int64
+}
+
+// Positions of the group being read, or nil if we are not checking
+var groupPos *groupPositions
+
+func (gp *groupPositions) NoteValidated(p int32, o int64) {
+	if gp == nil {
+		return
+	}
+	gp.lock.Lock()
+	defer gp.lock.Unlock()
+	if o+1 > gp.validated[p] {
+		gp.validated[p] = o + 1
+	}
+}
+
+func (gp *groupPositions) NoteCommitted(p int32, o int64) {
+	if gp == nil {
+		return
+	}
+	gp.lock.Lock()
+	defer gp.lock.Unlock()
+	if o > gp.committed[p] {
+		gp.committed[p] = o
+	}
+}
+
+func (gp *groupPositions) snapshot(positions []int64) []int64 {
+	gp.lock.Lock()
+	defer gp.lock.Unlock()
+	return append([]int64{}, positions...)
+}
+
+// A group's committed offset on each partition, -1 where it has none
+func fetchGroupCommitted(client *kgo.Client, group string, nPartitions int32) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+	defer cancel()
+	offsets, err := kadm.NewClient(client).FetchOffsets(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	committed := make([]int64, nPartitions)
+	for p := range committed {
+		committed[p] = -1
+		if o, ok := offsets.Lookup(*topic, int32(p)); ok && o.Err == nil {
+			committed[p] = o.At
+		}
+	}
+	return committed, nil
+}
+
+// Where the group will start reading each partition: its committed
+// offset, or the start of the log if it has none there (or the log has
+// since been trimmed past it)
+func groupResumeOffsets(nPartitions int32, startAt []int64) []int64 {
+	client := newClient(nil)
+	committed, err := fetchGroupCommitted(client, *consumerGroup, nPartitions)
+	closeClient(client)
+	Chk(err, "Error fetching committed offsets of group %s: %v", *consumerGroup, err)
+
+	resumeAt := append([]int64{}, startAt...)
+	for p, c := range committed {
+		if c > resumeAt[p] {
+			resumeAt[p] = c
+		}
+	}
+	return resumeAt
+}
+
+// Check the group's committed offsets every --commit_check_interval until
+// the returned function is called, which fails the run if any were lost
+// or ahead of us.  `resumeAt` is where the group starts reading each
+// partition.
+func startCommitDriftChecks(nPartitions int32, resumeAt []int64, slack int64) func() {
+	if *commitCheckInterval == 0 {
+		return func() {}
+	}
+	gp := &groupPositions{
+		committed: make([]int64, nPartitions),
+		validated: append([]int64{}, resumeAt...),
+		slack:     slack,
+	}
+	for p := range gp.committed {
+		gp.committed[p] = -1
+	}
+	groupPos = gp
+
+	client := newClient(nil)
+	stop := make(chan struct{})
+	stopped := make(chan int)
+	go func() {
+		problems := 0
+		prevValidated := gp.snapshot(gp.validated)
+		ticker := time.NewTicker(*commitCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				stopped <- problems
+				return
+			case <-ticker.C:
+			}
+			problems += gp.check(client, prevValidated)
+			prevValidated = gp.snapshot(gp.validated)
+		}
+	}()
+
+	return func() {
+		close(stop)
+		problems := <-stopped
+		closeClient(client)
+		groupPos = nil
+		if problems > 0 {
+			results.Emit()
+			Die("%d lost or unexpected committed offsets in group %s", problems, *consumerGroup)
+		}
+	}
+}
+
+// Compare the coordinator's committed offsets with ours, returning how
+// many are lost or ahead of us
+func (gp *groupPositions) check(client *kgo.Client, prevValidated []int64) int {
+	// Our commits confirmed before the fetch must be reflected in it, and
+	// anything committed by the time it returns has been validated first
+	lastCommit := gp.snapshot(gp.committed)
+	committed, err := fetchGroupCommitted(client, *consumerGroup, int32(len(lastCommit)))
+	if err != nil {
+		log.Warnf("Error fetching committed offsets of group %s: %v", *consumerGroup, err)
+		return 0
+	}
+	validated := gp.snapshot(gp.validated)
+
+	problems := 0
+	for i, c := range committed {
+		p := int32(i)
+		if c < lastCommit[p] {
+			log.Errorf("Group %s committed offset on %s/%d regressed to %d, below our commit of %d", *consumerGroup, *topic, p, c, lastCommit[p])
+			gp.report(p, driftRegressed, c, lastCommit[p], validated[p])
+			problems += 1
+		} else if c > validated[p] {
+			log.Errorf("Group %s committed offset on %s/%d is %d, beyond what we have validated (%d)", *consumerGroup, *topic, p, c, validated[p])
+			gp.report(p, driftAhead, c, lastCommit[p], validated[p])
+			problems += 1
+		} else if c >= 0 && c < prevValidated[p]-gp.slack {
+			// Not necessarily wrong, e.g. if commits are failing during
+			// a disruption, but worth knowing about
+			log.Warnf("Group %s committed offset on %s/%d is %d, still behind where we had validated to a check ago (%d)", *consumerGroup, *topic, p, c, prevValidated[p])
+			gp.report(p, driftLagging, c, lastCommit[p], validated[p])
+		}
+	}
+	return problems
+}
+
+func (gp *groupPositions) report(p int32, problem string, committed int64, lastCommit int64, validated int64) {
+	results.AddCommitDrift(CommitDrift{
+		Partition:  p,
+		Problem:    problem,
+		Committed:  committed,
+		LastCommit: lastCommit,
+		Validated:  validated,
+	})
+}
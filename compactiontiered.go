@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Compaction and tiered storage each rewrite which records a partition
+// serves, and where they meet, object storage can end up holding segments
+// from before compaction, or compacted segments that lost a key's latest
+// version.  In --compaction_tiered mode we produce a keyed workload to a
+// compacted topic with tiered storage, wait for compaction to settle
+// locally, wait for uploads and trim local data as --upload_timeout and
+// --local_trim would, and then read everything back from object storage.
+// Each key must read back at its latest version, and reads must not
+// return more superseded versions than the compacted local log held.
+
+// Superseded records in the compacted local log, or -1 if not scanned
+var compactedSuperseded int64 = -1
+
+// Read every partition we own from start to HWM, counting our keyed
+// records and the distinct keys among them: the difference is how many
+// superseded versions compaction has yet to remove
+func scanKeys(nPartitions int32) (int64, int64) {
+	client := newClient(nil)
+	start, err := getOffsets(client, nPartitions, -2)
+	ChkEmit(err, "%v", err)
+	hwm, err := getOffsetsIsolated(client, nPartitions, -1, readIsolationLevel())
+	ChkEmit(err, "%v", err)
+	closeClient(client)
+
+	partOffsets := make(map[int32]kgo.Offset)
+	remaining := 0
+	for p := int32(0); p < nPartitions; p++ {
+		if ownsPartition(p) && hwm[p] > start[p] {
+			partOffsets[p] = kgo.NewOffset().At(start[p])
+			remaining += 1
+		}
+	}
+	if remaining == 0 {
+		return 0, 0
+	}
+	client = newClient([]kgo.Opt{kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{*topic: partOffsets})})
+	defer closeClient(client)
+
+	type partitionKey struct {
+		p   int32
+		key string
+	}
+	keys := make(map[partitionKey]struct{})
+	records := int64(0)
+	done := make([]bool, nPartitions)
+	emptyPolls := 0
+	for remaining > 0 && runCtx.Err() == nil {
+		ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+		fetches := client.PollFetches(ctx)
+		cancel()
+		fetches.EachError(func(t string, p int32, err error) {
+			log.Debugf("Error scanning %s/%d: %v", t, p, err)
+		})
+		if len(fetches.Records()) == 0 {
+			emptyPolls += 1
+			if emptyPolls > 6 {
+				log.Warnf("No progress scanning %s, %d partitions unfinished", *topic, remaining)
+				break
+			}
+			continue
+		}
+		emptyPolls = 0
+		fetches.EachRecord(func(r *kgo.Record) {
+			if done[r.Partition] || r.Offset >= hwm[r.Partition] {
+				return
+			}
+			if bytes.HasPrefix(r.Key, []byte(keyedPrefix)) {
+				records += 1
+				keys[partitionKey{r.Partition, string(r.Key)}] = struct{}{}
+			}
+			if r.Offset >= hwm[r.Partition]-1 {
+				done[r.Partition] = true
+				remaining -= 1
+			}
+		})
+	}
+	return records, int64(len(keys))
+}
+
+// Wait for compaction to stop removing superseded versions: the active
+// segment is never compacted, so there is no count to wait for, only for
+// successive scans to agree.  On timeout we carry on with what we have.
+func waitForCompaction(nPartitions int32) {
+	deadline := time.Now().Add(*compactionTimeout)
+	records, keys := scanKeys(nPartitions)
+	first := records - keys
+	last := first
+	log.Infof("Waiting for compaction of %s: %d records of %d keys", *topic, records, keys)
+	for {
+		time.Sleep(10 * time.Second)
+		records, keys = scanKeys(nPartitions)
+		superseded := records - keys
+		log.Infof("Compaction of %s: %d records of %d keys, %d superseded", *topic, records, keys, superseded)
+		if superseded == 0 || (superseded < first && superseded == last) {
+			compactedSuperseded = superseded
+			log.Infof("Compaction of %s settled, %d superseded versions remain", *topic, superseded)
+			return
+		} else if time.Now().After(deadline) {
+			compactedSuperseded = superseded
+			log.Warnf("Compaction of %s still going after %v, %d superseded versions remain", *topic, *compactionTimeout, superseded)
+			return
+		}
+		last = superseded
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Besides the command line, flags may be set from environment variables
+// (SI_VERIFIER_ followed by the flag name in upper case, e.g.
+// SI_VERIFIER_BROKERS), and from YAML or JSON config files mapping flag
+// names to values.  Several config files may be given, so that e.g. a
+// per-cluster file holding connection and auth settings can be reused with
+// different workload files.
+//
+// The command line takes precedence over the environment, which takes
+// precedence over config files, later files overriding earlier ones.
+
+const envPrefix = "SI_VERIFIER_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(flagName)
+}
+
+// Read a config file into flag values
+func loadConfigFile(path string) map[string]string {
+	data, err := ioutil.ReadFile(path)
+	Chk(err, "Error reading config file %s: %v", path, err)
+
+	var raw map[string]interface{}
+	err = yaml.Unmarshal(data, &raw)
+	Chk(err, "Bad config file %s: %v", path, err)
+
+	values := make(map[string]string)
+	for name, v := range raw {
+		switch v := v.(type) {
+		case []interface{}:
+			// e.g. a list of brokers
+			var items []string
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case map[interface{}]interface{}:
+			Die("Bad value for '%s' in config file %s: nested settings are not supported", name, path)
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values
+}
+
+// Apply environment variables and config files to any flags not given on
+// the command line.  Must be called after flag.Parse.
+func applyConfig() {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	paths := *configFiles
+	if !explicit["config"] {
+		if env, ok := os.LookupEnv(envName("config")); ok {
+			paths = env
+		}
+	}
+
+	fromFiles := make(map[string]string)
+	sources := make(map[string]string)
+	if len(paths) > 0 {
+		for _, path := range strings.Split(paths, ",") {
+			for name, v := range loadConfigFile(path) {
+				if flag.Lookup(name) == nil {
+					Die("Unknown setting '%s' in config file %s", name, path)
+				}
+				fromFiles[name] = v
+				sources[name] = path
+			}
+		}
+	}
+
+	// Which flags came from where, to log once we know the log level, which
+	// may itself have come from here
+	var applied []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			err := f.Value.Set(v)
+			Chk(err, "Bad value '%s' for %s: %v", v, envName(f.Name), err)
+			applied = append(applied, fmt.Sprintf("Set %s from %s", f.Name, envName(f.Name)))
+		} else if v, ok := fromFiles[f.Name]; ok {
+			err := f.Value.Set(v)
+			Chk(err, "Bad value '%s' for %s in %s: %v", v, f.Name, sources[f.Name], err)
+			applied = append(applied, fmt.Sprintf("Set %s from %s", f.Name, sources[f.Name]))
+		}
+	})
+
+	setLogLevel()
+	for _, msg := range applied {
+		log.Debug(msg)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Connections and traffic per broker, across all clients.  Like throttling,
+// these are keyed by the cluster role and broker ID.  Connections churning,
+// dials failing to one broker, or traffic all landing on one broker point
+// at load balancers or advertised listeners rather than at the brokers
+// themselves.
+type ConnectionStats struct {
+	Opened       int64
+	Closed       int64
+	DialFailures int64
+	BytesWritten int64
+	BytesRead    int64
+}
+
+type connectionHook struct {
+	role string
+}
+
+func (h connectionHook) OnBrokerConnect(meta kgo.BrokerMetadata, dialDur time.Duration, _ net.Conn, err error) {
+	if err != nil {
+		log.Debugf("Dial to %s broker %d (%s:%d) failed after %v: %v", h.role, meta.NodeID, meta.Host, meta.Port, dialDur, err)
+	}
+	results.AddConnection(h.key(meta), err)
+}
+
+func (h connectionHook) OnBrokerDisconnect(meta kgo.BrokerMetadata, _ net.Conn) {
+	results.AddDisconnection(h.key(meta))
+}
+
+// Bytes moved to and from one broker.  Every request and response passes
+// through the hook, so these are counted with atomics rather than under
+// results.lock, and copied into the results when they are reported.
+type brokerTraffic struct {
+	written int64
+	read    int64
+}
+
+// Traffic per broker, keyed as the results' Connections
+var traffic sync.Map
+
+func trafficFor(key string) *brokerTraffic {
+	if bt, ok := traffic.Load(key); ok {
+		return bt.(*brokerTraffic)
+	}
+	bt, _ := traffic.LoadOrStore(key, &brokerTraffic{})
+	return bt.(*brokerTraffic)
+}
+
+func (h connectionHook) OnBrokerWrite(meta kgo.BrokerMetadata, _ int16, bytesWritten int, _, _ time.Duration, _ error) {
+	atomic.AddInt64(&trafficFor(h.key(meta)).written, int64(bytesWritten))
+}
+
+func (h connectionHook) OnBrokerRead(meta kgo.BrokerMetadata, _ int16, bytesRead int, _, _ time.Duration, _ error) {
+	atomic.AddInt64(&trafficFor(h.key(meta)).read, int64(bytesRead))
+}
+
+// Copy the traffic counters into the results.  The caller holds r.lock.
+func (r *Results) syncTraffic() {
+	traffic.Range(func(key, bt interface{}) bool {
+		cs := r.connections(key.(string))
+		cs.BytesWritten = atomic.LoadInt64(&bt.(*brokerTraffic).written)
+		cs.BytesRead = atomic.LoadInt64(&bt.(*brokerTraffic).read)
+		return true
+	})
+}
+
+// Brokers are keyed by their node ID.  Connections to seed brokers keep
+// the IDs franz-go gives seeds, counting up from math.MinInt32, even once
+// the broker's real ID is known, so show up under their own keys.
+func (h connectionHook) key(meta kgo.BrokerMetadata) string {
+	return fmt.Sprintf("%s/%d", h.role, meta.NodeID)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// With --consume_delay, the sequential reader pretends to be a slow
+// consumer, sleeping after each record or each batch it is handed.  A
+// reader that falls far behind the producer makes brokers serve old data
+// while new data arrives, which is when tiered storage's read path and
+// caches see the most churn.
+
+const (
+	consumeDelayRecord = "record"
+	consumeDelayBatch  = "batch"
+)
+
+// Sleep as a slow consumer would after processing `n` records, from
+// `batches` batches.  Returns early if ctx is done.
+func consumeDelay(ctx context.Context, n int, batches int) {
+	if *consumeDelayTime <= 0 {
+		return
+	}
+	units := batches
+	if *consumeDelayPer == consumeDelayRecord {
+		units = n
+	}
+	if units == 0 {
+		return
+	}
+	timer := time.NewTimer(time.Duration(units) * *consumeDelayTime)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
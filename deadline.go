@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// --timeout bounds the whole run, so that a wedged broker cannot hang us
+// forever.  Requests are made with runCtx, which is cancelled at the
+// deadline; we then run any registered flushes (e.g. storing the
+// producer's state), emit results and exit with exitTimeout.
+
+const exitTimeout = 4
+
+// Cancelled at --timeout, if set
+var runCtx = context.Background()
+
+var deadline struct {
+	lock  sync.Mutex
+	next  int
+	hooks map[int]func()
+	once  sync.Once
+}
+
+func startDeadline(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	runCtx = ctx
+	go func() {
+		<-ctx.Done()
+		cancel()
+		timeoutExit()
+	}()
+}
+
+// Register something to do before exiting on timeout: call the returned
+// func once it no longer applies
+func onTimeout(fn func()) func() {
+	deadline.lock.Lock()
+	defer deadline.lock.Unlock()
+	if deadline.hooks == nil {
+		deadline.hooks = make(map[int]func())
+	}
+	id := deadline.next
+	deadline.next += 1
+	deadline.hooks[id] = fn
+	return func() {
+		deadline.lock.Lock()
+		defer deadline.lock.Unlock()
+		delete(deadline.hooks, id)
+	}
+}
+
+func timedOut() bool {
+	return runCtx.Err() != nil
+}
+
+// Exit for the timeout.  Whoever gets here first does the work, and anyone
+// else (e.g. a request failing because its context was cancelled) waits
+// for them to exit.
+func timeoutExit() {
+	deadline.once.Do(func() {
+		log.Errorf("Run timed out after %v", *timeout)
+
+		deadline.lock.Lock()
+		hooks := make([]func(), 0, len(deadline.hooks))
+		for _, fn := range deadline.hooks {
+			hooks = append(hooks, fn)
+		}
+		deadline.lock.Unlock()
+		for _, fn := range hooks {
+			fn()
+		}
+
+		results.SetTimedOut()
+		results.Emit()
+		os.Exit(exitTimeout)
+	})
+	select {}
+}
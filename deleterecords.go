@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+)
+
+// With --delete_records, we advance the start offset of random partitions
+// with DeleteRecords before reading, and check that the prefix really is
+// gone (reads below the new start offset get OffsetOutOfRange) while the
+// rest of the partition still validates.  With tiered storage, the prefix
+// may be partly or wholly in object storage, so this checks that remote
+// reads respect the start offset as well as local ones.
+
+// Forget ranges below a new start offset
+func (ors *OffsetRanges) TrimBelow(o int64) {
+	var kept []OffsetRange
+	for _, r := range ors.Ranges {
+		if r.Upper <= o {
+			continue
+		}
+		if r.Lower < o {
+			r.Lower = o
+		}
+		kept = append(kept, r)
+	}
+	ors.Ranges = kept
+	ors.Tombstones = trimOffsets(ors.Tombstones, o)
+	ors.EmptyValues = trimOffsets(ors.EmptyValues, o)
+	ors.Unexpected = trimUnexpected(ors.Unexpected, o)
+	ors.Checksums = trimChecksums(ors.Checksums, o)
+	ors.ProduceTimes = trimProduceTimes(ors.ProduceTimes, o)
+	ors.BadTimestamps = trimBadTimestamps(ors.BadTimestamps, o)
+	ors.Timestamps = trimTimestamps(ors.Timestamps, o)
+	ors.ValueSizes = trimValueSizes(ors.ValueSizes, o)
+	ors.Leaders = trimLeaders(ors.Leaders, o)
+	if ors.Digest != nil && ors.Digest.Lower < o {
+		// No way to take records back out of a digest
+		ors.Digest = nil
+	}
+	for i := range ors.Bitmaps {
+		ors.Bitmaps[i].Offsets.RemoveBelow(o)
+	}
+}
+
+func deleteRecords(nPartitions int32) {
+	client := newClient(nil)
+	defer closeClient(client)
+	adm := kadm.NewClient(client)
+
+	lwm, hwm, err := getOffsetBounds(client, nPartitions)
+	ChkEmit(err, "%v", err)
+	leaders, err := getPartitionLeaders(client, nPartitions)
+	Chk(err, "%v", err)
+	t, _, err := getTopicMetadata(client)
+	Chk(err, "%v", err)
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+	rng := newRand("delete_records")
+
+	for i := 0; i < *deleteRecordsCount; i++ {
+		p := pickPartition(rng, nPartitions)
+		if hwm[p]-lwm[p] < 2 {
+			log.Infof("Partition %s/%d too small to delete records from", *topic, p)
+			continue
+		}
+		// Delete at least one record, and leave at least one
+		target := lwm[p] + 1 + rng.Int63n(hwm[p]-lwm[p]-1)
+		log.Infof("Deleting records on %s/%d below %d (start offset %d)", *topic, p, target, lwm[p])
+
+		offsets := kadm.Offsets{*topic: {p: kadm.Offset{Topic: *topic, Partition: p, At: target, LeaderEpoch: -1}}}
+		resps, err := adm.DeleteRecords(runCtx, offsets)
+		Chk(err, "Error deleting records on %s/%d: %v", *topic, p, err)
+		resp, err := resps.On(*topic, p, nil)
+		Chk(err, "Error deleting records on %s/%d: %v", *topic, p, err)
+		Chk(resp.Err, "Error deleting records on %s/%d: %v", *topic, p, resp.Err)
+		if resp.LowWatermark < target {
+			Die("DeleteRecords on %s/%d below %d left start offset at %d", *topic, p, target, resp.LowWatermark)
+		}
+		results.AddPrefixTruncation(PrefixTruncation{Partition: p, PrevStart: lwm[p], Start: resp.LowWatermark})
+		lwm[p] = resp.LowWatermark
+		validRanges.PartitionRanges[p].TrimBelow(lwm[p])
+
+		// The record just below the new start must be gone...
+		_, err = fetchFromReplica(client, leaders[p], t, p, lwm[p]-1)
+		if !errors.Is(err, kerr.OffsetOutOfRange) {
+			results.Emit()
+			Die("Read at %d on %s/%d below deleted start offset %d: expected OffsetOutOfRange, got %v", lwm[p]-1, *topic, p, lwm[p], err)
+		}
+
+		// ...and the one at it still readable
+		r, err := readRecordAt(p, lwm[p])
+		Chk(err, "Error reading new start offset %d on %s/%d: %v", lwm[p], *topic, p, err)
+		if r.Offset < lwm[p] {
+			results.Emit()
+			Die("Read at new start offset %d on %s/%d returned deleted offset %d", lwm[p], *topic, p, r.Offset)
+		}
+		validateRecord(r, &validRanges)
+	}
+
+	err = validRanges.Store()
+	Chk(err, "Error storing state after deleting records: %v", err)
+}
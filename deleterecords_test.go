@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Trimming drops everything below the new start offset, in every field
+func TestTrimBelow(t *testing.T) {
+	ors := OffsetRanges{
+		Ranges:        []OffsetRange{{Lower: 0, Upper: 4}, {Lower: 6, Upper: 10}},
+		Tombstones:    []int64{1, 7},
+		EmptyValues:   []int64{2, 8},
+		Unexpected:    []UnexpectedRecord{{Offset: 3}, {Offset: 9}},
+		Checksums:     []ChecksumRun{{Base: 0, Sums: []uint32{0, 1, 2, 3}}, {Base: 6, Sums: []uint32{6, 7, 8, 9}}},
+		ProduceTimes:  []ProduceTime{{Offset: 3}, {Offset: 9}},
+		BadTimestamps: []BadTimestamp{{Offset: 2}, {Offset: 8}},
+		ValueSizes:    []SizeRun{{Base: 0, Count: 10, Size: 50}},
+		Leaders:       []LeaderRun{{Base: 0, Count: 4, Leader: 1, Epoch: 1}, {Base: 6, Count: 4, Leader: 2, Epoch: 2}},
+		Digest:        &PartitionDigest{Lower: 0},
+	}
+	for o := int64(0); o < 10; o++ {
+		ors.NoteTimestamp(o, time.UnixMilli(1000+o))
+	}
+
+	ors.TrimBelow(7)
+
+	if !reflect.DeepEqual(ors.Ranges, []OffsetRange{{Lower: 7, Upper: 10}}) {
+		t.Errorf("Ranges %v", ors.Ranges)
+	}
+	if !reflect.DeepEqual(ors.Tombstones, []int64{7}) || !reflect.DeepEqual(ors.EmptyValues, []int64{8}) {
+		t.Errorf("Tombstones %v EmptyValues %v", ors.Tombstones, ors.EmptyValues)
+	}
+	if len(ors.Unexpected) != 1 || ors.Unexpected[0].Offset != 9 {
+		t.Errorf("Unexpected %v", ors.Unexpected)
+	}
+	if !reflect.DeepEqual(ors.Checksums, []ChecksumRun{{Base: 7, Sums: []uint32{7, 8, 9}}}) {
+		t.Errorf("Checksums %v", ors.Checksums)
+	}
+	if len(ors.ProduceTimes) != 1 || len(ors.BadTimestamps) != 1 {
+		t.Errorf("ProduceTimes %v BadTimestamps %v", ors.ProduceTimes, ors.BadTimestamps)
+	}
+	if !reflect.DeepEqual(ors.ValueSizes, []SizeRun{{Base: 7, Count: 3, Size: 50}}) {
+		t.Errorf("ValueSizes %v", ors.ValueSizes)
+	}
+	if !reflect.DeepEqual(ors.Leaders, []LeaderRun{{Base: 7, Count: 3, Leader: 2, Epoch: 2}}) {
+		t.Errorf("Leaders %v", ors.Leaders)
+	}
+	if ts, ok := ors.LookupTimestamp(8); !ok || ts != 1008 {
+		t.Errorf("timestamp at 8: %d %v", ts, ok)
+	}
+	if _, ok := ors.LookupTimestamp(6); ok {
+		t.Errorf("timestamp at 6 survived")
+	}
+	if ors.Digest != nil {
+		t.Errorf("digest of trimmed records kept")
+	}
+}
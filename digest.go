@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// With --partition_digest, we keep a rolling hash over the records we
+// produce to each partition, and forward sequential reads compute the same
+// hash over what they consume: one comparison then covers every record in
+// the stretch, with no per-offset state.  Digests are in the results, so
+// that reads of the same topic on two clusters (e.g. a source and its
+// mirror) can be compared too.
+//
+// A digest covers one unbroken run of offsets that we produced, so a gap
+// (e.g. another producer writing to the partition) starts a new one, and
+// a start offset moving past its beginning means it can't be checked.
+
+var digestTable = crc64.MakeTable(crc64.ECMA)
+
+// A rolling hash over the records at offsets [Lower, Upper)
+type PartitionDigest struct {
+	Lower int64
+	Upper int64
+	Sum   uint64
+}
+
+// Fold a record, by its offset and content checksum, into a digest
+func foldDigest(sum uint64, o int64, recordSum uint32) uint64 {
+	var buf [12]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(o))
+	binary.BigEndian.PutUint32(buf[8:], recordSum)
+	return crc64.Update(sum, digestTable, buf[:])
+}
+
+func (ors *OffsetRanges) NoteDigest(o int64, recordSum uint32) {
+	d := ors.Digest
+	if d == nil || d.Upper != o {
+		if d != nil {
+			log.Debugf("Gap in produced offsets at %d (digest covered %d-%d), starting a new digest", o, d.Lower, d.Upper)
+		}
+		d = &PartitionDigest{Lower: o, Upper: o}
+		ors.Digest = d
+	}
+	d.Sum = foldDigest(d.Sum, o, recordSum)
+	d.Upper = o + 1
+}
+
+// Of two digests of one partition, the one covering later offsets
+func mergeDigest(a *PartitionDigest, b *PartitionDigest) *PartitionDigest {
+	if a == nil || (b != nil && b.Upper > a.Upper) {
+		return b
+	}
+	return a
+}
+
+// The outcome of checking a partition's digest, for the results
+type DigestCheck struct {
+	Partition int32
+	Lower     int64
+	Upper     int64
+	Expected  uint64
+	Found     uint64
+	// Where the read stopped, if it did not reach Upper
+	ReadUpper int64
+}
+
+// A digest being computed over the records a read consumes
+type digestReader struct {
+	expect PartitionDigest
+	next   int64
+	sum    uint64
+}
+
+// The digests being computed by a forward sequential read, by partition
+var readDigests map[int32]*digestReader
+
+// Start computing digests for a read of [start, hwm), for the partitions
+// where it will cover everything a digest does
+func startReadDigests(nPartitions int32, validRanges *TopicOffsetRanges, start []int64, hwm []int64) {
+	readDigests = make(map[int32]*digestReader)
+	for p := int32(0); p < nPartitions; p++ {
+		d := validRanges.PartitionRanges[p].Digest
+		if d == nil || !ownsPartition(p) {
+			continue
+		}
+		if start[p] > d.Lower || hwm[p] < d.Upper {
+			log.Infof("Not checking digest of %s/%d: it covers %d-%d, but the read covers %d-%d", *topic, p, d.Lower, d.Upper, start[p], hwm[p])
+			continue
+		}
+		readDigests[p] = &digestReader{expect: *d, next: d.Lower}
+	}
+}
+
+func observeDigest(r *kgo.Record) {
+	dr := readDigests[r.Partition]
+	// Records before the digest, past it, or read again after a restart
+	if dr == nil || r.Offset < dr.next || r.Offset >= dr.expect.Upper {
+		return
+	}
+	dr.sum = foldDigest(dr.sum, r.Offset, recordChecksum(r))
+	dr.next = r.Offset + 1
+}
+
+// Compare the digests a read computed with those we recorded on produce
+func checkReadDigests() {
+	for p, dr := range readDigests {
+		check := DigestCheck{
+			Partition: p,
+			Lower:     dr.expect.Lower,
+			Upper:     dr.expect.Upper,
+			Expected:  dr.expect.Sum,
+			Found:     dr.sum,
+		}
+		if dr.next != dr.expect.Upper {
+			check.ReadUpper = dr.next
+		}
+		results.AddDigestCheck(check)
+
+		if dr.next != dr.expect.Upper || dr.sum != dr.expect.Sum {
+			reportCorruption(Corruption{
+				Partition: p,
+				Offset:    dr.expect.Lower,
+				Expected:  fmt.Sprintf("digest %016x over %d-%d", dr.expect.Sum, dr.expect.Lower, dr.expect.Upper),
+				Found:     fmt.Sprintf("digest %016x over %d-%d", dr.sum, dr.expect.Lower, dr.next),
+				Broker:    fetchSource(p),
+			}, fmt.Sprintf("Digest mismatch on %s/%d over offsets %d-%d: expected %016x, read %016x up to %d",
+				*topic, p, dr.expect.Lower, dr.expect.Upper, dr.expect.Sum, dr.sum, dr.next))
+		} else {
+			log.Infof("Digest of %s/%d matched over offsets %d-%d", *topic, p, dr.expect.Lower, dr.expect.Upper)
+		}
+	}
+	readDigests = nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+)
+
+var errorClasses = []string{"kafka_retriable", "kafka", "network", "timeout", "other"}
+
+// Per-class overrides of --disruption_budget, parsed from --disruption_budget_classes
+var disruptionBudgets = make(map[string]time.Duration)
+
+func parseDisruptionBudgets(s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("expected class=duration, got " + kv)
+		}
+		known := false
+		for _, c := range errorClasses {
+			if c == parts[0] {
+				known = true
+			}
+		}
+		if !known {
+			return errors.New("unknown error class " + parts[0] + ", must be one of " + strings.Join(errorClasses, ", "))
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return err
+		}
+		disruptionBudgets[parts[0]] = d
+	}
+	return nil
+}
+
+func classifyError(err error) string {
+	var kErr *kerr.Error
+	if errors.As(err, &kErr) {
+		if kErr.Retriable {
+			return "kafka_retriable"
+		}
+		return "kafka"
+	}
+	if errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) {
+		return "timeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "network"
+	}
+	return "other"
+}
+
+// Tracks runs of consecutive errors in one part of the workload (e.g. the
+// sequential reader), so that we can ride out disruptions like rolling
+// restarts up to a point, and report how long we were disrupted for.
+type DisruptionTracker struct {
+	what       string
+	start      time.Time
+	classStart map[string]time.Time
+	errors     map[string]int
+	attempts   int
+}
+
+func NewDisruptionTracker(what string) *DisruptionTracker {
+	return &DisruptionTracker{what: what}
+}
+
+func (d *DisruptionTracker) budget(class string) time.Duration {
+	if b, ok := disruptionBudgets[class]; ok {
+		return b
+	}
+	return *disruptionBudget
+}
+
+// Record an error.  Returns an error if this class of error has persisted
+// for longer than its budget, otherwise the caller should retry (see
+// Backoff).
+func (d *DisruptionTracker) Error(err error) error {
+	now := time.Now()
+	class := classifyError(err)
+	if d.attempts == 0 {
+		d.start = now
+		d.classStart = make(map[string]time.Time)
+		d.errors = make(map[string]int)
+	}
+	if _, ok := d.classStart[class]; !ok {
+		d.classStart[class] = now
+	}
+	d.errors[class] += 1
+	d.attempts += 1
+	progress.Error()
+
+	elapsed := now.Sub(d.classStart[class])
+	budget := d.budget(class)
+	log.Warnf("%s error (%s, %v into disruption): %v", d.what, class, now.Sub(d.start), err)
+	if budget > 0 && elapsed > budget {
+		d.record(now)
+		return fmt.Errorf("%s exceeded disruption budget for %s errors (%v > %v): %w", d.what, class, elapsed, budget, err)
+	}
+	return nil
+}
+
+// Sleep before retrying, backing off exponentially with consecutive errors
+func (d *DisruptionTracker) Backoff() {
+	wait := 250 * time.Millisecond
+	for i := 1; i < d.attempts && wait < 10*time.Second; i++ {
+		wait *= 2
+	}
+	if wait > 10*time.Second {
+		wait = 10 * time.Second
+	}
+	time.Sleep(wait)
+}
+
+// Record a success, closing any disruption window that was open
+func (d *DisruptionTracker) Ok() {
+	if d.attempts > 0 {
+		d.record(time.Now())
+		log.Infof("%s recovered after %v", d.what, time.Since(d.start))
+		d.attempts = 0
+	}
+}
+
+func (d *DisruptionTracker) record(end time.Time) {
+	results.AddDowntime(DowntimeWindow{
+		What:    d.what,
+		Start:   d.start,
+		End:     end,
+		Seconds: end.Sub(d.start).Seconds(),
+		Errors:  d.errors,
+	})
+}
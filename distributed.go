@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Distributed mode lets several verifier processes (e.g. one per pod) share
+// a topic.  They announce themselves on a control topic, divide up the
+// partitions between them so that no two produce to the same partition
+// (which would break each other's expected offsets), and after producing,
+// exchange their valid offset ranges so that each of them can validate
+// data written by any of them.
+//
+// All messages for a run are keyed by --run_id, so a control topic may be
+// reused across runs.
+
+const (
+	controlJoin   = "join"
+	controlRanges = "ranges"
+)
+
+// State is split across records of at most this much, to stay well under
+// the default max.message.bytes of 1MiB once JSON has base64 encoded it
+const controlChunkBytes = 512 * 1024
+
+type ControlMessage struct {
+	Run      string
+	Instance string
+	Type     string
+	// For ranges messages, the instance's encoded TopicOffsetRanges, or
+	// part Chunk of Chunks of it
+	State  []byte `json:",omitempty"`
+	Chunk  int    `json:",omitempty"`
+	Chunks int    `json:",omitempty"`
+}
+
+type Coordinator struct {
+	client   *kgo.Client
+	instance string
+
+	// Messages seen for our run, by type then instance
+	seen map[string]map[string]ControlMessage
+	// Parts of chunked messages not yet seen whole, by type then instance
+	chunks map[string]map[string][][]byte
+}
+
+func NewCoordinator() *Coordinator {
+	if len(*runId) == 0 {
+		Die("--control_topic requires --run_id")
+	}
+
+	instance := *instanceId
+	if len(instance) == 0 {
+		hostname, err := os.Hostname()
+		Chk(err, "Error getting hostname: %v", err)
+		instance = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	opts := []kgo.Opt{
+		kgo.DefaultProduceTopic(*controlTopic),
+		kgo.ConsumeTopics(*controlTopic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+	}
+
+	return &Coordinator{
+		client:   newProduceClient(opts),
+		instance: instance,
+		seen:     make(map[string]map[string]ControlMessage),
+		chunks:   make(map[string]map[string][][]byte),
+	}
+}
+
+func (c *Coordinator) Close() {
+	closeClient(c.client)
+}
+
+func (c *Coordinator) publish(msg ControlMessage) {
+	msg.Run = *runId
+	msg.Instance = c.instance
+	value, err := json.Marshal(msg)
+	Chk(err, "Error encoding control message: %v", err)
+
+	r := kgo.KeySliceRecord([]byte(*runId), value)
+	err = c.client.ProduceSync(runCtx, r).FirstErr()
+	Chk(err, "Error writing to control topic %s: %v", *controlTopic, err)
+}
+
+// Publish state in as many messages as it takes to keep each one under
+// controlChunkBytes
+func (c *Coordinator) publishState(typ string, state []byte) {
+	parts := splitChunks(state, controlChunkBytes)
+	if len(parts) <= 1 {
+		c.publish(ControlMessage{Type: typ, State: state})
+		return
+	}
+	for i, part := range parts {
+		c.publish(ControlMessage{Type: typ, State: part, Chunk: i, Chunks: len(parts)})
+	}
+}
+
+func splitChunks(data []byte, size int) [][]byte {
+	var parts [][]byte
+	for len(data) > size {
+		parts = append(parts, data[:size])
+		data = data[size:]
+	}
+	return append(parts, data)
+}
+
+// Collect a part of a chunked message, returning true once every part is
+// in, with msg's State the whole of them
+func (c *Coordinator) addChunk(msg *ControlMessage) bool {
+	if msg.Chunk < 0 || msg.Chunk >= msg.Chunks {
+		log.Warnf("Ignoring %s chunk %d of %d from instance %s", msg.Type, msg.Chunk, msg.Chunks, msg.Instance)
+		return false
+	}
+	if c.chunks[msg.Type] == nil {
+		c.chunks[msg.Type] = make(map[string][][]byte)
+	}
+	parts := c.chunks[msg.Type][msg.Instance]
+	if len(parts) != msg.Chunks {
+		// First part, or the instance started over
+		parts = make([][]byte, msg.Chunks)
+		c.chunks[msg.Type][msg.Instance] = parts
+	}
+	parts[msg.Chunk] = msg.State
+	for _, part := range parts {
+		if part == nil {
+			return false
+		}
+	}
+	delete(c.chunks[msg.Type], msg.Instance)
+	msg.State = bytes.Join(parts, nil)
+	msg.Chunk, msg.Chunks = 0, 0
+	return true
+}
+
+// Consume the control topic until every instance has sent a message of
+// the given type for our run.
+func (c *Coordinator) await(typ string) map[string]ControlMessage {
+	deadline := time.Now().Add(*coordinationTimeout)
+	for len(c.seen[typ]) < *instances {
+		if time.Now().After(deadline) {
+			Die("Timed out waiting for %s from %d instances (have %d)", typ, *instances, len(c.seen[typ]))
+		}
+
+		ctx, cancel := context.WithTimeout(runCtx, 5*time.Second)
+		fetches := c.client.PollFetches(ctx)
+		cancel()
+
+		fetches.EachError(func(t string, p int32, err error) {
+			if err != context.DeadlineExceeded {
+				log.Warnf("Error reading control topic %s/%d: %v", t, p, err)
+			}
+		})
+		fetches.EachRecord(func(r *kgo.Record) {
+			var msg ControlMessage
+			if err := json.Unmarshal(r.Value, &msg); err != nil {
+				log.Warnf("Ignoring bad control message at %s/%d o=%d: %v", r.Topic, r.Partition, r.Offset, err)
+				return
+			}
+			if msg.Run != *runId {
+				return
+			}
+			if msg.Chunks > 0 && !c.addChunk(&msg) {
+				return
+			}
+			if c.seen[msg.Type] == nil {
+				c.seen[msg.Type] = make(map[string]ControlMessage)
+			}
+			c.seen[msg.Type][msg.Instance] = msg
+		})
+		log.Infof("Have %s from %d/%d instances", typ, len(c.seen[typ]), *instances)
+	}
+
+	return c.seen[typ]
+}
+
+// Announce ourselves, wait for everyone else, then take our share of the
+// partitions.
+func (c *Coordinator) Join(nPartitions int32) {
+	log.Infof("Joining run %s as %s", *runId, c.instance)
+	c.publish(ControlMessage{Type: controlJoin})
+	joined := c.await(controlJoin)
+
+	var names []string
+	for name := range joined {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	index := sort.SearchStrings(names, c.instance)
+	if index == len(names) || names[index] != c.instance {
+		Die("Instance %s missing from join messages", c.instance)
+	}
+
+	// Share out the --partitions subset, if there is one
+	candidates := ownedPartitions
+	if candidates == nil {
+		for p := int32(0); p < nPartitions; p++ {
+			candidates = append(candidates, p)
+		}
+	}
+	ownedPartitions = make([]int32, 0)
+	for i, p := range candidates {
+		if i%len(names) == index {
+			ownedPartitions = append(ownedPartitions, p)
+		}
+	}
+	if len(ownedPartitions) == 0 {
+		Die("Instance %s owns no partitions: more instances (%d) than partitions (%d)", c.instance, len(names), len(candidates))
+	}
+	log.Infof("Instance %s (%d/%d) owns partitions %v", c.instance, index, len(names), ownedPartitions)
+}
+
+// Publish our valid offset ranges, then merge in everyone else's so that
+// our state file covers everything written during the run.
+func (c *Coordinator) ShareState(nPartitions int32) {
+	tors, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+	state, err := encodeState(&tors, stateFormatBinary)
+	Chk(err, "Error encoding state: %v", err)
+	c.publishState(controlRanges, state)
+
+	for instance, msg := range c.await(controlRanges) {
+		if instance == c.instance {
+			continue
+		}
+		var theirs TopicOffsetRanges
+		err := decodeState(msg.State, &theirs)
+		Chk(err, "Bad state from instance %s: %v", instance, err)
+		err = theirs.checkIdentity(fmt.Sprintf("instance %s", instance))
+		Chk(err, "%v", err)
+
+		if theirs.ProduceEpoch > tors.ProduceEpoch {
+			tors.ProduceEpoch = theirs.ProduceEpoch
+		}
+		for p := range theirs.PartitionRanges {
+			if p >= len(tors.PartitionRanges) {
+				Die("Instance %s has state for partition %d, but topic has %d partitions", instance, p, nPartitions)
+			}
+			overlap := tors.PartitionRanges[p].Merge(&theirs.PartitionRanges[p])
+			if overlap > 0 && ownsPartition(int32(p)) {
+				log.Warnf("Instance %s claims %d offsets on partition %d, which we own", instance, overlap, p)
+			}
+		}
+	}
+
+	err = tors.Store()
+	Chk(err, "Error storing merged state: %v", err)
+}
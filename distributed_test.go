@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestControlChunks(t *testing.T) {
+	state := make([]byte, 10)
+	for i := range state {
+		state[i] = byte(i)
+	}
+	parts := splitChunks(state, 4)
+	if len(parts) != 3 || len(parts[2]) != 2 {
+		t.Fatalf("split into %d parts, want 3 (last %d bytes)", len(parts), len(parts[len(parts)-1]))
+	}
+	if parts := splitChunks(state, 10); len(parts) != 1 {
+		t.Errorf("state of exactly one chunk split into %d parts", len(parts))
+	}
+
+	// Parts may arrive in any order, and only the last completes the message
+	c := &Coordinator{chunks: make(map[string]map[string][][]byte)}
+	for _, i := range []int{2, 0, 1} {
+		msg := ControlMessage{Instance: "a", Type: controlRanges, State: parts[i], Chunk: i, Chunks: len(parts)}
+		done := c.addChunk(&msg)
+		if done != (i == 1) {
+			t.Fatalf("chunk %d: done=%v", i, done)
+		}
+		if done && !bytes.Equal(msg.State, state) {
+			t.Errorf("reassembled %v, want %v", msg.State, state)
+		}
+	}
+
+	msg := ControlMessage{Instance: "a", Type: controlRanges, State: parts[0], Chunk: 3, Chunks: len(parts)}
+	if c.addChunk(&msg) {
+		t.Errorf("chunk out of range accepted")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+)
+
+// With --ephemeral_topic, a run is self-contained: we create a topic of our
+// own, produce to and validate it, then delete it, check that its objects
+// disappear from object storage (with --s3_bucket), and remove its state
+// file.  This suits CI, where nothing should be left behind between runs.
+
+// Create a uniquely named topic, and point --topic at it
+func createEphemeralTopic() {
+	prefix := *topic
+	if len(prefix) == 0 {
+		prefix = "si-verifier"
+	}
+	name := fmt.Sprintf("%s-%s-%04x", prefix, time.Now().UTC().Format("20060102-150405"), newRand("ephemeral").Intn(0x10000))
+
+	configs := make(map[string]*string)
+	if len(*s3Bucket) > 0 {
+		configs["redpanda.remote.write"] = kadm.StringPtr("true")
+		configs["redpanda.remote.read"] = kadm.StringPtr("true")
+	}
+
+	client := newProduceClient(nil)
+	defer closeClient(client)
+	resps, err := kadm.NewClient(client).CreateTopics(runCtx, int32(*ephemeralPartitions), int16(*ephemeralReplicas), configs, name)
+	Chk(err, "Error creating topic %s: %v", name, err)
+	resp, err := resps.On(name, nil)
+	Chk(err, "Error creating topic %s: %v", name, err)
+	Chk(resp.Err, "Error creating topic %s: %v", name, resp.Err)
+
+	log.Infof("Created ephemeral topic %s with %d partitions", name, *ephemeralPartitions)
+	*topic = name
+
+	// Wait for every partition to have a leader before we start
+	adm := kadm.NewClient(client)
+	for deadline := time.Now().Add(time.Minute); ; {
+		m, err := adm.Metadata(runCtx, name)
+		if err == nil {
+			t := m.Topics[name]
+			ready := t.Err == nil && len(t.Partitions) == *ephemeralPartitions
+			for _, p := range t.Partitions {
+				ready = ready && p.Err == nil && p.Leader >= 0
+			}
+			if ready {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			Die("Ephemeral topic %s partitions did not get leaders", name)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Delete the topic, wait for its objects to be removed from object storage,
+// and remove its state file
+func cleanupEphemeralTopic() {
+	client := newProduceClient(nil)
+	resps, err := kadm.NewClient(client).DeleteTopics(runCtx, *topic)
+	closeClient(client)
+	Chk(err, "Error deleting topic %s: %v", *topic, err)
+	resp, err := resps.On(*topic, nil)
+	Chk(err, "Error deleting topic %s: %v", *topic, err)
+	Chk(resp.Err, "Error deleting topic %s: %v", *topic, resp.Err)
+	log.Infof("Deleted ephemeral topic %s", *topic)
+
+	if len(*s3Bucket) > 0 {
+		waitForRemoteCleanup()
+	}
+
+	closeSqliteState(topicOffsetRangeFile())
+	if isStateDir(topicOffsetRangeFile()) {
+		err = os.RemoveAll(topicOffsetRangeFile())
+	} else {
+		err = os.Remove(topicOffsetRangeFile())
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Error removing state file %s: %v", topicOffsetRangeFile(), err)
+	}
+}
+
+// Wait for the deleted topic's manifests and segments to go from object
+// storage, recording any that outstay --ephemeral_cleanup_timeout
+func waitForRemoteCleanup() {
+	s3 := NewS3Client()
+	prefixes := []string{
+		fmt.Sprintf("meta/kafka/%s/", *topic),
+		fmt.Sprintf("kafka/%s/", *topic),
+	}
+
+	deadline := time.Now().Add(*ephemeralCleanupTimeout)
+	for {
+		objects, err := s3.List("")
+		Chk(err, "Error listing bucket %s: %v", *s3Bucket, err)
+
+		var remaining []string
+		for _, o := range objects {
+			key := unhashedKey(o.Key)
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key, prefix) {
+					remaining = append(remaining, key)
+				}
+			}
+		}
+
+		if len(remaining) == 0 {
+			log.Infof("Object storage cleaned up after %s", *topic)
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, key := range remaining {
+				log.Errorf("Object %s remains after deleting %s", key, *topic)
+				results.AddCloudStorageIssue(CloudStorageIssue{
+					Partition: -1,
+					Segment:   key,
+					Problem:   "object not removed after topic deletion",
+				})
+			}
+			results.Emit()
+			Die("%d objects remain in %s %v after deleting %s", len(remaining), *s3Bucket, *ephemeralCleanupTimeout, *topic)
+		}
+
+		log.Infof("Waiting for %d objects to be removed from object storage...", len(remaining))
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"os"
+)
+
+// No flock here, so state locks are not taken: concurrent producers
+// sharing state go undetected, as with --produce_lock=false
+func lockFile(f *os.File, wait bool) error {
+	return errNoFileLocks
+}
+
+func unlockFile(f *os.File) {}
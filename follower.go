@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// How many records to compare at a time in follower read mode
+const followerReadChunk = 1000
+
+// A consumer of a single partition that hands out records in runs
+type partitionReader struct {
+	p      int32
+	client *kgo.Client
+	buffer []*kgo.Record
+}
+
+func newPartitionReader(p int32, from int64, opts []kgo.Opt) *partitionReader {
+	offsets := map[string]map[int32]kgo.Offset{
+		*topic: {p: kgo.NewOffset().At(from)},
+	}
+	opts = append(opts, kgo.ConsumePartitions(offsets))
+	return &partitionReader{
+		p:      p,
+		client: newClient(opts),
+	}
+}
+
+func (pr *partitionReader) Close() {
+	closeClient(pr.client)
+}
+
+// Read up to n records, stopping early at the record before `upTo`.
+// Gives up if polls repeatedly return nothing.
+func (pr *partitionReader) read(n int, upTo int64) []*kgo.Record {
+	emptyPolls := 0
+	for len(pr.buffer) < n {
+		if len(pr.buffer) > 0 && pr.buffer[len(pr.buffer)-1].Offset >= upTo-1 {
+			break
+		}
+
+		ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+		fetches := pr.client.PollFetches(ctx)
+		cancel()
+		fetches.EachError(func(t string, p int32, err error) {
+			log.Warnf("Error reading %s/%d: %v", t, p, err)
+		})
+
+		records := fetches.Records()
+		if len(records) == 0 {
+			emptyPolls += 1
+			if emptyPolls > 6 {
+				Die("No progress reading %s/%d after %d records", *topic, pr.p, len(pr.buffer))
+			}
+		} else {
+			emptyPolls = 0
+		}
+		for _, r := range records {
+			if r.Offset < upTo {
+				pr.buffer = append(pr.buffer, r)
+			}
+		}
+	}
+
+	if n > len(pr.buffer) {
+		n = len(pr.buffer)
+	}
+	result := pr.buffer[:n]
+	pr.buffer = pr.buffer[n:]
+	return result
+}
+
+// Read every partition twice in lockstep: once from its leader, and once
+// with --rack set so that (with a rack-aware replica.selector.class, per
+// KIP-392) the broker can direct us to a follower.  The follower's
+// records must be identical to the leader's, and valid.
+func followerReadAll(nPartitions int32) {
+	if len(*rack) == 0 {
+		Die("--follower_read requires --rack")
+	}
+
+	client := newClient(nil)
+	lwm, hwm, err := getOffsetBounds(client, nPartitions)
+	ChkEmit(err, "%v", err)
+	closeClient(client)
+
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+
+	for p := int32(0); p < nPartitions; p++ {
+		if !ownsPartition(p) || lwm[p] >= hwm[p] {
+			continue
+		}
+
+		log.Infof("Follower read %s/%d %d-%d...", *topic, p, lwm[p], hwm[p])
+		// No rack for the leader reader, so it reads from the leader
+		leader := newPartitionReader(p, lwm[p], []kgo.Opt{kgo.Rack("")})
+		follower := newPartitionReader(p, lwm[p], []kgo.Opt{kgo.Rack(*rack)})
+
+		compared := 0
+		for {
+			lrs := leader.read(followerReadChunk, hwm[p])
+			if len(lrs) == 0 {
+				break
+			}
+			frs := follower.read(len(lrs), hwm[p])
+			if len(frs) != len(lrs) {
+				Die("Follower returned %d records on %s/%d from %d, leader returned %d", len(frs), *topic, p, lrs[0].Offset, len(lrs))
+			}
+
+			for i, lr := range lrs {
+				fr := frs[i]
+				if fr.Offset != lr.Offset {
+					Die("Follower offset mismatch on %s/%d: leader has %d, follower has %d", *topic, p, lr.Offset, fr.Offset)
+				}
+				if !bytes.Equal(fr.Key, lr.Key) || !bytes.Equal(fr.Value, lr.Value) || !fr.Timestamp.Equal(lr.Timestamp) {
+					badRecord(fr, &validRanges.PartitionRanges[p], fmt.Sprintf("leader's record with key %s", lr.Key), fmt.Sprintf("key %s", fr.Key),
+						"Follower content mismatch on %s/%d at %d: leader key '%s', follower key '%s'", *topic, p, lr.Offset, lr.Key, fr.Key)
+				}
+				validateRecord(fr, &validRanges)
+			}
+			compared += len(lrs)
+
+			if lrs[len(lrs)-1].Offset >= hwm[p]-1 {
+				break
+			}
+		}
+
+		leader.Close()
+		follower.Close()
+		log.Infof("Follower read %s/%d matched leader on %d records", *topic, p, compared)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Consume the topic through a consumer group, committing offsets and then
+// deliberately restarting the consumer every --group_restart_msgs records.
+// After each restart we check that consumption resumes exactly at the
+// committed position: an earlier offset means records were re-delivered, a
+// later offset means records were skipped.  This exercises __consumer_offsets
+// durability if the cluster is subject to failures while we run.
+func groupRead(nPartitions int32) {
+	if *groupChurnMembers > 0 {
+		groupChurnRead(nPartitions)
+		return
+	}
+
+	client := newClient(nil)
+	startAt, err := getOffsets(client, nPartitions, -2)
+	ChkEmit(err, "%v", err)
+	upTo, err := getOffsetsIsolated(client, nPartitions, -1, readIsolationLevel())
+	ChkEmit(err, "%v", err)
+	closeClient(client)
+
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+
+	stopDriftChecks := startCommitDriftChecks(nPartitions, groupResumeOffsets(nPartitions, startAt), int64(*groupRestartMsgs))
+
+	// The next offset to consume on each partition, according to our
+	// last successful commit.  -1 until we have committed on the partition.
+	committed := make([]int64, nPartitions)
+	for i := range committed {
+		committed[i] = -1
+	}
+
+	disruption := NewDisruptionTracker("group read")
+	for restarts := 0; ; restarts++ {
+		done, err := groupReadInner(nPartitions, startAt, upTo, committed, &validRanges)
+		if err != nil {
+			budgetErr := disruption.Error(err)
+			ChkEmit(budgetErr, "%v", budgetErr)
+			log.Warnf("Restarting group reader for error %v", err)
+			disruption.Backoff()
+			continue
+		}
+
+		disruption.Ok()
+		if done {
+			log.Infof("Group read complete after %d restarts", restarts)
+			stopDriftChecks()
+			return
+		} else {
+			log.Infof("Restarting group consumer to verify resume position")
+		}
+	}
+}
+
+func groupReadComplete(startAt []int64, upTo []int64, committed []int64) bool {
+	for p := range upTo {
+		position := startAt[p]
+		if committed[p] > position {
+			position = committed[p]
+		}
+		if position < upTo[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// Run one consumer group member until it has consumed at least
+// --group_restart_msgs records, then commit and return.  Returns true
+// if the whole topic has been consumed.
+func groupReadInner(nPartitions int32, startAt []int64, upTo []int64, committed []int64, validRanges *TopicOffsetRanges) (bool, error) {
+	if groupReadComplete(startAt, upTo, committed) {
+		return true, nil
+	}
+
+	opts := []kgo.Opt{
+		kgo.ConsumerGroup(*consumerGroup),
+		kgo.ConsumeTopics(*topic),
+		kgo.DisableAutoCommit(),
+		groupBalancers(),
+	}
+	client := newClient(opts)
+	// Closing the client leaves the group, so that the next member we
+	// create gets the partitions assigned without waiting for a timeout.
+	defer closeClient(client)
+
+	ctx, cancel := context.WithCancel(runCtx)
+	defer cancel()
+	watchdog := NewWatchdog("group read", cancel)
+	watchdog.Start()
+	defer watchdog.Stop()
+
+	resumed := make([]bool, nPartitions)
+	next := make([]int64, nPartitions)
+	last := make(map[int32]*kgo.Record)
+	consumed := 0
+
+	for {
+		fetches := client.PollFetches(ctx)
+
+		var r_err error
+		fetches.EachError(func(t string, p int32, err error) {
+			log.Debugf("Group fetch %s/%d e=%v...", t, p, err)
+			watchdog.FetchError(p, err)
+			noteFetchPartitionError(p, err)
+			r_err = err
+		})
+
+		if r_err != nil {
+			return false, r_err
+		}
+
+		fetches.EachRecord(func(r *kgo.Record) {
+			log.Debugf("Group read %s/%d o=%d...", *topic, r.Partition, r.Offset)
+			if !resumed[r.Partition] {
+				resumed[r.Partition] = true
+				c := committed[r.Partition]
+				if c >= 0 && r.Offset > c {
+					Die("Group consumer skipped records on %s/%d: resumed at %d, committed %d", *topic, r.Partition, r.Offset, c)
+				} else if c >= 0 && r.Offset < c {
+					Die("Group consumer re-read records on %s/%d: resumed at %d, committed %d", *topic, r.Partition, r.Offset, c)
+				}
+			} else if r.Offset < next[r.Partition] {
+				Die("Group consumer went backwards on %s/%d: read %d after %d", *topic, r.Partition, r.Offset, next[r.Partition]-1)
+			}
+			next[r.Partition] = r.Offset + 1
+
+			validateRecord(r, validRanges)
+			groupPos.NoteValidated(r.Partition, r.Offset)
+			watchdog.Progress(r.Partition, r.Offset)
+			last[r.Partition] = r
+			consumed += 1
+		})
+
+		position := make([]int64, nPartitions)
+		copy(position, committed)
+		for p, r := range last {
+			position[p] = r.Offset + 1
+		}
+
+		if consumed >= *groupRestartMsgs || groupReadComplete(startAt, upTo, position) {
+			var rs []*kgo.Record
+			for _, r := range last {
+				rs = append(rs, r)
+			}
+			err := client.CommitRecords(runCtx, rs...)
+			if err != nil {
+				// We don't know whether the commit landed: forget these
+				// partitions' positions rather than raising false skip/re-read
+				// errors on resume.
+				for p := range last {
+					committed[p] = -1
+				}
+				return false, err
+			}
+			copy(committed, position)
+			for _, r := range rs {
+				groupPos.NoteCommitted(r.Partition, r.Offset+1)
+			}
+			log.Infof("Group committed offsets for %d partitions after %d records", len(rs), consumed)
+			return groupReadComplete(startAt, upTo, committed), nil
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// With --group_churn_members, the group is consumed by several members at
+// once, and every --group_churn_interval one of them is killed without
+// committing and a new one started, so the group is always rebalancing.
+// Members commit after each poll and when partitions are revoked from
+// them.  Whoever is assigned a partition must resume exactly at its
+// committed offset: records since the last commit may be delivered again,
+// but never records before it, and none may be skipped.
+
+const (
+	groupProtocolEager       = "eager"
+	groupProtocolCooperative = "cooperative"
+)
+
+func groupBalancers() kgo.GroupOpt {
+	if *groupProtocol == groupProtocolEager {
+		return kgo.Balancers(kgo.RangeBalancer())
+	}
+	return kgo.Balancers(kgo.CooperativeStickyBalancer())
+}
+
+type GroupChurnStats struct {
+	Spawned     int64
+	Killed      int64
+	Assignments int64
+	// Records delivered again after a member died before committing them
+	Redelivered int64
+}
+
+type groupChurn struct {
+	validRanges *TopicOffsetRanges
+	upTo        []int64
+
+	lock sync.Mutex
+	// Where the group resumes each partition, per our last commit, and
+	// whether a commit whose outcome we don't know has happened since
+	committed []int64
+	uncertain []bool
+	// One past the highest offset any member has consumed
+	consumed []int64
+	stats    GroupChurnStats
+}
+
+type churnMember struct {
+	id     int
+	client *kgo.Client
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Held while handling a poll's records and committing them, so that a
+	// revoke can't come in between
+	lock     sync.Mutex
+	killed   bool
+	assigned map[int32]bool
+	resumed  map[int32]bool
+	next     map[int32]int64
+	// The last record consumed on each partition since our last commit
+	last map[int32]*kgo.Record
+}
+
+func groupChurnRead(nPartitions int32) {
+	client := newClient(nil)
+	startAt, err := getOffsets(client, nPartitions, -2)
+	ChkEmit(err, "%v", err)
+	upTo, err := getOffsetsIsolated(client, nPartitions, -1, readIsolationLevel())
+	ChkEmit(err, "%v", err)
+	closeClient(client)
+
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+
+	resumeAt := groupResumeOffsets(nPartitions, startAt)
+	gc := &groupChurn{
+		validRanges: &validRanges,
+		upTo:        upTo,
+		committed:   resumeAt,
+		uncertain:   make([]bool, nPartitions),
+		consumed:    append([]int64{}, resumeAt...),
+	}
+	// Members commit after every poll, so the group should never be far
+	// behind them
+	stopDriftChecks := startCommitDriftChecks(nPartitions, resumeAt, 0)
+
+	rng := newRand("group churn")
+	var members []*churnMember
+	nextID := 0
+	spawn := func() {
+		members = append(members, gc.startMember(nextID))
+		nextID += 1
+	}
+	for i := 0; i < *groupChurnMembers; i++ {
+		spawn()
+	}
+
+	log.Infof("Group churn read with %d %s members...", *groupChurnMembers, *groupProtocol)
+	lastChurn := time.Now()
+	for !gc.complete() {
+		time.Sleep(time.Second)
+		if runCtx.Err() != nil {
+			break
+		}
+
+		// Replace members that gave up on an error
+		live := members[:0]
+		for _, m := range members {
+			select {
+			case <-m.done:
+				m.stop()
+			default:
+				live = append(live, m)
+			}
+		}
+		members = live
+
+		if time.Since(lastChurn) > *groupChurnInterval && len(members) > 0 {
+			lastChurn = time.Now()
+			i := rng.Intn(len(members))
+			log.Infof("Killing group member %d", members[i].id)
+			members[i].kill()
+			gc.lock.Lock()
+			gc.stats.Killed += 1
+			gc.lock.Unlock()
+			members = append(members[:i], members[i+1:]...)
+		}
+		for len(members) < *groupChurnMembers {
+			spawn()
+		}
+	}
+
+	for _, m := range members {
+		m.stop()
+	}
+	stopDriftChecks()
+
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	results.SetGroupChurn(gc.stats)
+	log.Infof("Group churn read complete: %d members started, %d killed, %d assignments, %d records redelivered",
+		gc.stats.Spawned, gc.stats.Killed, gc.stats.Assignments, gc.stats.Redelivered)
+}
+
+func (gc *groupChurn) complete() bool {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	for p := range gc.upTo {
+		if gc.committed[p] < gc.upTo[p] {
+			return false
+		}
+	}
+	return true
+}
+
+func (gc *groupChurn) startMember(id int) *churnMember {
+	m := &churnMember{
+		id:       id,
+		done:     make(chan struct{}),
+		assigned: make(map[int32]bool),
+		resumed:  make(map[int32]bool),
+		next:     make(map[int32]int64),
+		last:     make(map[int32]*kgo.Record),
+	}
+	opts := []kgo.Opt{
+		kgo.ConsumerGroup(*consumerGroup),
+		kgo.ConsumeTopics(*topic),
+		kgo.DisableAutoCommit(),
+		groupBalancers(),
+		kgo.OnPartitionsAssigned(func(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			for _, p := range assigned[*topic] {
+				m.assigned[p] = true
+				m.resumed[p] = false
+			}
+			gc.lock.Lock()
+			gc.stats.Assignments += int64(len(assigned[*topic]))
+			gc.lock.Unlock()
+		}),
+		kgo.OnPartitionsRevoked(func(ctx context.Context, _ *kgo.Client, revoked map[string][]int32) {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			// A killed member dies without committing what it consumed
+			if !m.killed {
+				gc.commit(ctx, m, revoked[*topic])
+			}
+			m.unassign(revoked[*topic])
+		}),
+		kgo.OnPartitionsLost(func(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			m.unassign(lost[*topic])
+		}),
+	}
+	m.client = newClient(opts)
+
+	var ctx context.Context
+	ctx, m.cancel = context.WithCancel(runCtx)
+	go gc.runMember(ctx, m)
+
+	gc.lock.Lock()
+	gc.stats.Spawned += 1
+	gc.lock.Unlock()
+	log.Debugf("Started group member %d", id)
+	return m
+}
+
+func (m *churnMember) unassign(partitions []int32) {
+	for _, p := range partitions {
+		delete(m.assigned, p)
+		delete(m.last, p)
+	}
+}
+
+// Stop a member without committing anything further
+func (m *churnMember) kill() {
+	m.lock.Lock()
+	m.killed = true
+	m.lock.Unlock()
+	m.stop()
+}
+
+func (m *churnMember) stop() {
+	m.cancel()
+	<-m.done
+	closeClient(m.client)
+}
+
+func (gc *groupChurn) runMember(ctx context.Context, m *churnMember) {
+	defer close(m.done)
+	for {
+		fetches := m.client.PollFetches(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		var fetchErr error
+		fetches.EachError(func(t string, p int32, err error) {
+			fetchErr = err
+		})
+		if fetchErr != nil {
+			log.Warnf("Group member %d stopping for error %v", m.id, fetchErr)
+			return
+		}
+
+		m.lock.Lock()
+		fetches.EachRecord(func(r *kgo.Record) {
+			gc.consume(m, r)
+		})
+		gc.commit(ctx, m, nil)
+		m.lock.Unlock()
+	}
+}
+
+// Check a record is where the group should be, and validate it
+func (gc *groupChurn) consume(m *churnMember, r *kgo.Record) {
+	p := r.Partition
+	if !m.assigned[p] {
+		// Fetched before the partition was revoked from us
+		return
+	}
+
+	gc.lock.Lock()
+	if !m.resumed[p] {
+		m.resumed[p] = true
+		c := gc.committed[p]
+		if !gc.uncertain[p] && r.Offset > c {
+			Die("Group member %d skipped records on %s/%d: resumed at %d, committed %d", m.id, *topic, p, r.Offset, c)
+		} else if !gc.uncertain[p] && r.Offset < c {
+			Die("Group member %d re-read committed records on %s/%d: resumed at %d, committed %d", m.id, *topic, p, r.Offset, c)
+		}
+	} else if r.Offset < m.next[p] {
+		Die("Group member %d went backwards on %s/%d: read %d after %d", m.id, *topic, p, r.Offset, m.next[p]-1)
+	}
+	if r.Offset < gc.consumed[p] {
+		gc.stats.Redelivered += 1
+	} else {
+		gc.consumed[p] = r.Offset + 1
+	}
+	gc.lock.Unlock()
+
+	m.next[p] = r.Offset + 1
+	m.last[p] = r
+	if r.Offset < gc.upTo[p] {
+		validateRecord(r, gc.validRanges)
+	}
+	groupPos.NoteValidated(p, r.Offset)
+}
+
+// Commit what a member has consumed, on some partitions or (if nil) all of
+// them.  Called with the member's lock held.
+func (gc *groupChurn) commit(ctx context.Context, m *churnMember, partitions []int32) {
+	var rs []*kgo.Record
+	for p, r := range m.last {
+		if partitions == nil || containsPartition(partitions, p) {
+			rs = append(rs, r)
+		}
+	}
+	if len(rs) == 0 {
+		return
+	}
+
+	err := m.client.CommitRecords(ctx, rs...)
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	var kErr *kerr.Error
+	for _, r := range rs {
+		if err == nil {
+			gc.committed[r.Partition] = r.Offset + 1
+			gc.uncertain[r.Partition] = false
+			groupPos.NoteCommitted(r.Partition, r.Offset+1)
+			delete(m.last, r.Partition)
+		} else if !errors.As(err, &kErr) {
+			// It may have landed anyway
+			gc.uncertain[r.Partition] = true
+		}
+	}
+	if err != nil {
+		log.Warnf("Group member %d commit failed: %v", m.id, err)
+	}
+}
+
+func containsPartition(partitions []int32, p int32) bool {
+	for _, q := range partitions {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Kafka admin queries, via franz-go's kadm, which takes care of sharding
+// requests across brokers and of partial responses.  Not to be confused with
+// admin.go, which talks to the Redpanda admin API.
+
+// Get our topic's metadata, and the ID of the cluster that served it
+func getTopicMetadata(client *kgo.Client) (kadm.TopicDetail, string, error) {
+	m, err := kadm.NewClient(client).Metadata(runCtx, *topic)
+	if err != nil {
+		return kadm.TopicDetail{}, "", fmt.Errorf("unable to request topic metadata: %w", err)
+	}
+	t, ok := m.Topics[*topic]
+	if !ok {
+		return t, "", fmt.Errorf("metadata response did not include topic %s", *topic)
+	}
+	if t.Err != nil {
+		return t, "", fmt.Errorf("error getting topic metadata: %w", t.Err)
+	}
+	return t, m.Cluster, nil
+}
+
+// The current leader of each partition, -1 where there is none
+func getPartitionLeaders(client *kgo.Client, nPartitions int32) ([]int32, error) {
+	t, _, err := getTopicMetadata(client)
+	if err != nil {
+		return nil, err
+	}
+	leaders := make([]int32, nPartitions)
+	for i := range leaders {
+		leaders[i] = -1
+	}
+	for _, p := range t.Partitions {
+		if p.Partition < nPartitions && p.Err == nil {
+			leaders[p.Partition] = p.Leader
+		}
+	}
+	return leaders, nil
+}
+
+// Our topic's configs, by name
+func getTopicConfigs(client *kgo.Client) (map[string]kadm.Config, error) {
+	rcs, err := kadm.NewClient(client).DescribeTopicConfigs(runCtx, *topic)
+	if err != nil {
+		return nil, fmt.Errorf("error describing %s config: %w", *topic, err)
+	}
+	rc, err := rcs.On(*topic, nil)
+	if err == nil {
+		err = rc.Err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error describing %s config: %w", *topic, err)
+	}
+
+	configs := make(map[string]kadm.Config)
+	for _, c := range rc.Configs {
+		configs[c.Key] = c
+	}
+	return configs, nil
+}
+
+// ListOffsets for every partition: t is a timestamp, or -1 for the HWM
+// (LSO at isolation level 1) or -2 for the start offset
+func listOffsets(client *kgo.Client, t int64, isolationLevel int8) (kadm.ListedOffsets, error) {
+	adm := kadm.NewClient(client)
+	ctx := runCtx
+	switch {
+	case t == -2:
+		return adm.ListStartOffsets(ctx, *topic)
+	case t == -1 && isolationLevel == 1:
+		return adm.ListCommittedOffsets(ctx, *topic)
+	case t == -1:
+		return adm.ListEndOffsets(ctx, *topic)
+	default:
+		return adm.ListOffsetsAfterMilli(ctx, t, *topic)
+	}
+}
+
+func getOffsetsInner(client *kgo.Client, nPartitions int32, t int64, isolationLevel int8) ([]int64, error) {
+	log.Infof("Loading offsets for topic %s t=%d i=%d...", *topic, t, isolationLevel)
+	pOffsets := make([]int64, nPartitions)
+
+	listed, err := listOffsets(client, t, isolationLevel)
+	if err != nil {
+		// Partial results are no use: a missing partition would read as
+		// offset 0
+		return nil, err
+	}
+
+	var r_err error
+	seenPartitions := int32(0)
+	listed.Each(func(o kadm.ListedOffset) {
+		if o.Partition >= nPartitions {
+			// The topic grew since we looked
+			return
+		}
+		if o.Err != nil {
+			log.Warnf("error fetching %s/%d metadata: %v", *topic, o.Partition, o.Err)
+			r_err = o.Err
+		}
+		pOffsets[o.Partition] = o.Offset
+		seenPartitions += 1
+		log.Debugf("Partition %d offset %d", o.Partition, pOffsets[o.Partition])
+	})
+
+	if seenPartitions < nPartitions {
+		return nil, fmt.Errorf("Got offsets for only %d of %d partitions", seenPartitions, nPartitions)
+	}
+
+	return pOffsets, r_err
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// In keyed mode we produce the way most applications do: records carry
+// keys from a fixed key space, and the client's default hashing
+// partitioner decides where they go.  Keys no longer encode offsets, so
+// reads are validated against the acked offset ranges, plus the partitions
+// that each key was acked on: a key turning up anywhere else means a
+// record was misplaced.  We also keep where each key's latest version
+// landed, so that after compaction we can check the last version of each
+// key left in the log is that one.
+
+const keyedPrefix = "key."
+
+// Protects TopicOffsetRanges.KeyPartitions and KeyLatest from concurrent
+// produce acks, and from stores encoding them meanwhile
+var keyPartitionsLock sync.Mutex
+
+// Past this many, key mismatches are counted but not listed
+const maxKeyMismatches = 100
+
+// The latest version of a key we were acked for.  Once a compacted topic
+// is cleaned, this is the only version of the key that should be left.
+type KeyVersion struct {
+	Partition int32
+	Offset    int64
+	// A tombstone may itself be cleaned away after delete.retention.ms
+	Tombstone bool `json:",omitempty"`
+}
+
+type CompactionStats struct {
+	Keys int64
+	// Keys whose latest version read back as the last one in the log
+	Latest int64
+	// Keys whose tombstone had been cleaned away
+	Removed int64
+	// Keys whose last version in the log was later than any we know of
+	Unknown int64
+	// Versions read that a later one superseded, and with
+	// --compaction_tiered, how many the compacted local log held
+	ReadSuperseded      int64
+	CompactedSuperseded *int64        `json:",omitempty"`
+	Mismatches          []KeyMismatch `json:",omitempty"`
+}
+
+// A key whose last version in the log was not its latest: Found is -1 if
+// the key was gone altogether
+type KeyMismatch struct {
+	Key       string
+	Partition int32
+	Expected  int64
+	Found     int64
+}
+
+func keyedKey(n int) string {
+	return fmt.Sprintf("%s%08d", keyedPrefix, n)
+}
+
+// Pick keys uniformly from the key space, or with --key_skew, with zipfian
+// weights so that a few hot keys take most updates, as in most real
+// compacted topics
+func newKeyPicker(rng *rand.Rand) func() int {
+	if *keySkew <= 1 || *keySpace < 2 {
+		return func() int {
+			return rng.Intn(*keySpace)
+		}
+	}
+	z := rand.NewZipf(rng, *keySkew, 1, uint64(*keySpace-1))
+	return func() int {
+		return int(z.Uint64())
+	}
+}
+
+func newKeyedRecord(n int) *kgo.Record {
+	key := keyedKey(n)
+	payload := newPayload()
+	r := kgo.KeySliceRecord([]byte(key), payload)
+	stampRunHeaders(r)
+	return r
+}
+
+// Record that a key was acked on a partition.  A key should only ever
+// hash to one partition, unless the topic's partition count changes.
+func (tors *TopicOffsetRanges) NoteKeyPartition(key string, p int32) {
+	keyPartitionsLock.Lock()
+	defer keyPartitionsLock.Unlock()
+	tors.noteKeyPartition(key, p)
+}
+
+func (tors *TopicOffsetRanges) noteKeyPartition(key string, p int32) {
+	if tors.KeyPartitions == nil {
+		tors.KeyPartitions = make(map[string][]int32)
+	}
+	existing := tors.KeyPartitions[key]
+	for _, e := range existing {
+		if e == p {
+			return
+		}
+	}
+	if len(existing) > 0 {
+		log.Warnf("Key %s acked on %s/%d, but previously on %v: did the partition count change?", key, *topic, p, existing)
+	}
+	tors.KeyPartitions[key] = append(existing, p)
+}
+
+// Record that a key was acked at an offset.  Acks are applied in send
+// order, so each one is the key's latest.
+func (tors *TopicOffsetRanges) NoteKeyLatest(key string, p int32, o int64, tombstone bool) {
+	keyPartitionsLock.Lock()
+	defer keyPartitionsLock.Unlock()
+	tors.noteKeyLatest(key, p, o, tombstone)
+}
+
+func (tors *TopicOffsetRanges) noteKeyLatest(key string, p int32, o int64, tombstone bool) {
+	if tors.KeyLatest == nil {
+		tors.KeyLatest = make(map[string]KeyVersion)
+	}
+	existing, ok := tors.KeyLatest[key]
+	if ok && existing.Partition == p && existing.Offset > o {
+		return
+	}
+	tors.KeyLatest[key] = KeyVersion{Partition: p, Offset: o, Tombstone: tombstone}
+}
+
+// The caller holds keyPartitionsLock if into is shared with produce acks
+func mergeKeyPartitions(into *TopicOffsetRanges, from *TopicOffsetRanges) {
+	for key, partitions := range from.KeyPartitions {
+		for _, p := range partitions {
+			into.noteKeyPartition(key, p)
+		}
+	}
+	for key, kv := range from.KeyLatest {
+		if existing, ok := into.KeyLatest[key]; ok && existing.Partition != kv.Partition {
+			// No way to tell which came later
+			log.Warnf("Key %s latest on %s/%d at %d and on %s/%d at %d, keeping the first", key, *topic, existing.Partition, existing.Offset, *topic, kv.Partition, kv.Offset)
+			continue
+		}
+		into.noteKeyLatest(key, kv.Partition, kv.Offset, kv.Tombstone)
+	}
+}
+
+// The last version of each key seen by the sequential reader, and how
+// many versions of keys it read in all
+var (
+	keyedReadsLock   sync.Mutex
+	keyedReads       map[string]KeyVersion
+	keyedReadRecords int64
+)
+
+func noteKeyedRead(r *kgo.Record) {
+	keyedReadsLock.Lock()
+	defer keyedReadsLock.Unlock()
+	if keyedReads == nil {
+		keyedReads = make(map[string]KeyVersion)
+	}
+	key := string(r.Key)
+	if existing, ok := keyedReads[key]; ok && existing.Partition == r.Partition && existing.Offset >= r.Offset {
+		// A restarted reader reads some records again
+		return
+	}
+	keyedReads[key] = KeyVersion{Partition: r.Partition, Offset: r.Offset, Tombstone: r.Value == nil}
+	keyedReadRecords += 1
+}
+
+// After a forward read of each partition from its start, check that the
+// last version of each key read was the latest we were acked for.  On a
+// compacted topic, this is what must survive cleaning.
+func checkKeyLatest(start []int64, validRanges *TopicOffsetRanges) {
+	if len(validRanges.KeyLatest) == 0 {
+		return
+	}
+	keyedReadsLock.Lock()
+	defer keyedReadsLock.Unlock()
+
+	var stats CompactionStats
+	for key, kv := range validRanges.KeyLatest {
+		if int(kv.Partition) >= len(start) || kv.Offset < start[kv.Partition] || !ownsPartition(kv.Partition) {
+			// Gone with the start of the log
+			continue
+		}
+		stats.Keys += 1
+		found := int64(-1)
+		if seen, ok := keyedReads[key]; ok && seen.Partition == kv.Partition {
+			found = seen.Offset
+		}
+		switch {
+		case found == kv.Offset:
+			stats.Latest += 1
+			continue
+		case found < 0 && kv.Tombstone:
+			stats.Removed += 1
+			continue
+		case found > kv.Offset && !validRanges.Contains(kv.Partition, found):
+			// Probably from a run that was killed before storing its state
+			log.Debugf("Key %s last read on %s/%d at %d, after its latest known version at %d", key, *topic, kv.Partition, found, kv.Offset)
+			stats.Unknown += 1
+			continue
+		}
+		log.Errorf("Key %s last read on %s/%d at %d, expected its latest version at %d", key, *topic, kv.Partition, found, kv.Offset)
+		if len(stats.Mismatches) < maxKeyMismatches {
+			stats.Mismatches = append(stats.Mismatches, KeyMismatch{Key: key, Partition: kv.Partition, Expected: kv.Offset, Found: found})
+		}
+	}
+	sort.Slice(stats.Mismatches, func(i, j int) bool { return stats.Mismatches[i].Key < stats.Mismatches[j].Key })
+	stats.ReadSuperseded = keyedReadRecords - int64(len(keyedReads))
+	log.Infof("Checked latest versions of %d keys: %d latest, %d tombstones removed, %d unknown, %d superseded versions read",
+		stats.Keys, stats.Latest, stats.Removed, stats.Unknown, stats.ReadSuperseded)
+	resurrected := false
+	if compactedSuperseded >= 0 {
+		stats.CompactedSuperseded = &compactedSuperseded
+		if stats.ReadSuperseded > compactedSuperseded {
+			log.Errorf("Read %d superseded versions from %s, but its compacted local log held %d: object storage does not reflect compaction",
+				stats.ReadSuperseded, *topic, compactedSuperseded)
+			resurrected = true
+		}
+	}
+	results.SetCompaction(stats)
+
+	if bad := stats.Keys - stats.Latest - stats.Removed - stats.Unknown; bad > 0 {
+		results.Emit()
+		Die("%d keys on %s did not read back at their latest version", bad, *topic)
+	} else if resurrected {
+		results.Emit()
+		Die("Reads of %s returned versions that compaction had removed", *topic)
+	}
+}
+
+func validateKeyedRecord(r *kgo.Record, validRanges *TopicOffsetRanges) {
+	key := string(r.Key)
+	if !validRanges.Contains(r.Partition, r.Offset) {
+		log.Infof("Ignoring read validation of keyed record at offset outside valid range %s/%d %d", *topic, r.Partition, r.Offset)
+		return
+	}
+
+	partitions := validRanges.KeyPartitions[key]
+	for _, p := range partitions {
+		if p == r.Partition {
+			validatePayload(r, &validRanges.PartitionRanges[r.Partition])
+			log.Debugf("Read OK (%s) on p=%d at o=%d", r.Key, r.Partition, r.Offset)
+			return
+		}
+	}
+
+	var ors *OffsetRanges
+	if int(r.Partition) < len(validRanges.PartitionRanges) {
+		ors = &validRanges.PartitionRanges[r.Partition]
+	}
+	badRecord(r, ors, fmt.Sprintf("key %s on partitions %v", key, partitions), fmt.Sprintf("key %s on partition %d", key, r.Partition),
+		"Bad read at offset %d on partition %s/%d: key '%s' was only produced to partitions %v",
+		r.Offset, *topic, r.Partition, key, partitions)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Keyed acks update the key maps while interim stores encode them: run
+// with -race to check every backend encodes them under the lock.
+func TestStoreDuringKeyedAcks(t *testing.T) {
+	defer func(path, layout, backend string) {
+		stateFilePath, *stateLayout, *stateBackend = path, layout, backend
+	}(stateFilePath, *stateLayout, *stateBackend)
+
+	for _, c := range []struct{ layout, backend, name string }{
+		{stateLayoutFile, stateBackendFile, "state.json"},
+		{stateLayoutDir, stateBackendFile, "state.d"},
+		{stateLayoutFile, stateBackendSqlite, "state.sqlite"},
+	} {
+		if c.backend == stateBackendSqlite && !sqliteAvailable {
+			continue
+		}
+		stateFilePath = filepath.Join(t.TempDir(), c.name)
+		*stateLayout, *stateBackend = c.layout, c.backend
+
+		tors := NewTopicOffsetRanges(2)
+		tors.NoteKeyLatest(keyedKey(0), 0, 0, false)
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := keyedKey(i % 1000)
+				tors.NoteKeyPartition(key, int32(i%2))
+				tors.NoteKeyLatest(key, int32(i%2), int64(i), false)
+			}
+		}()
+		var err error
+		for i := 0; i < 20 && err == nil; i++ {
+			err = tors.Store()
+		}
+		close(stop)
+		<-done
+		if c.backend == stateBackendSqlite {
+			closeSqliteState(stateFilePath)
+		}
+		if err != nil {
+			t.Fatalf("%s/%s: %v", c.layout, c.backend, err)
+		}
+
+		loaded, _, err := readState(stateFilePath)
+		if err != nil {
+			t.Fatalf("%s/%s: %v", c.layout, c.backend, err)
+		}
+		if len(loaded.KeyLatest) == 0 {
+			t.Errorf("%s/%s: no keys stored", c.layout, c.backend)
+		}
+	}
+}
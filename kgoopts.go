@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// --kgo_opt passes client settings that we don't otherwise model through
+// to franz-go, e.g. --kgo_opt metadata_max_age=10s,request_retries=50, so
+// that unusual scenarios don't need code changes.  They apply to every
+// client, after our own settings, so they can also override those.
+
+func durationOpt(fn func(time.Duration) kgo.Opt) func(string) (kgo.Opt, error) {
+	return func(v string) (kgo.Opt, error) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		return fn(d), nil
+	}
+}
+
+func intOpt(fn func(int) kgo.Opt) func(string) (kgo.Opt, error) {
+	return func(v string) (kgo.Opt, error) {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		return fn(n), nil
+	}
+}
+
+func boolOpt(fn func() kgo.Opt) func(string) (kgo.Opt, error) {
+	return func(v string) (kgo.Opt, error) {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		if !b {
+			// Off is the default for all of these
+			return nil, nil
+		}
+		return fn(), nil
+	}
+}
+
+var kgoOptParsers = map[string]func(string) (kgo.Opt, error){
+	"metadata_max_age":         durationOpt(func(d time.Duration) kgo.Opt { return kgo.MetadataMaxAge(d) }),
+	"metadata_min_age":         durationOpt(func(d time.Duration) kgo.Opt { return kgo.MetadataMinAge(d) }),
+	"conn_idle_timeout":        durationOpt(func(d time.Duration) kgo.Opt { return kgo.ConnIdleTimeout(d) }),
+	"request_timeout_overhead": durationOpt(func(d time.Duration) kgo.Opt { return kgo.RequestTimeoutOverhead(d) }),
+	"retry_timeout":            durationOpt(func(d time.Duration) kgo.Opt { return kgo.RetryTimeout(d) }),
+	"produce_request_timeout":  durationOpt(func(d time.Duration) kgo.Opt { return kgo.ProduceRequestTimeout(d) }),
+	"record_delivery_timeout":  durationOpt(func(d time.Duration) kgo.Opt { return kgo.RecordDeliveryTimeout(d) }),
+	"request_retries":          intOpt(func(n int) kgo.Opt { return kgo.RequestRetries(n) }),
+	"record_retries":           intOpt(func(n int) kgo.Opt { return kgo.RecordRetries(n) }),
+	"max_concurrent_fetches":   intOpt(func(n int) kgo.Opt { return kgo.MaxConcurrentFetches(n) }),
+	"broker_max_write_bytes":   intOpt(func(n int) kgo.Opt { return kgo.BrokerMaxWriteBytes(int32(n)) }),
+	"broker_max_read_bytes":    intOpt(func(n int) kgo.Opt { return kgo.BrokerMaxReadBytes(int32(n)) }),
+	"disable_fetch_sessions":   boolOpt(func() kgo.Opt { return kgo.DisableFetchSessions() }),
+}
+
+// Parsed --kgo_opt settings
+var extraKgoOpts []kgo.Opt
+
+func parseKgoOpts(spec string) ([]kgo.Opt, error) {
+	var opts []kgo.Opt
+	if len(spec) == 0 {
+		return opts, nil
+	}
+	for _, kv := range strings.Split(spec, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("--kgo_opt setting '%s' is not key=value", kv)
+		}
+		parse, ok := kgoOptParsers[parts[0]]
+		if !ok {
+			var known []string
+			for k := range kgoOptParsers {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown --kgo_opt '%s' (known: %s)", parts[0], strings.Join(known, ", "))
+		}
+		opt, err := parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad --kgo_opt %s value '%s': %w", parts[0], parts[1], err)
+		}
+		if opt != nil {
+			opts = append(opts, opt)
+		}
+	}
+	return opts, nil
+}
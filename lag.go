@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// While the sequential reader runs, we poll each partition's high
+// watermark every --lag_interval and note how far behind it the reader
+// is.  Lag that keeps growing while faults are injected means reads are
+// being starved, which a run that eventually finishes would otherwise hide.
+// With --lag_alert, lag beyond that many records is logged as it happens
+// and counted in the results.
+
+// Past this many, lag samples are thinned to every other one
+const maxLagSamples = 2000
+
+type LagStats struct {
+	Max  int64
+	Last int64
+	// Samples that were over --lag_alert
+	Alerts int64 `json:",omitempty"`
+}
+
+// Total lag across partitions at a time into the read
+type LagSample struct {
+	Seconds float64
+	Lag     int64
+}
+
+type LagTracker struct {
+	start    time.Time
+	position []int64
+	alerting []bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// nil unless the sequential reader is running with --lag_interval: methods
+// are no-ops on nil
+var readerLag *LagTracker
+
+// Start polling lag for a reader starting at `from` on each partition
+func StartLagTracker(nPartitions int32, from []int64, interval time.Duration) *LagTracker {
+	lt := &LagTracker{
+		start:    time.Now(),
+		position: append([]int64{}, from...),
+		alerting: make([]bool, nPartitions),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(lt.done)
+		client := newClient(nil)
+		defer closeClient(client)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lt.stop:
+				return
+			case <-ticker.C:
+			}
+			// A failed poll is just a missed sample: the reader's own
+			// errors are reported elsewhere
+			hwm, err := getOffsetsInner(client, nPartitions, -1, readIsolationLevel())
+			if err != nil {
+				log.Debugf("Error polling offsets for lag: %v", err)
+				continue
+			}
+			lt.sample(hwm)
+		}
+	}()
+	return lt
+}
+
+func (lt *LagTracker) Stop() {
+	if lt == nil {
+		return
+	}
+	close(lt.stop)
+	<-lt.done
+}
+
+// Note that the reader has read offset o
+func (lt *LagTracker) Read(p int32, o int64) {
+	if lt == nil || int(p) >= len(lt.position) {
+		return
+	}
+	atomic.StoreInt64(&lt.position[p], o+1)
+}
+
+func (lt *LagTracker) sample(hwm []int64) {
+	total := int64(0)
+	for p := int32(0); p < int32(len(lt.position)) && int(p) < len(hwm); p++ {
+		if !ownsPartition(p) {
+			continue
+		}
+		lag := hwm[p] - atomic.LoadInt64(&lt.position[p])
+		if lag < 0 {
+			lag = 0
+		}
+		total += lag
+
+		alert := *lagAlert > 0 && lag > *lagAlert
+		if alert && !lt.alerting[p] {
+			log.Warnf("Sequential reader lag on %s/%d is %d records, over --lag_alert %d", *topic, p, lag, *lagAlert)
+		} else if !alert && lt.alerting[p] {
+			log.Infof("Sequential reader lag on %s/%d back down to %d records", *topic, p, lag)
+		}
+		lt.alerting[p] = alert
+		results.AddLag(p, lag, alert)
+	}
+	log.Debugf("Sequential reader lag on %s: %d records", *topic, total)
+	results.AddLagSample(LagSample{Seconds: time.Since(lt.start).Seconds(), Lag: total})
+}
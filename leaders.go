@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// The state records which broker acked each record we produced, and in
+// which of its leader epochs, so that corruption found on read can be
+// pinned straight away on a node or a leadership era.  Like value sizes,
+// these are kept in runs, here spanning any offsets in between that
+// weren't ours, so a partition costs a run per leadership change.
+//
+// The broker is the one each batch was written to, from a client hook.
+// Produce responses don't carry the leader epoch, so we take it from
+// metadata, which is loaded again whenever a partition's leader moves:
+// until it is, records are noted with epoch -1.
+
+// Offsets from Base, up to Base+Count, acked by Leader in Epoch
+type LeaderRun struct {
+	Base   int64
+	Count  int64
+	Leader int32
+	Epoch  int32
+}
+
+func (lr *LeaderRun) upper() int64 {
+	return lr.Base + lr.Count
+}
+
+func (ors *OffsetRanges) NoteLeader(o int64, leader int32, epoch int32) {
+	if n := len(ors.Leaders); n > 0 {
+		last := &ors.Leaders[n-1]
+		if o >= last.upper() && last.Leader == leader && last.Epoch == epoch {
+			last.Count = o + 1 - last.Base
+			return
+		}
+	}
+	ors.Leaders = append(ors.Leaders, LeaderRun{Base: o, Count: 1, Leader: leader, Epoch: epoch})
+}
+
+func (ors *OffsetRanges) LookupLeader(o int64) (LeaderRun, bool) {
+	i := sort.Search(len(ors.Leaders), func(i int) bool { return ors.Leaders[i].upper() > o })
+	if i < len(ors.Leaders) && ors.Leaders[i].Base <= o {
+		return ors.Leaders[i], true
+	}
+	return LeaderRun{}, false
+}
+
+// Union of two sorted lists of runs, keeping the leaders we saw first
+// where they overlap, and joining adjacent runs of the same leader and
+// epoch.
+func mergeLeaders(a []LeaderRun, b []LeaderRun) []LeaderRun {
+	if len(b) == 0 {
+		return a
+	}
+	all := append(append([]LeaderRun{}, a...), b...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Base < all[j].Base })
+
+	var merged []LeaderRun
+	for _, lr := range all {
+		if n := len(merged); n > 0 && lr.Base < merged[n-1].upper() {
+			last := &merged[n-1]
+			if lr.upper() > last.upper() {
+				merged = append(merged, LeaderRun{Base: last.upper(), Count: lr.upper() - last.upper(), Leader: lr.Leader, Epoch: lr.Epoch})
+			}
+		} else if n > 0 && lr.Base == merged[n-1].upper() && lr.Leader == merged[n-1].Leader && lr.Epoch == merged[n-1].Epoch {
+			merged[n-1].Count += lr.Count
+		} else {
+			merged = append(merged, lr)
+		}
+	}
+	return merged
+}
+
+func trimLeaders(runs []LeaderRun, o int64) []LeaderRun {
+	i := sort.Search(len(runs), func(i int) bool { return runs[i].upper() > o })
+	if i == len(runs) {
+		return nil
+	}
+	runs = runs[i:]
+	if runs[0].Base < o {
+		runs[0] = LeaderRun{Base: o, Count: runs[0].upper() - o, Leader: runs[0].Leader, Epoch: runs[0].Epoch}
+	}
+	return runs
+}
+
+// Records the broker each produce batch was written to
+type produceLeaderHook struct{}
+
+func (produceLeaderHook) OnProduceBatchWritten(meta kgo.BrokerMetadata, t string, p int32, _ kgo.ProduceBatchMetrics) {
+	if t != *topic {
+		return
+	}
+	currentProduceLeaders().noteBroker(p, meta.NodeID)
+}
+
+type leaderEpoch struct {
+	leader int32
+	epoch  int32
+	// The partition's generation when the metadata was requested
+	gen int64
+}
+
+type ProduceLeaderTracker struct {
+	lock    sync.Mutex
+	brokers map[int32]int32
+	// Bumped each time a partition's batches go to a different broker, so
+	// that an epoch loaded before the move is never used after it, even
+	// if leadership has since come back to the same broker
+	gens   map[int32]int64
+	epochs map[int32]leaderEpoch
+
+	refresh chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// The tracker the produce hook reports to, nil unless producing: methods
+// are no-ops on nil
+var (
+	produceLeaders     *ProduceLeaderTracker
+	produceLeadersLock sync.Mutex
+)
+
+func currentProduceLeaders() *ProduceLeaderTracker {
+	produceLeadersLock.Lock()
+	defer produceLeadersLock.Unlock()
+	return produceLeaders
+}
+
+func setProduceLeaders(lt *ProduceLeaderTracker) {
+	produceLeadersLock.Lock()
+	defer produceLeadersLock.Unlock()
+	produceLeaders = lt
+}
+
+func StartProduceLeaderTracker(client *kgo.Client, nPartitions int32) *ProduceLeaderTracker {
+	lt := &ProduceLeaderTracker{
+		brokers: make(map[int32]int32),
+		gens:    make(map[int32]int64),
+		epochs:  make(map[int32]leaderEpoch),
+		refresh: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	lt.refresh <- struct{}{}
+	go func() {
+		defer close(lt.done)
+		for {
+			select {
+			case <-lt.stop:
+				return
+			case <-lt.refresh:
+			}
+			lt.lock.Lock()
+			gens := make(map[int32]int64, len(lt.gens))
+			for p, gen := range lt.gens {
+				gens[p] = gen
+			}
+			lt.lock.Unlock()
+
+			t, _, err := getTopicMetadata(client)
+			if err != nil {
+				log.Debugf("Error loading leader epochs: %v", err)
+				// Try again shortly, rather than on the next leader move
+				time.AfterFunc(time.Second, lt.requestRefresh)
+				continue
+			}
+			lt.lock.Lock()
+			for _, p := range t.Partitions {
+				if p.Partition < nPartitions && p.Err == nil {
+					lt.epochs[p.Partition] = leaderEpoch{leader: p.Leader, epoch: p.LeaderEpoch, gen: gens[p.Partition]}
+				}
+			}
+			lt.lock.Unlock()
+		}
+	}()
+	return lt
+}
+
+func (lt *ProduceLeaderTracker) Stop() {
+	if lt == nil {
+		return
+	}
+	close(lt.stop)
+	<-lt.done
+}
+
+func (lt *ProduceLeaderTracker) requestRefresh() {
+	select {
+	case lt.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (lt *ProduceLeaderTracker) noteBroker(p int32, broker int32) {
+	if lt == nil {
+		return
+	}
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	if prev, ok := lt.brokers[p]; ok && prev != broker {
+		lt.gens[p] += 1
+	}
+	lt.brokers[p] = broker
+	if le, ok := lt.epochs[p]; !ok || le.gen != lt.gens[p] || le.leader != broker {
+		lt.requestRefresh()
+	}
+}
+
+// The broker that acked a partition's latest batch, and its leader epoch
+// if metadata loaded since the batch went to that broker says so: -1 for
+// whichever we don't know
+func (lt *ProduceLeaderTracker) Current(p int32) (int32, int32) {
+	if lt == nil {
+		return -1, -1
+	}
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	broker, ok := lt.brokers[p]
+	if !ok {
+		return -1, -1
+	}
+	if le, ok := lt.epochs[p]; ok && le.leader == broker && le.gen == lt.gens[p] {
+		return broker, le.epoch
+	}
+	return broker, -1
+}
+
+func (lr LeaderRun) String() string {
+	return fmt.Sprintf("broker %d epoch %d", lr.Leader, lr.Epoch)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNoteLeader(t *testing.T) {
+	ors := &OffsetRanges{}
+	ors.NoteLeader(0, 1, 5)
+	ors.NoteLeader(1, 1, 5)
+	// Offsets that weren't ours in between stay in the run
+	ors.NoteLeader(4, 1, 5)
+	ors.NoteLeader(5, 2, 6)
+	ors.NoteLeader(6, 2, -1)
+	want := []LeaderRun{{0, 5, 1, 5}, {5, 1, 2, 6}, {6, 1, 2, -1}}
+	if !reflect.DeepEqual(ors.Leaders, want) {
+		t.Fatalf("runs %v, want %v", ors.Leaders, want)
+	}
+	if lr, ok := ors.LookupLeader(3); !ok || lr.Leader != 1 {
+		t.Errorf("leader at 3: %v %v", lr, ok)
+	}
+	if _, ok := ors.LookupLeader(7); ok {
+		t.Errorf("leader found past the end")
+	}
+}
+
+func TestMergeLeaders(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b []LeaderRun
+		want []LeaderRun
+	}{
+		{"nothing to add", []LeaderRun{{0, 5, 1, 1}}, nil, []LeaderRun{{0, 5, 1, 1}}},
+		{"adjacent, same leader", []LeaderRun{{0, 5, 1, 1}}, []LeaderRun{{5, 5, 1, 1}}, []LeaderRun{{0, 10, 1, 1}}},
+		{"adjacent, new epoch", []LeaderRun{{0, 5, 1, 1}}, []LeaderRun{{5, 5, 1, 2}}, []LeaderRun{{0, 5, 1, 1}, {5, 5, 1, 2}}},
+		{"overlap keeps the first", []LeaderRun{{0, 5, 1, 1}}, []LeaderRun{{3, 5, 2, 2}}, []LeaderRun{{0, 5, 1, 1}, {5, 3, 2, 2}}},
+		{"contained", []LeaderRun{{0, 10, 1, 1}}, []LeaderRun{{3, 2, 2, 2}}, []LeaderRun{{0, 10, 1, 1}}},
+	}
+	for _, c := range cases {
+		if got := mergeLeaders(c.a, c.b); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestTrimLeaders(t *testing.T) {
+	runs := []LeaderRun{{0, 5, 1, 1}, {5, 5, 2, 2}}
+	if got := trimLeaders(append([]LeaderRun{}, runs...), 7); !reflect.DeepEqual(got, []LeaderRun{{7, 3, 2, 2}}) {
+		t.Errorf("trimmed to %v", got)
+	}
+	if got := trimLeaders(append([]LeaderRun{}, runs...), 10); got != nil {
+		t.Errorf("trim past the end kept %v", got)
+	}
+}
+
+func TestProduceLeaderTrackerGenerations(t *testing.T) {
+	lt := &ProduceLeaderTracker{
+		brokers: make(map[int32]int32),
+		gens:    make(map[int32]int64),
+		epochs:  map[int32]leaderEpoch{0: {leader: 1, epoch: 5}},
+		refresh: make(chan struct{}, 1),
+	}
+	lt.noteBroker(0, 1)
+	if broker, epoch := lt.Current(0); broker != 1 || epoch != 5 {
+		t.Errorf("Current = %d %d, want 1 5", broker, epoch)
+	}
+
+	// Leadership moves away and back: the epoch loaded before must not be
+	// used, though it names the same broker
+	lt.noteBroker(0, 2)
+	lt.noteBroker(0, 1)
+	if _, epoch := lt.Current(0); epoch != -1 {
+		t.Errorf("stale epoch %d used after leadership moved", epoch)
+	}
+	if len(lt.refresh) != 1 {
+		t.Errorf("no refresh requested")
+	}
+
+	// Until metadata requested after the move comes back
+	lt.epochs[0] = leaderEpoch{leader: 1, epoch: 7, gen: lt.gens[0]}
+	if _, epoch := lt.Current(0); epoch != 7 {
+		t.Errorf("epoch %d, want 7", epoch)
+	}
+
+	var none *ProduceLeaderTracker
+	none.noteBroker(0, 1)
+	if broker, epoch := none.Current(0); broker != -1 || epoch != -1 {
+		t.Errorf("nil tracker Current = %d %d", broker, epoch)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// With shadow indexing, a topic's retention settings only govern the local
+// copy of its data: once segments are uploaded, local trimming must not
+// change what consumers can read, because reads below the local start
+// offset are served from object storage.  In local trim mode we shrink
+// local retention after producing, wait for brokers to act on it, and
+// check that the start offset has not moved, so that the sequential read
+// which follows has to fetch everything below the active segment from
+// object storage.
+
+// Read a topic config, returning its value and whether it was set on the
+// topic (as opposed to inherited from a default)
+func describeTopicConfig(client *kgo.Client, name string) (*string, bool, error) {
+	configs, err := getTopicConfigs(client)
+	if err != nil {
+		return nil, false, err
+	}
+	c, ok := configs[name]
+	if !ok {
+		return nil, false, nil
+	}
+	return c.Value, c.Source == kmsg.ConfigSourceDynamicTopicConfig, nil
+}
+
+// Set a topic config, or remove it if value is nil
+func alterTopicConfig(client *kgo.Client, name string, value *string) error {
+	config := kadm.AlterConfig{Op: kadm.SetConfig, Name: name, Value: value}
+	if value == nil {
+		config.Op = kadm.DeleteConfig
+	}
+	resps, err := kadm.NewClient(client).AlterTopicConfigs(runCtx, []kadm.AlterConfig{config}, *topic)
+	if err != nil {
+		return fmt.Errorf("error altering %s config: %w", *topic, err)
+	}
+	for _, r := range resps {
+		if r.Err != nil {
+			return fmt.Errorf("error setting %s on %s: %w", name, *topic, r.Err)
+		}
+	}
+	return nil
+}
+
+// The largest local size of each partition across its replicas, or nil
+// if the cluster will not tell us
+func getLocalSizes(client *kgo.Client, nPartitions int32) []int64 {
+	req := kmsg.NewPtrDescribeLogDirsRequest()
+	reqTopic := kmsg.NewDescribeLogDirsRequestTopic()
+	reqTopic.Topic = *topic
+	for p := int32(0); p < nPartitions; p++ {
+		reqTopic.Partitions = append(reqTopic.Partitions, p)
+	}
+	req.Topics = append(req.Topics, reqTopic)
+
+	sizes := make([]int64, nPartitions)
+	found := false
+	for _, shard := range client.RequestSharded(runCtx, req) {
+		if shard.Err != nil {
+			log.Debugf("DescribeLogDirs error from broker %d: %v", shard.Meta.NodeID, shard.Err)
+			continue
+		}
+		resp := shard.Resp.(*kmsg.DescribeLogDirsResponse)
+		for _, d := range resp.Dirs {
+			for _, t := range d.Topics {
+				if t.Topic != *topic {
+					continue
+				}
+				for _, p := range t.Partitions {
+					if p.Partition < nPartitions && p.Size > sizes[p.Partition] {
+						sizes[p.Partition] = p.Size
+					}
+					found = true
+				}
+			}
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return sizes
+}
+
+// Shrink local retention and wait for it to take effect.  Returns a
+// function that puts the original setting back.
+func localTrim(nPartitions int32) func() {
+	client := newClient(nil)
+	defer closeClient(client)
+
+	lwmBefore, err := getOffsets(client, nPartitions, -2)
+	ChkEmit(err, "%v", err)
+	sizesBefore := getLocalSizes(client, nPartitions)
+
+	original, wasSet, err := describeTopicConfig(client, *localTrimConfig)
+	Chk(err, "%v", err)
+	if !wasSet {
+		original = nil
+	}
+	log.Infof("Setting %s=%s on %s to trim local data", *localTrimConfig, *localTrimValue, *topic)
+	err = alterTopicConfig(client, *localTrimConfig, localTrimValue)
+	Chk(err, "%v", err)
+
+	restore := func() {
+		client := newClient(nil)
+		defer closeClient(client)
+		if original == nil {
+			log.Infof("Removing %s from %s", *localTrimConfig, *topic)
+		} else {
+			log.Infof("Restoring %s=%s on %s", *localTrimConfig, *original, *topic)
+		}
+		if err := alterTopicConfig(client, *localTrimConfig, original); err != nil {
+			log.Errorf("Could not restore %s on %s: %v", *localTrimConfig, *topic, err)
+		}
+	}
+
+	// Wait for every partition that had data to shrink.  A partition whose
+	// data all sits in its active segment will never shrink, so on timeout
+	// we carry on and just warn.
+	if sizesBefore == nil {
+		log.Warnf("Cannot see local partition sizes, waiting %v for local trim", *localTrimTimeout)
+		time.Sleep(*localTrimTimeout)
+	} else {
+		deadline := time.Now().Add(*localTrimTimeout)
+		for {
+			sizes := getLocalSizes(client, nPartitions)
+			waiting := 0
+			for p := int32(0); p < nPartitions; p++ {
+				if ownsPartition(p) && sizesBefore[p] > 0 && sizes != nil && sizes[p] >= sizesBefore[p] {
+					waiting += 1
+				}
+			}
+			if waiting == 0 {
+				log.Infof("Local data trimmed on all partitions")
+				break
+			} else if time.Now().After(deadline) {
+				log.Warnf("Local data not trimmed on %d partitions after %v", waiting, *localTrimTimeout)
+				break
+			}
+			log.Infof("Waiting for local trim, %d partitions remaining...", waiting)
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	// Local trimming must be invisible to consumers
+	lwmAfter, hwm, err := getOffsetBounds(client, nPartitions)
+	ChkEmit(err, "%v", err)
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+	lost := false
+	for p := int32(0); p < nPartitions; p++ {
+		if lwmAfter[p] > lwmBefore[p] {
+			log.Errorf("Start offset of %s/%d advanced from %d to %d on local trim", *topic, p, lwmBefore[p], lwmAfter[p])
+			results.AddDataLoss(DataLoss{
+				Partition:    p,
+				AckedUpper:   validRanges.PartitionRanges[p].AckedUpper,
+				AckedEpoch:   validRanges.PartitionRanges[p].AckedEpoch,
+				Lwm:          lwmAfter[p],
+				Hwm:          hwm[p],
+				CurrentEpoch: -1,
+			})
+			lost = true
+		}
+	}
+	if lost {
+		restore()
+		results.Emit()
+		Die("Local trim made data unreadable on %s", *topic)
+	}
+
+	return restore
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// When the topic has message.timestamp.type=LogAppendTime, the broker
+// stamps each record as it appends it, so we can check more than that
+// timestamps resolve: every record must carry a broker-assigned timestamp,
+// timestamps must not go backwards along a partition, and each must fall
+// between when we sent the record and when it was acked (give or take
+// --timestamp_skew, for the broker's clock not matching ours).
+//
+// Keeping send and ack times for every record would cost more state than
+// the records' offsets do, so we keep a mark about once a second per
+// partition.  Offsets are assigned in append order, so a record appended
+// no earlier than the latest mark at or below its offset was sent, and no
+// later than the earliest mark above it was acked.
+
+// Milliseconds between marks
+const produceTimeInterval = 1000
+
+// When the record at Offset was sent and acked, in milliseconds
+type ProduceTime struct {
+	Offset int64
+	Sent   int64
+	Acked  int64
+}
+
+// Whether the topic's timestamps are assigned by the broker
+var logAppendTime bool
+
+func (ors *OffsetRanges) NoteProduceTime(o int64, sent time.Time, acked time.Time) {
+	pt := ProduceTime{Offset: o, Sent: sent.UnixMilli(), Acked: acked.UnixMilli()}
+	// The last mark always follows the latest ack, so that every offset we
+	// produced lies at or below one
+	n := len(ors.ProduceTimes)
+	if n >= 2 && pt.Acked-ors.ProduceTimes[n-2].Acked < produceTimeInterval {
+		ors.ProduceTimes[n-1] = pt
+	} else {
+		ors.ProduceTimes = append(ors.ProduceTimes, pt)
+	}
+}
+
+// The window in which the record at offset o must have been appended, in
+// milliseconds, if our marks bound it on both sides
+func (ors *OffsetRanges) produceTimeBounds(o int64) (int64, int64, bool) {
+	marks := ors.ProduceTimes
+	i := sort.Search(len(marks), func(i int) bool { return marks[i].Offset >= o })
+	if i == len(marks) {
+		return 0, 0, false
+	}
+	upper := marks[i].Acked
+	if marks[i].Offset != o {
+		i -= 1
+	}
+	if i < 0 {
+		return 0, 0, false
+	}
+	return marks[i].Sent, upper, true
+}
+
+func mergeProduceTimes(a []ProduceTime, b []ProduceTime) []ProduceTime {
+	if len(b) == 0 {
+		return a
+	}
+	merged := append(append([]ProduceTime{}, a...), b...)
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Offset < merged[j].Offset })
+	return merged
+}
+
+func trimProduceTimes(marks []ProduceTime, o int64) []ProduceTime {
+	i := sort.Search(len(marks), func(i int) bool { return marks[i].Offset >= o })
+	if i == len(marks) {
+		return nil
+	}
+	return marks[i:]
+}
+
+// Check a record's timestamp was assigned by the broker while we were
+// producing it
+func validateLogAppendTime(r *kgo.Record, ors *OffsetRanges) {
+	if !logAppendTime {
+		return
+	}
+	if r.Attrs.TimestampType() != 1 {
+		badRecord(r, ors, "LogAppendTime timestamp", "CreateTime timestamp",
+			"Bad read at offset %d on partition %s/%d: topic uses LogAppendTime, but timestamp type is %d", r.Offset, *topic, r.Partition, r.Attrs.TimestampType())
+		return
+	}
+	lower, upper, ok := ors.produceTimeBounds(r.Offset)
+	if !ok {
+		return
+	}
+	skew := timestampSkew.Milliseconds()
+	ts := r.Timestamp.UnixMilli()
+	if ts < lower-skew || ts > upper+skew {
+		expected := fmt.Sprintf("t=%d-%d", lower, upper)
+		badRecord(r, ors, expected, fmt.Sprintf("t=%d", ts),
+			"Bad read at offset %d on partition %s/%d: LogAppendTime t=%d outside produce window t=%d-%d (skew %v)",
+			r.Offset, *topic, r.Partition, ts, lower, upper, *timestampSkew)
+	}
+}
+
+// Check that LogAppendTime timestamps don't go backwards along a partition,
+// given the last timestamp read on each
+func checkTimestampOrder(r *kgo.Record, ors *OffsetRanges, last []int64) {
+	if !logAppendTime || r.Attrs.IsControl() {
+		return
+	}
+	ts := r.Timestamp.UnixMilli()
+	if ts < last[r.Partition] {
+		badRecord(r, ors, fmt.Sprintf("t>=%d", last[r.Partition]), fmt.Sprintf("t=%d", ts),
+			"Bad read at offset %d on partition %s/%d: LogAppendTime t=%d is earlier than the previous record's t=%d",
+			r.Offset, *topic, r.Partition, ts, last[r.Partition])
+	}
+	last[r.Partition] = ts
+}
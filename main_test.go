@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// A partition fragmented into n ranges of 10 offsets, with gaps between
+func fragmentedRanges(n int) *OffsetRanges {
+	ors := &OffsetRanges{}
+	for i := int64(0); i < int64(n); i++ {
+		ors.Ranges = append(ors.Ranges, OffsetRange{Lower: i * 20, Upper: i*20 + 10})
+	}
+	return ors
+}
+
+func TestOffsetRangesLookup(t *testing.T) {
+	ors := fragmentedRanges(100)
+	cases := []struct {
+		o     int64
+		found bool
+		lower int64
+	}{
+		{0, true, 0},
+		{9, true, 0},
+		{10, false, 0},
+		{19, false, 0},
+		{20, true, 20},
+		{1989, true, 1980},
+		{1990, false, 0},
+		{-1, false, 0},
+	}
+	for _, c := range cases {
+		r, ok := ors.Lookup(c.o)
+		if ok != c.found || (ok && r.Lower != c.lower) {
+			t.Errorf("Lookup(%d) = %v %v, want found=%v lower=%d", c.o, r, ok, c.found, c.lower)
+		}
+	}
+}
+
+func BenchmarkOffsetRangesLookup(b *testing.B) {
+	for _, n := range []int{1, 100, 10000} {
+		ors := fragmentedRanges(n)
+		span := int64(n) * 20
+		b.Run(fmt.Sprintf("ranges=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ors.Lookup(int64(i) % span)
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	cases := []struct {
+		key           string
+		epoch, offset int64
+		ok            bool
+	}{
+		{formatKey(0, 0), 0, 0, true},
+		{formatKey(12, 345), 12, 345, true},
+		{formatKey(999999, 1<<40), 999999, 1 << 40, true},
+		// Padding after the key is allowed, if it starts with a separator
+		{formatKey(3, 7) + ".xxxxxxxx", 3, 7, true},
+		{formatKey(3, 7) + "x", 0, 0, false},
+		{formatKey(3, 7)[:keyLen-1], 0, 0, false},
+		{"000003-000000000000000007", 0, 0, false},
+		{"00000a.000000000000000007", 0, 0, false},
+		{"", 0, 0, false},
+		{"key-1", 0, 0, false},
+	}
+	for _, c := range cases {
+		epoch, offset, ok := parseKey([]byte(c.key))
+		if ok != c.ok || epoch != c.epoch || offset != c.offset {
+			t.Errorf("parseKey(%q) = %d %d %v, want %d %d %v", c.key, epoch, offset, ok, c.epoch, c.offset, c.ok)
+		}
+	}
+	if n := len(formatKey(1, 1)); n != keyLen {
+		t.Errorf("formatKey length %d, want %d", n, keyLen)
+	}
+}
+
+// A partition holding a single record is read, at that record, whatever
+// the distribution
+func TestChooseReadOffsetSingleRecord(t *testing.T) {
+	defer func(dist string) { *readDist = dist }(*readDist)
+	rng := rand.New(rand.NewSource(1))
+	for _, dist := range []string{"uniform", "zipfian", "head", "tail"} {
+		*readDist = dist
+		for i := 0; i < 10; i++ {
+			if o := chooseReadOffset(rng, 41, 1); o != 41 {
+				t.Fatalf("%s: chose %d from the single record at 41", dist, o)
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redpanda's shadow indexing uploads each partition's closed segments to
+// object storage, along with a manifest listing them:
+//
+//   <hash>/meta/kafka/<topic>/<partition>_<revision>/manifest.json
+//   <hash>/kafka/<topic>/<partition>_<revision>/<base>-<term>-v1.log
+//
+// The hash prefix spreads keys across S3 partitions, and is different for
+// every object, so we find our topic's objects by listing the bucket.
+
+type SegmentMeta struct {
+	IsCompacted     bool  `json:"is_compacted"`
+	SizeBytes       int64 `json:"size_bytes"`
+	BaseOffset      int64 `json:"base_offset"`
+	CommittedOffset int64 `json:"committed_offset"`
+	// Difference between Redpanda's log offsets and Kafka offsets at the
+	// start of the segment.  Older manifests do not have it.
+	DeltaOffset int64 `json:"delta_offset"`
+}
+
+type PartitionManifest struct {
+	Version    int                    `json:"version"`
+	Namespace  string                 `json:"namespace"`
+	Topic      string                 `json:"topic"`
+	Partition  int32                  `json:"partition"`
+	Revision   int64                  `json:"revision"`
+	LastOffset int64                  `json:"last_offset"`
+	Segments   map[string]SegmentMeta `json:"segments"`
+}
+
+// Strip the hash prefix from an object key
+func unhashedKey(key string) string {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return key
+	}
+	return key[i+1:]
+}
+
+// Load the newest manifest for each partition of our topic, along with
+// the (unhashed) keys of the topic's segment objects, mapped to their
+// full keys.
+func loadManifests(s3 *S3Client) (map[int32]PartitionManifest, map[string]string) {
+	objects, err := s3.List("")
+	Chk(err, "Error listing bucket %s: %v", *s3Bucket, err)
+
+	manifestPrefix := fmt.Sprintf("meta/kafka/%s/", *topic)
+	segmentPrefix := fmt.Sprintf("kafka/%s/", *topic)
+
+	manifests := make(map[int32]PartitionManifest)
+	segments := make(map[string]string)
+	for _, o := range objects {
+		key := unhashedKey(o.Key)
+		if strings.HasPrefix(key, segmentPrefix) {
+			segments[key] = o.Key
+			continue
+		}
+		if !strings.HasPrefix(key, manifestPrefix) || !strings.HasSuffix(key, "/manifest.json") {
+			continue
+		}
+
+		data, err := s3.Get(o.Key)
+		Chk(err, "Error reading manifest %s: %v", o.Key, err)
+		var m PartitionManifest
+		err = json.Unmarshal(data, &m)
+		Chk(err, "Bad manifest %s: %v", o.Key, err)
+
+		// A topic deleted and recreated under the same name leaves manifests
+		// for each revision: only the newest is the current topic's.
+		if existing, ok := manifests[m.Partition]; ok {
+			if existing.Revision > m.Revision {
+				log.Infof("Ignoring manifest %s for older revision %d", o.Key, m.Revision)
+				continue
+			}
+			log.Infof("Ignoring manifest for older revision %d of partition %d", existing.Revision, m.Partition)
+		}
+		log.Debugf("Loaded manifest %s: %d segments, last offset %d", o.Key, len(m.Segments), m.LastOffset)
+		manifests[m.Partition] = m
+	}
+
+	return manifests, segments
+}
+
+// A segment object's key, without the hash prefix
+func segmentObjectKey(p int32, revision int64, name string) string {
+	return fmt.Sprintf("kafka/%s/%d_%d/%s", *topic, p, revision, name)
+}
+
+// Check one partition's manifest against our acked offsets, returning the
+// number of problems found.
+func checkManifest(m PartitionManifest, segmentKeys map[string]string, ranges *OffsetRanges) int {
+	p := m.Partition
+	issues := 0
+	report := func(segment string, lower int64, upper int64, problem string) {
+		log.Errorf("Cloud storage problem on %s/%d offsets %d-%d (%s): %s", *topic, p, lower, upper, segment, problem)
+		results.AddCloudStorageIssue(CloudStorageIssue{
+			Partition: p,
+			Segment:   segment,
+			Lower:     lower,
+			Upper:     upper,
+			Problem:   problem,
+		})
+		issues += 1
+	}
+
+	var names []string
+	for name := range m.Segments {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return m.Segments[names[i]].BaseOffset < m.Segments[names[j]].BaseOffset
+	})
+	if len(names) == 0 {
+		log.Infof("No segments uploaded yet for %s/%d", *topic, p)
+		return 0
+	}
+
+	// Segments must be present in the bucket, and contiguous.  Coverage
+	// is worked out in Kafka offsets, so that we can compare it with our
+	// acked offsets: on manifests without delta_offset these are really
+	// Redpanda log offsets, which run ahead of Kafka offsets by the number
+	// of configuration batches, so a gap may go unnoticed there.
+	type span struct{ lower, upper int64 }
+	var gaps []span
+	for i, name := range names {
+		s := m.Segments[name]
+		if _, ok := segmentKeys[segmentObjectKey(p, m.Revision, name)]; !ok {
+			report(name, s.BaseOffset, s.CommittedOffset, "segment in manifest but missing from bucket")
+		}
+		if i > 0 {
+			prev := m.Segments[names[i-1]]
+			if s.BaseOffset > prev.CommittedOffset+1 {
+				report(name, prev.CommittedOffset+1, s.BaseOffset-1, "gap between segments")
+				gaps = append(gaps, span{prev.CommittedOffset + 1 - prev.DeltaOffset, s.BaseOffset - s.DeltaOffset})
+			} else if s.BaseOffset <= prev.CommittedOffset {
+				report(name, s.BaseOffset, prev.CommittedOffset, "segments overlap")
+			}
+		}
+	}
+
+	first := m.Segments[names[0]]
+	last := m.Segments[names[len(names)-1]]
+	uploadStart := first.BaseOffset - first.DeltaOffset
+	uploadEnd := last.CommittedOffset - last.DeltaOffset + 1
+
+	// Every acked offset in the uploaded span must be in some segment
+	var pending int64
+	for _, r := range ranges.AllRanges() {
+		for _, g := range gaps {
+			lower, upper := r.Lower, r.Upper
+			if g.lower > lower {
+				lower = g.lower
+			}
+			if g.upper < upper {
+				upper = g.upper
+			}
+			if lower < upper {
+				report("", lower, upper-1, "acked offsets not covered by any segment")
+			}
+		}
+		if r.Upper > uploadEnd {
+			lower := r.Lower
+			if lower < uploadEnd {
+				lower = uploadEnd
+			}
+			pending += r.Upper - lower
+		}
+	}
+
+	if ranges.AckedUpper > 0 && uploadStart >= ranges.AckedUpper {
+		log.Warnf("Uploads for %s/%d start at %d, beyond all acked offsets (%d)", *topic, p, uploadStart, ranges.AckedUpper)
+	}
+	log.Infof("%s/%d: %d segments cover %d-%d, %d acked offsets not yet uploaded",
+		*topic, p, len(names), uploadStart, uploadEnd-1, pending)
+	return issues
+}
+
+// The check-manifests subcommand: check that the partition manifests in
+// object storage describe a contiguous run of uploaded segments, all of
+// which exist, covering all the acked offsets in our state file that
+// shadow indexing should have uploaded by now.
+func checkManifests() {
+	if len(*topic) == 0 {
+		Die("check-manifests requires --topic")
+	}
+
+	client := newClient(nil)
+	t, cid, err := getTopicMetadata(client)
+	closeClient(client)
+	Chk(err, "%v", err)
+	clusterID = cid
+	topicID = formatTopicID(t.ID)
+	nPartitions := int32(len(t.Partitions))
+
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+	manifests, segmentKeys := loadManifests(NewS3Client())
+
+	issues := 0
+	for p := int32(0); p < nPartitions; p++ {
+		m, ok := manifests[p]
+		if !ok {
+			if validRanges.PartitionRanges[p].AckedUpper > 0 {
+				log.Warnf("No manifest in bucket %s for %s/%d", *s3Bucket, *topic, p)
+			}
+			continue
+		}
+		issues += checkManifest(m, segmentKeys, &validRanges.PartitionRanges[p])
+	}
+
+	results.Emit()
+	if issues > 0 {
+		Die("%d cloud storage problems on %s", issues, *topic)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// The merge-state subcommand: combine the valid offsets files written by
+// several producers (e.g. one per pod, each with its own working directory)
+// into this topic's valid offsets file, so that a single reader can
+// validate everything they wrote.
+func mergeState(files []string) {
+	if len(*topic) == 0 {
+		Die("merge-state requires --topic, to name the output file")
+	}
+	if len(files) == 0 {
+		Die("Usage: merge-state <valid_offsets file>...")
+	}
+
+	var merged TopicOffsetRanges
+	for i, f := range files {
+		tors, shardErrs, err := readState(f)
+		Chk(err, "Bad state file %s: %v", f, err)
+		for p, err := range shardErrs {
+			Die("Bad state file %s: %v", statePartitionFile(f, p), err)
+		}
+
+		if i == 0 {
+			// Adopt the first file's identity, and check the rest against it
+			clusterID = tors.ClusterID
+			topicID = tors.TopicID
+		}
+		err = tors.checkIdentity(f)
+		Chk(err, "%v", err)
+
+		if tors.ProduceEpoch > merged.ProduceEpoch {
+			merged.ProduceEpoch = tors.ProduceEpoch
+		}
+		for len(merged.PartitionRanges) < len(tors.PartitionRanges) {
+			merged.PartitionRanges = append(merged.PartitionRanges, OffsetRanges{})
+		}
+		for p := range tors.PartitionRanges {
+			overlap := merged.PartitionRanges[p].Merge(&tors.PartitionRanges[p])
+			if overlap > 0 {
+				// Two producers both claim to have written these offsets: keep
+				// them, but one of the producers' accounting must be wrong.
+				log.Warnf("%s overlaps earlier files by %d offsets on partition %d", f, overlap, p)
+			}
+		}
+		mergeKeyPartitions(&merged, &tors)
+		log.Infof("Merged %s (%d partitions)", f, len(tors.PartitionRanges))
+	}
+
+	merged.ClusterID = clusterID
+	merged.TopicID = topicID
+	err := merged.Store()
+	Chk(err, "Error writing merged state: %v", err)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOffsetRangesMerge(t *testing.T) {
+	r := func(lower, upper, epoch int64) OffsetRange {
+		return OffsetRange{Lower: lower, Upper: upper, Epoch: epoch}
+	}
+	cases := []struct {
+		name    string
+		a, b    []OffsetRange
+		want    []OffsetRange
+		overlap int64
+	}{
+		{"into empty", nil, []OffsetRange{r(0, 5, 1)}, []OffsetRange{r(0, 5, 1)}, 0},
+		{"disjoint", []OffsetRange{r(0, 5, 1)}, []OffsetRange{r(10, 15, 1)}, []OffsetRange{r(0, 5, 1), r(10, 15, 1)}, 0},
+		{"adjacent, same epoch", []OffsetRange{r(0, 5, 1)}, []OffsetRange{r(5, 10, 1)}, []OffsetRange{r(0, 10, 1)}, 0},
+		{"adjacent, other epoch", []OffsetRange{r(0, 5, 1)}, []OffsetRange{r(5, 10, 2)}, []OffsetRange{r(0, 5, 1), r(5, 10, 2)}, 0},
+		{"overlapping", []OffsetRange{r(0, 10, 1)}, []OffsetRange{r(5, 15, 1)}, []OffsetRange{r(0, 15, 1)}, 5},
+		{"contained", []OffsetRange{r(0, 10, 1)}, []OffsetRange{r(2, 4, 1)}, []OffsetRange{r(0, 10, 1)}, 2},
+		{"out of order", []OffsetRange{r(20, 30, 1)}, []OffsetRange{r(0, 10, 1)}, []OffsetRange{r(0, 10, 1), r(20, 30, 1)}, 0},
+	}
+	for _, c := range cases {
+		a := OffsetRanges{Ranges: append([]OffsetRange{}, c.a...)}
+		b := OffsetRanges{Ranges: c.b}
+		overlap := a.Merge(&b)
+		if !reflect.DeepEqual(a.Ranges, c.want) || overlap != c.overlap {
+			t.Errorf("%s: got %v overlap %d, want %v overlap %d", c.name, a.Ranges, overlap, c.want, c.overlap)
+		}
+	}
+}
+
+// Every per-offset field survives a merge, from either side
+func TestOffsetRangesMergeFields(t *testing.T) {
+	a := OffsetRanges{
+		Ranges:      []OffsetRange{{Lower: 0, Upper: 5}},
+		Tombstones:  []int64{1},
+		EmptyValues: []int64{2},
+		Unexpected:  []UnexpectedRecord{{Offset: 3, KeyOffset: 4}},
+		Checksums:   []ChecksumRun{{Base: 0, Sums: []uint32{10, 11, 12, 13, 14}}},
+		ValueSizes:  []SizeRun{{Base: 0, Count: 5, Size: 100}},
+		Leaders:     []LeaderRun{{Base: 0, Count: 5, Leader: 1, Epoch: 2}},
+	}
+	b := OffsetRanges{
+		Ranges:      []OffsetRange{{Lower: 5, Upper: 8}},
+		Tombstones:  []int64{6},
+		EmptyValues: []int64{7},
+		Unexpected:  []UnexpectedRecord{{Offset: 9, KeyOffset: 5}},
+		Checksums:   []ChecksumRun{{Base: 5, Sums: []uint32{15, 16, 17}}},
+		ValueSizes:  []SizeRun{{Base: 5, Count: 3, Size: 100}},
+		Leaders:     []LeaderRun{{Base: 5, Count: 3, Leader: 2, Epoch: 3}},
+	}
+	a.Merge(&b)
+
+	if !reflect.DeepEqual(a.Ranges, []OffsetRange{{Lower: 0, Upper: 8}}) {
+		t.Errorf("Ranges %v", a.Ranges)
+	}
+	if !reflect.DeepEqual(a.Tombstones, []int64{1, 6}) || !reflect.DeepEqual(a.EmptyValues, []int64{2, 7}) {
+		t.Errorf("Tombstones %v EmptyValues %v", a.Tombstones, a.EmptyValues)
+	}
+	if len(a.Unexpected) != 2 || a.Unexpected[1].Offset != 9 {
+		t.Errorf("Unexpected %v", a.Unexpected)
+	}
+	if sum, ok := a.LookupChecksum(6); !ok || sum != 16 {
+		t.Errorf("checksum at 6: %d %v", sum, ok)
+	}
+	if !reflect.DeepEqual(a.ValueSizes, []SizeRun{{Base: 0, Count: 8, Size: 100}}) {
+		t.Errorf("ValueSizes %v", a.ValueSizes)
+	}
+	if lr, ok := a.LookupLeader(6); !ok || lr.Leader != 2 {
+		t.Errorf("leader at 6: %+v %v", lr, ok)
+	}
+}
+
+func TestMergeKeyPartitions(t *testing.T) {
+	into := TopicOffsetRanges{}
+	into.NoteKeyPartition("a", 0)
+	into.NoteKeyLatest("a", 0, 5, false)
+	from := TopicOffsetRanges{}
+	from.NoteKeyPartition("a", 1)
+	from.NoteKeyPartition("b", 2)
+	from.NoteKeyLatest("a", 1, 9, false)
+	from.NoteKeyLatest("b", 2, 3, true)
+	mergeKeyPartitions(&into, &from)
+
+	if !reflect.DeepEqual(into.KeyPartitions["a"], []int32{0, 1}) {
+		t.Errorf("a on %v", into.KeyPartitions["a"])
+	}
+	// Latest versions on different partitions can't be ordered: the first wins
+	if kv := into.KeyLatest["a"]; kv.Partition != 0 || kv.Offset != 5 {
+		t.Errorf("a latest %+v", kv)
+	}
+	if kv := into.KeyLatest["b"]; kv.Partition != 2 || !kv.Tombstone {
+		t.Errorf("b latest %+v", kv)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// With --offset_tracking=bitmap, valid offsets are kept in a roaring-style
+// compressed bitmap per produce epoch rather than as a list of ranges.  A
+// range list is tiny while produce is healthy, but grows without bound
+// when it is fragmented (e.g. by many failed produce bursts); a bitmap
+// costs at most a bit per offset however fragmented it gets, and exactly
+// the same lookups work against it.
+//
+// As in roaring, offsets are split into a high key and a low 16 bits, and
+// each key's low bits are held in a sorted array while there are few of
+// them, or a plain bitmap once there are many.
+
+const (
+	offsetTrackingRanges = "ranges"
+	offsetTrackingBitmap = "bitmap"
+)
+
+const (
+	containerBits = 1 << 16
+	// Past this many offsets, a bitmap is smaller than an array
+	maxArrayContainer = 4096
+)
+
+type bitmapContainer struct {
+	Array []uint16 `json:",omitempty"`
+	Bits  []uint64 `json:",omitempty"`
+}
+
+func (c *bitmapContainer) contains(low uint16) bool {
+	if c.Bits != nil {
+		return c.Bits[low/64]&(1<<(low%64)) != 0
+	}
+	i := sort.Search(len(c.Array), func(i int) bool { return c.Array[i] >= low })
+	return i < len(c.Array) && c.Array[i] == low
+}
+
+func (c *bitmapContainer) add(low uint16) {
+	if c.Bits != nil {
+		c.Bits[low/64] |= 1 << (low % 64)
+		return
+	}
+	i := sort.Search(len(c.Array), func(i int) bool { return c.Array[i] >= low })
+	if i < len(c.Array) && c.Array[i] == low {
+		return
+	}
+	if len(c.Array) >= maxArrayContainer {
+		c.toBits()
+		c.add(low)
+		return
+	}
+	c.Array = append(c.Array, 0)
+	copy(c.Array[i+1:], c.Array[i:])
+	c.Array[i] = low
+}
+
+func (c *bitmapContainer) toBits() {
+	c.Bits = make([]uint64, containerBits/64)
+	for _, low := range c.Array {
+		c.Bits[low/64] |= 1 << (low % 64)
+	}
+	c.Array = nil
+}
+
+// Call fn with each low value, in ascending order
+func (c *bitmapContainer) each(fn func(low uint16)) {
+	if c.Bits == nil {
+		for _, low := range c.Array {
+			fn(low)
+		}
+		return
+	}
+	for i, w := range c.Bits {
+		for w != 0 {
+			b := bits.TrailingZeros64(w)
+			fn(uint16(i*64 + b))
+			w &= w - 1
+		}
+	}
+}
+
+type OffsetBitmap struct {
+	// Sorted high keys (offset >> 16), and a container for each
+	Keys       []int64
+	Containers []bitmapContainer
+}
+
+func splitOffset(o int64) (int64, uint16) {
+	return o >> 16, uint16(o & (containerBits - 1))
+}
+
+func (b *OffsetBitmap) find(key int64) int {
+	return sort.Search(len(b.Keys), func(i int) bool { return b.Keys[i] >= key })
+}
+
+func (b *OffsetBitmap) Contains(o int64) bool {
+	key, low := splitOffset(o)
+	i := b.find(key)
+	return i < len(b.Keys) && b.Keys[i] == key && b.Containers[i].contains(low)
+}
+
+func (b *OffsetBitmap) Add(o int64) {
+	key, low := splitOffset(o)
+	i := b.find(key)
+	if i == len(b.Keys) || b.Keys[i] != key {
+		b.Keys = append(b.Keys, 0)
+		copy(b.Keys[i+1:], b.Keys[i:])
+		b.Keys[i] = key
+		b.Containers = append(b.Containers, bitmapContainer{})
+		copy(b.Containers[i+1:], b.Containers[i:])
+		b.Containers[i] = bitmapContainer{}
+	}
+	b.Containers[i].add(low)
+}
+
+// Call fn with each offset, in ascending order
+func (b *OffsetBitmap) Each(fn func(o int64)) {
+	for i := range b.Containers {
+		base := b.Keys[i] << 16
+		b.Containers[i].each(func(low uint16) {
+			fn(base + int64(low))
+		})
+	}
+}
+
+// The offsets as ranges, e.g. for reporting
+func (b *OffsetBitmap) Runs(epoch int64) []OffsetRange {
+	var runs []OffsetRange
+	b.Each(func(o int64) {
+		if n := len(runs); n > 0 && runs[n-1].Upper == o {
+			runs[n-1].Upper += 1
+		} else {
+			runs = append(runs, OffsetRange{Lower: o, Upper: o + 1, Epoch: epoch})
+		}
+	})
+	return runs
+}
+
+// Forget offsets below o
+func (b *OffsetBitmap) RemoveBelow(o int64) {
+	var kept OffsetBitmap
+	b.Each(func(x int64) {
+		if x >= o {
+			kept.Add(x)
+		}
+	})
+	*b = kept
+}
+
+// Add another bitmap's offsets to this one, returning how many were in both
+func (b *OffsetBitmap) Or(other *OffsetBitmap) int64 {
+	overlap := int64(0)
+	other.Each(func(o int64) {
+		if b.Contains(o) {
+			overlap += 1
+		} else {
+			b.Add(o)
+		}
+	})
+	return overlap
+}
+
+// Offsets produced in one epoch
+type EpochBitmap struct {
+	Epoch   int64
+	Offsets OffsetBitmap
+}
+
+func (ors *OffsetRanges) epochBitmap(epoch int64) *OffsetBitmap {
+	for i := range ors.Bitmaps {
+		if ors.Bitmaps[i].Epoch == epoch {
+			return &ors.Bitmaps[i].Offsets
+		}
+	}
+	ors.Bitmaps = append(ors.Bitmaps, EpochBitmap{Epoch: epoch})
+	return &ors.Bitmaps[len(ors.Bitmaps)-1].Offsets
+}
+
+// The offsets tracked in bitmaps, as ranges
+func (ors *OffsetRanges) bitmapRuns() []OffsetRange {
+	var runs []OffsetRange
+	for i := range ors.Bitmaps {
+		runs = append(runs, ors.Bitmaps[i].Offsets.Runs(ors.Bitmaps[i].Epoch)...)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Lower < runs[j].Lower })
+	return runs
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOffsetBitmap(t *testing.T) {
+	var b OffsetBitmap
+	// Enough offsets in one container to convert it from an array to bits,
+	// a few in a sparse container, and one far beyond
+	dense := int64(maxArrayContainer + 100)
+	for o := int64(0); o < dense; o++ {
+		b.Add(o * 2)
+	}
+	b.Add(containerBits*3 + 5)
+	b.Add(containerBits*3 + 6)
+	b.Add(containerBits*3 + 5)
+	b.Add(1 << 40)
+
+	if b.Containers[0].Bits == nil {
+		t.Errorf("dense container still an array")
+	}
+	if b.Containers[1].Bits != nil || len(b.Containers[1].Array) != 2 {
+		t.Errorf("sparse container %+v", b.Containers[1])
+	}
+	for _, c := range []struct {
+		o    int64
+		want bool
+	}{
+		{0, true}, {1, false}, {2, true}, {dense*2 - 2, true}, {dense * 2, false},
+		{containerBits*3 + 5, true}, {containerBits*3 + 7, false},
+		{1 << 40, true}, {1<<40 + 1, false}, {containerBits * 2, false},
+	} {
+		if got := b.Contains(c.o); got != c.want {
+			t.Errorf("Contains(%d) = %v, want %v", c.o, got, c.want)
+		}
+	}
+
+	var prev int64 = -1
+	n := 0
+	b.Each(func(o int64) {
+		if o <= prev {
+			t.Fatalf("Each out of order: %d after %d", o, prev)
+		}
+		prev = o
+		n += 1
+	})
+	if n != int(dense)+3 {
+		t.Errorf("Each visited %d offsets, want %d", n, dense+3)
+	}
+
+	b.RemoveBelow(containerBits*3 + 6)
+	runs := b.Runs(7)
+	want := []OffsetRange{{Lower: containerBits*3 + 6, Upper: containerBits*3 + 7, Epoch: 7}, {Lower: 1 << 40, Upper: 1<<40 + 1, Epoch: 7}}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("Runs after RemoveBelow = %v, want %v", runs, want)
+	}
+}
+
+func TestOffsetBitmapOr(t *testing.T) {
+	var a, b OffsetBitmap
+	for o := int64(0); o < 10; o++ {
+		a.Add(o)
+		b.Add(o + 5)
+	}
+	if overlap := a.Or(&b); overlap != 5 {
+		t.Errorf("overlap %d, want 5", overlap)
+	}
+	if runs := a.Runs(0); !reflect.DeepEqual(runs, []OffsetRange{{Lower: 0, Upper: 15}}) {
+		t.Errorf("Runs after Or = %v", runs)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Within one consumer session, each partition's records must arrive in
+// strictly increasing offset order, within a fetch and across fetches.
+// Completion tracking only keeps the highest offset read, so without a
+// check of its own a repeated or backwards offset would pass unnoticed
+// unless its content happened to be wrong.
+
+// A record that arrived at or below an offset already read in the same
+// session
+type OffsetRegression struct {
+	Partition int32
+	Offset    int64
+	Previous  int64
+	Broker    int32
+}
+
+// Check r comes after the last offset read on its partition, where
+// `last` holds -1 for partitions not yet read, and note it as the last
+func checkOffsetOrder(r *kgo.Record, last []int64) {
+	p := r.Partition
+	prev := last[p]
+	last[p] = r.Offset
+	if prev < 0 || r.Offset > prev {
+		return
+	}
+	regression := OffsetRegression{Partition: p, Offset: r.Offset, Previous: prev, Broker: fetchSource(p)}
+	results.AddOffsetRegression(regression)
+	if *validationPolicy == validationAbort {
+		results.Emit()
+		Die("Read offset %d on %s/%d after offset %d: records out of order (broker %d)", r.Offset, *topic, p, prev, regression.Broker)
+	}
+	log.Errorf("Read offset %d on %s/%d after offset %d: records out of order (broker %d)", r.Offset, *topic, p, prev, regression.Broker)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Negative testing: with --oversize_rate, some records are produced with
+// values larger than the topic's max.message.bytes, and the broker must
+// reject them without disturbing anything around them.  They are sent
+// from a separate client, each in a batch of its own, so that a rejection
+// cannot take ordinary records down with it.  The main producer's offset
+// expectations then check that rejected records took no offsets.
+
+// Default max.message.bytes, if the topic will not tell us
+const defaultMaxMessageBytes = 1048588
+
+type OversizeStats struct {
+	Attempts int64
+	Rejected int64
+	// Rejections by error, plus errors that were not a rejection
+	Errors map[string]int64
+}
+
+type OversizeProducer struct {
+	client *kgo.Client
+	size   int
+}
+
+func NewOversizeProducer() *OversizeProducer {
+	client := newProduceClient(nil)
+	maxBytes := defaultMaxMessageBytes
+	value, _, err := describeTopicConfig(client, "max.message.bytes")
+	closeClient(client)
+	Chk(err, "%v", err)
+	if value != nil {
+		maxBytes, err = strconv.Atoi(*value)
+		Chk(err, "Bad max.message.bytes '%s': %v", *value, err)
+	}
+
+	size := maxBytes + 1024
+	log.Infof("Producing oversized records of %d bytes (max.message.bytes=%d)", size, maxBytes)
+
+	// The client must be willing to send the record, for the broker to
+	// have the chance to reject it
+	opts := []kgo.Opt{
+		kgo.DefaultProduceTopic(*topic),
+		kgo.ProducerBatchMaxBytes(int32(size + 64*1024)),
+		kgo.ProducerBatchCompression(kgo.NoCompression()),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+		kgo.RecordRetries(1),
+	}
+	return &OversizeProducer{
+		client: newProduceClient(opts),
+		size:   size,
+	}
+}
+
+func (op *OversizeProducer) Close() {
+	closeClient(op.client)
+}
+
+// Produce one oversized record, and check it is rejected
+func (op *OversizeProducer) Produce(p int32) {
+	r := kgo.KeySliceRecord([]byte(fmt.Sprintf("oversize.%d", op.size)), make([]byte, op.size))
+	r.Partition = p
+	err := op.client.ProduceSync(runCtx, r).FirstErr()
+
+	if err == nil {
+		results.AddOversize(r.Partition, nil, false)
+		results.Emit()
+		Die("Oversized record of %d bytes accepted at offset %d on %s/%d", op.size, r.Offset, *topic, r.Partition)
+	}
+
+	rejected := errors.Is(err, kerr.MessageTooLarge) || errors.Is(err, kerr.RecordListTooLarge)
+	if rejected {
+		log.Debugf("Oversized record on %s/%d rejected: %v", *topic, p, err)
+	} else {
+		log.Warnf("Oversized record on %s/%d failed with unexpected error: %v", *topic, p, err)
+	}
+	results.AddOversize(p, err, rejected)
+}
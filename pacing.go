@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Produce rate control.  By default we produce as fast as the cluster will
+// take it; --produce_rate sets a fixed rate, and --ramp or --ramp_schedule
+// change the rate as the run goes on, e.g. to find the rate at which
+// tiered storage uploads start falling behind.
+//
+// --arrival_pattern shapes traffic within that rate: steady spaces records
+// evenly, poisson spaces them randomly as independent arrivals would be, and
+// burst sends --burst_size records at a time with --burst_idle gaps between,
+// so that segments go idle and roll, uploads batch up, and timestamps have
+// gaps in them, as with real traffic.
+
+const (
+	arrivalSteady  = "steady"
+	arrivalPoisson = "poisson"
+	arrivalBurst   = "burst"
+)
+
+// A rate to hold for a while: the last step of a schedule holds forever
+type RateStep struct {
+	Rate     float64
+	Duration time.Duration
+}
+
+// Parse --ramp: "start,step,interval[,max]" starts at `start` records/s,
+// adding `step` every `interval`, until `max` if given.
+func parseRamp(spec string) ([]RateStep, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) < 3 || len(parts) > 4 {
+		return nil, errors.New("--ramp must be start,step,interval[,max]")
+	}
+	start, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad --ramp start '%s'", parts[0])
+	}
+	step, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad --ramp step '%s'", parts[1])
+	}
+	interval, err := time.ParseDuration(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad --ramp interval '%s'", parts[2])
+	}
+	max := 0.0
+	if len(parts) == 4 {
+		max, err = strconv.ParseFloat(parts[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad --ramp max '%s'", parts[3])
+		}
+	}
+	if start <= 0 || step <= 0 || interval <= 0 {
+		return nil, errors.New("--ramp start, step and interval must be positive")
+	}
+	if len(parts) == 4 && max <= 0 {
+		// The last step holds forever, so would never produce again
+		return nil, errors.New("--ramp max must be positive")
+	}
+
+	var steps []RateStep
+	for rate := start; max == 0 || rate < max; rate += step {
+		steps = append(steps, RateStep{Rate: rate, Duration: interval})
+		if max == 0 && len(steps) >= 10000 {
+			// Nobody will run long enough to care
+			break
+		}
+	}
+	if max > 0 {
+		steps = append(steps, RateStep{Rate: max})
+	}
+	return steps, nil
+}
+
+// Parse a --ramp_schedule file: one "<duration> <rate>" step per line,
+// with blank lines and #comments ignored
+func parseRampSchedule(path string) ([]RateStep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ramp schedule %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var steps []RateStep
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if len(line) == 0 {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad line in ramp schedule %s: '%s'", path, line)
+		}
+		d, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad duration in ramp schedule %s: '%s'", path, fields[0])
+		}
+		rate, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad rate in ramp schedule %s: '%s'", path, fields[1])
+		}
+		if rate < 0 {
+			return nil, fmt.Errorf("negative rate in ramp schedule %s: '%s'", path, fields[1])
+		}
+		steps = append(steps, RateStep{Rate: rate, Duration: d})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading ramp schedule %s: %w", path, err)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty ramp schedule %s", path)
+	}
+	if steps[len(steps)-1].Rate == 0 {
+		return nil, fmt.Errorf("ramp schedule %s ends with a zero rate, which would never produce again", path)
+	}
+	return steps, nil
+}
+
+type Pacer struct {
+	start time.Time
+	steps []RateStep
+	step  int
+	next  time.Time
+
+	rng *rand.Rand
+
+	// Records sent in the current burst
+	burst int
+}
+
+// A pacer per the produce rate flags, or nil to produce flat out
+func NewPacer() (*Pacer, error) {
+	var steps []RateStep
+	var err error
+	if len(*rampSchedule) > 0 {
+		steps, err = parseRampSchedule(*rampSchedule)
+	} else if len(*ramp) > 0 {
+		steps, err = parseRamp(*ramp)
+	} else if *produceRate > 0 {
+		steps = []RateStep{{Rate: *produceRate}}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(steps) == 0 && *arrivalPattern == arrivalSteady {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if len(steps) > 0 {
+		log.Infof("Producing at %.1f records/s (%s arrivals)", steps[0].Rate, *arrivalPattern)
+	} else {
+		log.Infof("Producing flat out in bursts of %d, %v apart", *burstSize, *burstIdle)
+	}
+	return &Pacer{start: now, steps: steps, next: now, rng: newRand("arrival")}, nil
+}
+
+// The rate now, moving on to later steps as their time comes
+func (pc *Pacer) rate(now time.Time) float64 {
+	elapsed := time.Duration(0)
+	for i := 0; i < len(pc.steps)-1; i++ {
+		elapsed += pc.steps[i].Duration
+		if now.Sub(pc.start) < elapsed {
+			pc.setStep(i)
+			return pc.steps[i].Rate
+		}
+	}
+	pc.setStep(len(pc.steps) - 1)
+	return pc.steps[len(pc.steps)-1].Rate
+}
+
+func (pc *Pacer) setStep(i int) {
+	if i != pc.step {
+		log.Infof("Produce rate now %.1f records/s", pc.steps[i].Rate)
+		pc.step = i
+	}
+}
+
+// Move the schedule on by time spent paused, so that no step is cut short
+func (pc *Pacer) Shift(d time.Duration) {
+	if pc == nil {
+		return
+	}
+	pc.start = pc.start.Add(d)
+	pc.next = pc.next.Add(d)
+}
+
+// Sleep until the next send time, returning the time it is now
+func (pc *Pacer) sleep() time.Time {
+	now := time.Now()
+	if pc.next.After(now) {
+		time.Sleep(pc.next.Sub(now))
+		now = pc.next
+	} else if now.Sub(pc.next) > time.Second {
+		// Don't try to catch up on time lost to a stall in one burst
+		pc.next = now
+	}
+	return now
+}
+
+// Block until it is time to send the next record
+func (pc *Pacer) Wait() {
+	if pc == nil {
+		return
+	}
+	now := pc.sleep()
+
+	if *arrivalPattern == arrivalBurst {
+		pc.burst += 1
+		if pc.burst >= *burstSize {
+			pc.burst = 0
+			pc.next = now.Add(*burstIdle)
+			return
+		}
+	}
+
+	if len(pc.steps) == 0 {
+		// Bursts without a rate limit
+		return
+	}
+	rate := pc.rate(now)
+	for rate <= 0 {
+		// A zero-rate step pauses until the next one
+		pc.next = now.Add(100 * time.Millisecond)
+		now = pc.sleep()
+		rate = pc.rate(now)
+	}
+	gap := float64(time.Second) / rate
+	if *arrivalPattern == arrivalPoisson {
+		gap *= pc.rng.ExpFloat64()
+	}
+	pc.next = pc.next.Add(time.Duration(gap))
+}
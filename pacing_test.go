@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRamp(t *testing.T) {
+	cases := []struct {
+		spec  string
+		steps []RateStep
+		ok    bool
+	}{
+		{"10,5,1m,25", []RateStep{{10, time.Minute}, {15, time.Minute}, {20, time.Minute}, {Rate: 25}}, true},
+		{"100,50,30s,100", []RateStep{{Rate: 100}}, true},
+		{"1.5,1,1s,3", []RateStep{{1.5, time.Second}, {2.5, time.Second}, {Rate: 3}}, true},
+		{"10,5", nil, false},
+		{"10,5,1m,25,30", nil, false},
+		{"x,5,1m", nil, false},
+		{"10,x,1m", nil, false},
+		{"10,5,x", nil, false},
+		{"10,5,1m,x", nil, false},
+		{"0,5,1m", nil, false},
+		{"10,0,1m", nil, false},
+		{"10,5,0s", nil, false},
+		{"10,5,1m,0", nil, false},
+		{"10,5,1m,-1", nil, false},
+	}
+	for _, c := range cases {
+		steps, err := parseRamp(c.spec)
+		if (err == nil) != c.ok {
+			t.Errorf("parseRamp(%q) error %v, want ok=%v", c.spec, err, c.ok)
+			continue
+		}
+		if c.ok && !reflect.DeepEqual(steps, c.steps) {
+			t.Errorf("parseRamp(%q) = %v, want %v", c.spec, steps, c.steps)
+		}
+	}
+
+	// Without a max, the ramp is bounded but never ends on a zero rate
+	steps, err := parseRamp("1,1,1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(steps); n != 10000 || steps[n-1].Rate <= 0 {
+		t.Errorf("unbounded ramp has %d steps, last %v", n, steps[n-1])
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"golang.org/x/sync/semaphore"
+)
+
+// Each partition is produced to from its own goroutine, with its own limit
+// on records in flight, so that a slow partition holds up only itself.
+// Acks are applied to our state in the order their records were sent,
+// whatever order the client runs callbacks in, so that ranges and payload
+// kinds are always recorded in offset order.
+
+// A record on its way to a partition producer
+type pendingRecord struct {
+	r      *kgo.Record
+	expect int64
+	kind   payloadKind
+	// With --checksums or --partition_digest, the record's content checksum
+	sum uint32
+	// When we handed the record to the client
+	sent time.Time
+}
+
+// Runs ack handlers in send order: an ack that arrives early waits for
+// those before it
+type ackTracker struct {
+	lock    sync.Mutex
+	next    uint64
+	pending map[uint64]func()
+}
+
+func (at *ackTracker) Done(seq uint64, apply func()) {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+	at.pending[seq] = apply
+	for {
+		f, ok := at.pending[at.next]
+		if !ok {
+			return
+		}
+		delete(at.pending, at.next)
+		at.next += 1
+		f()
+	}
+}
+
+type partitionProducer struct {
+	records  chan pendingRecord
+	inflight *semaphore.Weighted
+	acks     ackTracker
+	seq      uint64
+}
+
+// Start producing whatever is queued on the returned producer's records
+// channel until it is closed.  `handle` is called for each ack, in send
+// order; wg is done once the producer has handed over its last record.
+func startPartitionProducer(client *kgo.Client, handle func(pr pendingRecord, r *kgo.Record, err error), wg *sync.WaitGroup) *partitionProducer {
+	pp := &partitionProducer{
+		records:  make(chan pendingRecord, 256),
+		inflight: semaphore.NewWeighted(int64(*produceInflight)),
+		acks:     ackTracker{pending: make(map[uint64]func())},
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for pr := range pp.records {
+			pr := pr
+			seq := pp.seq
+			pp.seq += 1
+			if err := pp.inflight.Acquire(runCtx, 1); err != nil {
+				// Shutting down: fail the record without producing it, as
+				// we hold no slot for its callback to release
+				pr.sent = time.Now()
+				releasePayload(pr.r.Value)
+				pp.acks.Done(seq, func() {
+					handle(pr, pr.r, err)
+				})
+				continue
+			}
+			sent := time.Now()
+			pr.sent = sent
+			atomic.AddInt64(&inflightRecords, 1)
+			client.Produce(runCtx, pr.r, func(r *kgo.Record, err error) {
+				atomic.AddInt64(&inflightRecords, -1)
+				pp.inflight.Release(1)
+				releasePayload(r.Value)
+				if err == nil {
+					produceLatency.Observe(time.Since(sent))
+				}
+				pp.acks.Done(seq, func() {
+					handle(pr, r, err)
+				})
+			})
+		}
+	}()
+	return pp
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// The partition count of a topic can grow while we run.  With
+// --partition_refresh, the producer looks for new partitions periodically,
+// and on finding them restarts with a fresh client and state sized for the
+// new count, so that it produces to (and we later validate) the new
+// partitions too.  State files already grow on load to fit the topic.
+
+// The topic's current partition count, which must not be less than it was
+func refreshPartitionCount(client *kgo.Client, nPartitions int32) (int32, error) {
+	t, _, err := getTopicMetadata(client)
+	if err != nil {
+		return nPartitions, err
+	}
+	n := int32(len(t.Partitions))
+	if n < nPartitions {
+		return nPartitions, fmt.Errorf("topic %s shrank from %d to %d partitions", *topic, nPartitions, n)
+	} else if n > nPartitions {
+		log.Infof("Topic %s grew from %d to %d partitions", *topic, nPartitions, n)
+	}
+	return n, nil
+}
+
+// Extend per-partition counters for new partitions
+func growInt64s(s []int64, nPartitions int32, fill []int64) []int64 {
+	for p := int32(len(s)); p < nPartitions; p++ {
+		v := int64(0)
+		if fill != nil {
+			v = fill[p]
+		}
+		s = append(s, v)
+	}
+	return s
+}
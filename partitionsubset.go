@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// --partitions restricts producing and validation to some of the topic's
+// partitions, e.g. to shard a huge topic across several verifier jobs by
+// hand, or to reproduce an issue seen on one partition without waiting on
+// the rest.  It is given as a list of partitions and inclusive ranges, like
+// "0,3,7-12".
+
+// An inclusive range of partitions, as given in --partitions
+type partitionRange struct {
+	first, last int32
+}
+
+// Parse --partitions, without expanding its ranges
+func parsePartitionRanges(spec string) ([]partitionRange, error) {
+	var ranges []partitionRange
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			// e.g. a trailing comma
+			continue
+		}
+		lo, hi := item, item
+		if i := strings.Index(item, "-"); i >= 0 {
+			lo, hi = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+		first, err := strconv.ParseInt(lo, 10, 32)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("bad partition '%s' in '%s'", item, spec)
+		}
+		last, err := strconv.ParseInt(hi, 10, 32)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("bad partition range '%s' in '%s'", item, spec)
+		}
+		ranges = append(ranges, partitionRange{int32(first), int32(last)})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no partitions in '%s'", spec)
+	}
+	return ranges, nil
+}
+
+// The sorted, distinct partitions in --partitions, all of which must be
+// below nPartitions.  Ranges are checked before they are expanded, so a
+// typo like 0-2000000000 fails rather than filling memory.
+func parsePartitionList(spec string, nPartitions int32) ([]int32, error) {
+	ranges, err := parsePartitionRanges(spec)
+	if err != nil {
+		return nil, err
+	}
+	seen := make([]bool, nPartitions)
+	for _, r := range ranges {
+		if r.last >= nPartitions {
+			return nil, fmt.Errorf("partition %d is out of range: topic %s has only %d partitions", r.last, *topic, nPartitions)
+		}
+		for p := r.first; p <= r.last; p++ {
+			seen[p] = true
+		}
+	}
+
+	var partitions []int32
+	for p, ok := range seen {
+		if ok {
+			partitions = append(partitions, int32(p))
+		}
+	}
+	return partitions, nil
+}
+
+// Take ownership of the --partitions subset, once we know how many
+// partitions the topic has
+func applyPartitionSubset(nPartitions int32) {
+	if len(*partitionSubset) == 0 {
+		return
+	}
+	partitions, err := parsePartitionList(*partitionSubset, nPartitions)
+	Chk(err, "Bad --partitions: %v", err)
+	ownedPartitions = partitions
+	log.Infof("Working on %d of %d partitions: %v", len(partitions), nPartitions, partitions)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePartitionList(t *testing.T) {
+	cases := []struct {
+		spec       string
+		partitions []int32
+		ok         bool
+	}{
+		{"0", []int32{0}, true},
+		{"0,3,7-9", []int32{0, 3, 7, 8, 9}, true},
+		{"5-5", []int32{5}, true},
+		{"3,1,2,3,1-2", []int32{1, 2, 3}, true},
+		{" 1 , 4 - 6 ", []int32{1, 4, 5, 6}, true},
+		{"2,4,", []int32{2, 4}, true},
+		{"15", []int32{15}, true},
+		{"9-7", nil, false},
+		{"16", nil, false},
+		{"0-2000000000", nil, false},
+		{"-1", nil, false},
+		{"a", nil, false},
+		{"1-", nil, false},
+		{"1-2-3", nil, false},
+		{"", nil, false},
+		{",", nil, false},
+	}
+	for _, c := range cases {
+		partitions, err := parsePartitionList(c.spec, 16)
+		if (err == nil) != c.ok {
+			t.Errorf("parsePartitionList(%q) error %v, want ok=%v", c.spec, err, c.ok)
+			continue
+		}
+		if c.ok && !reflect.DeepEqual(partitions, c.partitions) {
+			t.Errorf("parsePartitionList(%q) = %v, want %v", c.spec, partitions, c.partitions)
+		}
+	}
+
+	// Without the partition count, only the syntax is checked
+	if _, err := parsePartitionRanges("0-2000000000"); err != nil {
+		t.Errorf("parsePartitionRanges: %v", err)
+	}
+}
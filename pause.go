@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// SIGUSR1 pauses production and SIGUSR2 resumes it, so that a test
+// orchestrator can make quiescent windows mid-run, e.g. to let segments
+// roll and upload, or to take snapshots.  On pausing, the producer flushes
+// and stores its state, so nothing is in flight while paused.
+
+type Pauser struct {
+	lock   sync.Mutex
+	paused bool
+	resume chan struct{}
+}
+
+var producePause = &Pauser{}
+
+func (pa *Pauser) Pause() {
+	pa.lock.Lock()
+	defer pa.lock.Unlock()
+	if !pa.paused {
+		pa.paused = true
+		pa.resume = make(chan struct{})
+	}
+}
+
+func (pa *Pauser) Resume() {
+	pa.lock.Lock()
+	defer pa.lock.Unlock()
+	if pa.paused {
+		pa.paused = false
+		close(pa.resume)
+	}
+}
+
+func (pa *Pauser) Paused() bool {
+	pa.lock.Lock()
+	defer pa.lock.Unlock()
+	return pa.paused
+}
+
+// Block until resumed, returning how long we were paused for
+func (pa *Pauser) Wait() time.Duration {
+	pa.lock.Lock()
+	resume := pa.resume
+	paused := pa.paused
+	pa.lock.Unlock()
+	if !paused {
+		return 0
+	}
+
+	start := time.Now()
+	<-resume
+	return time.Since(start)
+}
@@ -0,0 +1,7 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+// No SIGUSR1 or SIGUSR2 here, so production can't be paused
+func handlePauseSignals() {}
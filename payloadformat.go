@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// By default, payloads are opaque bytes, and what a record means is in its
+// key.  With --payload_format, each payload is instead a structured
+// document saying where the record should be and what it holds, checked
+// on read, for reproducing issues that only show with structured payloads.
+// Readers must use the same format as the run that produced.
+//
+// The protobuf format is this message, which is simple enough that we
+// encode it by hand:
+//
+//	message Payload {
+//	  string run_id = 1;
+//	  int32 partition = 2;      // -1 in --keyed mode
+//	  int64 sequence = 3;       // expected offset, -1 in --keyed mode
+//	  fixed32 checksum = 4;     // CRC32C of the message without this field
+//	  int64 timestamp_ms = 5;   // when we built the record
+//	  bytes padding = 6;        // up to --msg_size
+//	}
+//
+// The json format carries the same fields, with the checksum in hex, the
+// time in RFC3339 and the padding as dots, so that records can be read
+// with rpk or kcat while debugging an incident:
+//
+//	{"run_id":"42","partition":3,"sequence":1000,"checksum":"1a2b3c4d",
+//	 "produce_time":"2021-12-17T12:33:19.123Z","padding":"......"}
+
+const (
+	payloadFormatRaw      = "raw"
+	payloadFormatProtobuf = "protobuf"
+	payloadFormatJSON     = "json"
+)
+
+const jsonPayloadTime = "2006-01-02T15:04:05.000Z07:00"
+
+type jsonPayload struct {
+	RunID       string `json:"run_id"`
+	Partition   int32  `json:"partition"`
+	Sequence    int64  `json:"sequence"`
+	Checksum    string `json:"checksum"`
+	ProduceTime string `json:"produce_time"`
+	Padding     string `json:"padding"`
+}
+
+type structuredPayload struct {
+	RunID       string
+	Partition   int32
+	Sequence    int64
+	Checksum    uint32
+	TimestampMs int64
+	Padding     []byte
+}
+
+// Replace a record's payload with a structured one, if --payload_format
+// asks for it.  The record's partition must already be set, unless the
+// partitioner will choose it.  A record whose timestamp we chose ourselves
+// must have it set first, as the payload is stamped with it.
+func applyPayloadFormat(r *kgo.Record, sequence int64) {
+	if *payloadFormat == payloadFormatRaw {
+		return
+	}
+	stamp := time.Now()
+	if !r.Timestamp.IsZero() {
+		stamp = r.Timestamp
+	}
+	sp := structuredPayload{
+		RunID:       thisRun().ID,
+		Partition:   r.Partition,
+		Sequence:    sequence,
+		TimestampMs: stamp.UnixMilli(),
+	}
+	if *keyed {
+		sp.Partition = -1
+		sp.Sequence = -1
+	}
+	if *payloadFormat == payloadFormatJSON {
+		r.Value = encodeJSONPayload(r.Value[:0], &sp, *mSize)
+	} else {
+		r.Value = encodeProtobufPayload(r.Value[:0], &sp, *mSize)
+	}
+}
+
+func decodePayload(b []byte) (structuredPayload, error) {
+	if *payloadFormat == payloadFormatJSON {
+		return decodeJSONPayload(b)
+	}
+	return decodeProtobufPayload(b)
+}
+
+func appendProtobufTag(b []byte, field int, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+// Everything but the checksum and padding, which are covered by it
+func appendProtobufFields(b []byte, sp *structuredPayload) []byte {
+	b = appendProtobufTag(b, 1, 2)
+	b = appendUvarint(b, uint64(len(sp.RunID)))
+	b = append(b, sp.RunID...)
+	// Negative int32s and int64s are sign extended to ten byte varints
+	b = appendProtobufTag(b, 2, 0)
+	b = appendUvarint(b, uint64(int64(sp.Partition)))
+	b = appendProtobufTag(b, 3, 0)
+	b = appendUvarint(b, uint64(sp.Sequence))
+	b = appendProtobufTag(b, 5, 0)
+	b = appendUvarint(b, uint64(sp.TimestampMs))
+	return b
+}
+
+// The checksum is the same whatever the format, so is always taken over
+// the protobuf encoding
+func payloadChecksum(sp *structuredPayload) uint32 {
+	sum := crc32.Checksum(appendProtobufFields(nil, sp), castagnoli)
+	return crc32.Update(sum, castagnoli, sp.Padding)
+}
+
+// Encode a payload into b, padded out to size if it fits
+func encodeProtobufPayload(b []byte, sp *structuredPayload, size int) []byte {
+	b = appendProtobufFields(b, sp)
+	// The padding field's own tag and length come out of the room left
+	const checksumLen = 5
+	if room := size - len(b) - checksumLen - 1; room > 1 {
+		n := room - uvarintLen(uint64(room))
+		for n+1+uvarintLen(uint64(n+1)) <= room {
+			n += 1
+		}
+		sp.Padding = make([]byte, n)
+	}
+	b = appendProtobufTag(b, 6, 2)
+	b = appendUvarint(b, uint64(len(sp.Padding)))
+	b = append(b, sp.Padding...)
+
+	sp.Checksum = payloadChecksum(sp)
+	b = appendProtobufTag(b, 4, 5)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], sp.Checksum)
+	return append(b, sum[:]...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n += 1
+	}
+	return n
+}
+
+func decodeProtobufPayload(b []byte) (structuredPayload, error) {
+	var sp structuredPayload
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return sp, errors.New("bad field tag")
+		}
+		b = b[n:]
+		field, wireType := int(tag>>3), int(tag&7)
+		switch wireType {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return sp, fmt.Errorf("bad varint in field %d", field)
+			}
+			b = b[n:]
+			switch field {
+			case 2:
+				sp.Partition = int32(v)
+			case 3:
+				sp.Sequence = int64(v)
+			case 5:
+				sp.TimestampMs = int64(v)
+			}
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return sp, fmt.Errorf("bad length in field %d", field)
+			}
+			v := b[n : n+int(l)]
+			b = b[n+int(l):]
+			switch field {
+			case 1:
+				sp.RunID = string(v)
+			case 6:
+				sp.Padding = v
+			}
+		case 5:
+			if len(b) < 4 {
+				return sp, fmt.Errorf("short fixed32 in field %d", field)
+			}
+			if field == 4 {
+				sp.Checksum = binary.LittleEndian.Uint32(b)
+			}
+			b = b[4:]
+		default:
+			return sp, fmt.Errorf("unexpected wire type %d in field %d", wireType, field)
+		}
+	}
+	return sp, nil
+}
+
+// Encode a payload into b as JSON, padded out to size if it fits
+func encodeJSONPayload(b []byte, sp *structuredPayload, size int) []byte {
+	jp := jsonPayload{
+		RunID:       sp.RunID,
+		Partition:   sp.Partition,
+		Sequence:    sp.Sequence,
+		Checksum:    "00000000",
+		ProduceTime: time.UnixMilli(sp.TimestampMs).UTC().Format(jsonPayloadTime),
+	}
+	// Dots need no escaping, so each one adds a byte to the document
+	unpadded, _ := json.Marshal(&jp)
+	if n := size - len(unpadded); n > 0 {
+		sp.Padding = bytes.Repeat([]byte{'.'}, n)
+	}
+	jp.Padding = string(sp.Padding)
+	sp.Checksum = payloadChecksum(sp)
+	jp.Checksum = fmt.Sprintf("%08x", sp.Checksum)
+	doc, _ := json.Marshal(&jp)
+	return append(b, doc...)
+}
+
+func decodeJSONPayload(b []byte) (structuredPayload, error) {
+	var jp jsonPayload
+	if err := json.Unmarshal(b, &jp); err != nil {
+		return structuredPayload{}, err
+	}
+	sum, err := strconv.ParseUint(jp.Checksum, 16, 32)
+	if err != nil {
+		return structuredPayload{}, fmt.Errorf("bad checksum '%s'", jp.Checksum)
+	}
+	t, err := time.Parse(jsonPayloadTime, jp.ProduceTime)
+	if err != nil {
+		return structuredPayload{}, fmt.Errorf("bad produce time '%s'", jp.ProduceTime)
+	}
+	return structuredPayload{
+		RunID:       jp.RunID,
+		Partition:   jp.Partition,
+		Sequence:    jp.Sequence,
+		Checksum:    uint32(sum),
+		TimestampMs: t.UnixMilli(),
+		Padding:     []byte(jp.Padding),
+	}, nil
+}
+
+// Check a normal record's structured payload says what it should: that
+// it was built for where we read it, and before the record was stamped
+func validatePayloadFormat(r *kgo.Record, ors *OffsetRanges) {
+	if *payloadFormat == payloadFormatRaw {
+		return
+	}
+	sp, err := decodePayload(r.Value)
+	if err != nil {
+		badRecord(r, ors, *payloadFormat+" payload", err.Error(),
+			"Bad read at offset %d on partition %s/%d: undecodable %s payload: %v", r.Offset, *topic, r.Partition, *payloadFormat, err)
+		return
+	}
+	if sum := payloadChecksum(&sp); sum != sp.Checksum {
+		badRecord(r, ors, fmt.Sprintf("payload checksum %08x", sp.Checksum), fmt.Sprintf("payload checksum %08x", sum),
+			"Bad read at offset %d on partition %s/%d: payload checksum %08x, payload says %08x", r.Offset, *topic, r.Partition, sum, sp.Checksum)
+		return
+	}
+	if sp.Partition >= 0 && sp.Partition != r.Partition {
+		badRecord(r, ors, fmt.Sprintf("partition %d", sp.Partition), fmt.Sprintf("partition %d", r.Partition),
+			"Bad read at offset %d on partition %s/%d: payload from run %s was for partition %d", r.Offset, *topic, r.Partition, sp.RunID, sp.Partition)
+	}
+	if _, offset, parsed := parseKey(r.Key); parsed && sp.Sequence >= 0 && sp.Sequence != offset {
+		badRecord(r, ors, fmt.Sprintf("sequence %d", offset), fmt.Sprintf("sequence %d", sp.Sequence),
+			"Bad read at offset %d on partition %s/%d: payload from run %s has sequence %d, key has %d", r.Offset, *topic, r.Partition, sp.RunID, sp.Sequence, offset)
+	}
+	if !logAppendTime && sp.TimestampMs > r.Timestamp.Add(*timestampSkew).UnixMilli() {
+		badRecord(r, ors, fmt.Sprintf("payload built before t=%d", r.Timestamp.UnixMilli()), fmt.Sprintf("payload built at t=%d", sp.TimestampMs),
+			"Bad read at offset %d on partition %s/%d: payload built at t=%d, after the record's timestamp t=%d", r.Offset, *topic, r.Partition, sp.TimestampMs, r.Timestamp.UnixMilli())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPayloadCodecs(t *testing.T) {
+	codecs := []struct {
+		name   string
+		encode func([]byte, *structuredPayload, int) []byte
+		decode func([]byte) (structuredPayload, error)
+	}{
+		{payloadFormatProtobuf, encodeProtobufPayload, decodeProtobufPayload},
+		{payloadFormatJSON, encodeJSONPayload, decodeJSONPayload},
+	}
+	payloads := []structuredPayload{
+		{RunID: "42", Partition: 3, Sequence: 1000, TimestampMs: 1639744399123},
+		// As in --keyed mode
+		{RunID: "run-b", Partition: -1, Sequence: -1, TimestampMs: 1},
+		{RunID: "", Partition: 0, Sequence: 1 << 40, TimestampMs: 1639744399000},
+	}
+	for _, c := range codecs {
+		for _, size := range []int{0, 16, 200, 1000} {
+			for _, p := range payloads {
+				sp := p
+				b := c.encode(nil, &sp, size)
+				if size >= 200 && len(b) != size {
+					t.Errorf("%s: encoded %d bytes, want %d", c.name, len(b), size)
+				}
+				got, err := c.decode(b)
+				if err != nil {
+					t.Fatalf("%s: decode %q: %v", c.name, b, err)
+				}
+				if len(got.Padding) == 0 {
+					got.Padding = nil
+				}
+				if len(sp.Padding) == 0 {
+					sp.Padding = nil
+				}
+				if !reflect.DeepEqual(got, sp) {
+					t.Errorf("%s: decoded %+v, encoded %+v", c.name, got, sp)
+				}
+				if sum := payloadChecksum(&got); sum != got.Checksum {
+					t.Errorf("%s: checksum %08x, payload says %08x", c.name, sum, got.Checksum)
+				}
+			}
+		}
+	}
+}
+
+// The same fields give the same checksum whichever format carried them
+func TestPayloadChecksumFormatIndependent(t *testing.T) {
+	a := structuredPayload{RunID: "r", Partition: 1, Sequence: 2, TimestampMs: 3}
+	b := a
+	encodeProtobufPayload(nil, &a, 0)
+	encodeJSONPayload(nil, &b, 0)
+	if a.Checksum != b.Checksum {
+		t.Errorf("protobuf checksum %08x, json %08x", a.Checksum, b.Checksum)
+	}
+}
+
+func TestDecodePayloadErrors(t *testing.T) {
+	sp := structuredPayload{RunID: "r", Partition: 1, Sequence: 2, TimestampMs: 3}
+	pb := encodeProtobufPayload(nil, &sp, 100)
+	for _, b := range [][]byte{
+		pb[:len(pb)-2],           // truncated checksum
+		{0x0a, 0x10, 'x'},        // length beyond the end
+		{0x0b},                   // unsupported wire type
+		{0x10, 0xff, 0xff, 0xff}, // unterminated varint
+	} {
+		if _, err := decodeProtobufPayload(b); err == nil {
+			t.Errorf("decoded %x without error", b)
+		}
+	}
+
+	var jp jsonPayload
+	for _, mutate := range []func(){
+		func() { jp.Checksum = "xyz" },
+		func() { jp.ProduceTime = "yesterday" },
+	} {
+		json.Unmarshal(encodeJSONPayload(nil, &sp, 0), &jp)
+		mutate()
+		b, _ := json.Marshal(&jp)
+		if _, err := decodeJSONPayload(b); err == nil {
+			t.Errorf("decoded %s without error", b)
+		}
+	}
+	if _, err := decodeJSONPayload([]byte("{")); err == nil {
+		t.Errorf("decoded truncated JSON without error")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Null values (tombstones) and empty values take different paths through
+// record encoding in brokers and tiered storage than ordinary payloads.
+// With --tombstone_rate and --empty_rate, some records are produced that
+// way, and their offsets kept in the state so that reads can check that a
+// null is still null, an empty value still empty, and nothing else has
+// turned into either.
+
+type payloadKind int
+
+const (
+	payloadNormal payloadKind = iota
+	payloadNull
+	payloadEmpty
+)
+
+// Maybe turn a record into a tombstone or empty record, per the rates
+func applyPayloadKind(rng *rand.Rand, r *kgo.Record) payloadKind {
+	if *tombstoneRate == 0 && *emptyRate == 0 {
+		return payloadNormal
+	}
+	x := rng.Float64()
+	if x < *tombstoneRate {
+		r.Value = nil
+		return payloadNull
+	} else if x < *tombstoneRate+*emptyRate {
+		r.Value = []byte{}
+		return payloadEmpty
+	}
+	return payloadNormal
+}
+
+func (ors *OffsetRanges) NotePayloadKind(o int64, kind payloadKind) {
+	// Acks arrive in offset order on each partition, so these stay sorted
+	switch kind {
+	case payloadNull:
+		ors.Tombstones = append(ors.Tombstones, o)
+	case payloadEmpty:
+		ors.EmptyValues = append(ors.EmptyValues, o)
+	}
+}
+
+func containsOffset(offsets []int64, o int64) bool {
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= o })
+	return i < len(offsets) && offsets[i] == o
+}
+
+// Drop offsets below o from a sorted offset list
+func trimOffsets(offsets []int64, o int64) []int64 {
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= o })
+	if i == len(offsets) {
+		return nil
+	}
+	return offsets[i:]
+}
+
+// Sorted union of two sorted offset lists
+func mergeOffsets(a []int64, b []int64) []int64 {
+	if len(b) == 0 {
+		return a
+	}
+	merged := make([]int64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if j == len(b) || (i < len(a) && a[i] < b[j]) {
+			merged = append(merged, a[i])
+			i += 1
+		} else if i == len(a) || b[j] < a[i] {
+			merged = append(merged, b[j])
+			j += 1
+		} else {
+			merged = append(merged, a[i])
+			i += 1
+			j += 1
+		}
+	}
+	return merged
+}
+
+// Check a record that we produced has the kind of value we produced it with
+func validatePayload(r *kgo.Record, ors *OffsetRanges) {
+	if containsOffset(ors.Tombstones, r.Offset) {
+		if r.Value != nil {
+			badRecord(r, ors, "null value", fmt.Sprintf("%d bytes", len(r.Value)),
+				"Bad read at offset %d on partition %s/%d: expected null value, found %d bytes", r.Offset, *topic, r.Partition, len(r.Value))
+		}
+	} else if containsOffset(ors.EmptyValues, r.Offset) {
+		if r.Value == nil || len(r.Value) != 0 {
+			badRecord(r, ors, "empty value", fmt.Sprintf("%d bytes (null: %v)", len(r.Value), r.Value == nil),
+				"Bad read at offset %d on partition %s/%d: expected empty value, found %d bytes (null: %v)", r.Offset, *topic, r.Partition, len(r.Value), r.Value == nil)
+		}
+	} else if r.Value == nil {
+		badRecord(r, ors, "non-null value", "null value", "Bad read at offset %d on partition %s/%d: unexpected null value", r.Offset, *topic, r.Partition)
+	} else {
+		validateValueSize(r, ors)
+		validatePayloadFormat(r, ors)
+	}
+	validateChecksum(r, ors)
+	validateLogAppendTime(r, ors)
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// With --pipeline_sink, we act as an exactly-once stream processor would:
+// consume --topic in a consumer group, and copy each record, transformed,
+// to the sink topic in a transaction that also commits the consumed
+// offsets.  Afterwards, a read_committed read of the sink must find
+// exactly one copy of every source record the pipeline consumed, however
+// many transactions were aborted and retried on the way.
+//
+// With --pipeline_abort_rate, some transactions are aborted on purpose
+// after producing their copies.  We know the sink offsets those copies
+// landed at, so we can check that read_committed skips every one of them,
+// and that read_uncommitted still returns them.
+
+type PipelineStats struct {
+	Transactions int64
+	Aborted      int64
+	Copied       int64
+	Duplicates   int64
+	Missing      int64
+	// Copies whose value doesn't start with the key of the record they
+	// are keyed as copying
+	Mismatched int64 `json:",omitempty"`
+
+	// Records in transactions we aborted on purpose, how many of them
+	// read_committed skipped, and how many read_uncommitted returned
+	AbortedRecords   int64
+	CommittedSkipped int64
+	UncommittedRead  int64
+}
+
+// Sink records are keyed by where their source record was
+func pipelineKey(p int32, o int64) string {
+	return fmt.Sprintf("src.%06d.%018d", p, o)
+}
+
+func parsePipelineKey(key []byte) (int32, int64, bool) {
+	s := string(key)
+	if len(s) != 29 || s[:4] != "src." || s[10] != '.' {
+		return 0, 0, false
+	}
+	p, err := strconv.ParseInt(s[4:10], 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	o, err := strconv.ParseInt(s[11:], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return int32(p), o, true
+}
+
+// The transform: the sink record's value is the source record's key
+// followed by its value, so that the copy can be traced back
+func pipelineRecord(r *kgo.Record, sinkPartitions int32) *kgo.Record {
+	value := make([]byte, 0, len(r.Key)+len(r.Value))
+	value = append(append(value, r.Key...), r.Value...)
+	sink := kgo.KeySliceRecord([]byte(pipelineKey(r.Partition, r.Offset)), value)
+	sink.Topic = *pipelineSink
+	sink.Partition = r.Partition % sinkPartitions
+	return sink
+}
+
+// The end offsets of a topic other than ours, and how many partitions it has
+func listEndOffsets(client *kgo.Client, t string, committed bool) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+	defer cancel()
+	adm := kadm.NewClient(client)
+	var listed kadm.ListedOffsets
+	var err error
+	if committed {
+		listed, err = adm.ListCommittedOffsets(ctx, t)
+	} else {
+		listed, err = adm.ListEndOffsets(ctx, t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, len(listed[t]))
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("topic %s not found", t)
+	}
+	for p, o := range listed[t] {
+		if o.Err != nil {
+			return nil, fmt.Errorf("error listing offsets of %s/%d: %w", t, p, o.Err)
+		}
+		offsets[p] = o.Offset
+	}
+	return offsets, nil
+}
+
+type pipeline struct {
+	sinkPartitions int32
+	stats          PipelineStats
+
+	// Source offsets the pipeline consumed, by source partition
+	consumed map[int32]*OffsetBitmap
+	// The offset of the last committed copy on each sink partition, -1 if none
+	sinkUpper []int64
+	// Sink offsets of copies in transactions we aborted on purpose, by
+	// sink partition
+	aborted map[int32]*OffsetBitmap
+	// Aborted copies that read_committed returned
+	abortedLeaked int64
+}
+
+func runPipeline(nPartitions int32) {
+	client := newClient(nil)
+	sinkStart, err := listEndOffsets(client, *pipelineSink, false)
+	Chk(err, "Error getting sink offsets: %v", err)
+	// Copy everything that is committed now
+	upTo, err := listEndOffsets(client, *topic, true)
+	Chk(err, "Error getting source offsets: %v", err)
+	closeClient(client)
+
+	pl := &pipeline{
+		sinkPartitions: int32(len(sinkStart)),
+		consumed:       make(map[int32]*OffsetBitmap),
+		sinkUpper:      make([]int64, len(sinkStart)),
+		aborted:        make(map[int32]*OffsetBitmap),
+	}
+	for p := range pl.sinkUpper {
+		pl.sinkUpper[p] = -1
+	}
+
+	pl.copy(nPartitions, upTo)
+	if runCtx.Err() != nil {
+		return
+	}
+	pl.verify(sinkStart)
+	pl.verifyAbortedVisible()
+
+	results.SetPipeline(pl.stats)
+	log.Infof("Pipeline copied %d records to %s in %d transactions (%d aborted)",
+		pl.stats.Copied, *pipelineSink, pl.stats.Transactions, pl.stats.Aborted)
+	if pl.stats.Duplicates > 0 || pl.stats.Missing > 0 || pl.stats.Mismatched > 0 {
+		results.Emit()
+		Die("Pipeline sink %s has %d duplicate, %d missing and %d mismatched records",
+			*pipelineSink, pl.stats.Duplicates, pl.stats.Missing, pl.stats.Mismatched)
+	}
+	if pl.stats.AbortedRecords > 0 {
+		log.Infof("Of %d aborted records in %s, read_committed skipped %d and read_uncommitted read %d",
+			pl.stats.AbortedRecords, *pipelineSink, pl.stats.CommittedSkipped, pl.stats.UncommittedRead)
+		if pl.stats.CommittedSkipped != pl.stats.AbortedRecords || pl.stats.UncommittedRead != pl.stats.AbortedRecords {
+			results.Emit()
+			Die("Aborted records in pipeline sink %s were not hidden from read_committed and visible to read_uncommitted", *pipelineSink)
+		}
+	}
+}
+
+// Copy the source to the sink in transactions, until the group has
+// committed past upTo on every partition
+func (pl *pipeline) copy(nPartitions int32, upTo []int64) {
+	opts, role := clusterClientOpts(&consumeCluster, []kgo.Opt{
+		// One transactional producer per group, so a restarted pipeline fences
+		// its predecessor
+		kgo.TransactionalID(*pipelineGroup),
+		kgo.ConsumerGroup(*pipelineGroup),
+		kgo.ConsumeTopics(*topic),
+		kgo.RequireStableFetchOffsets(),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	})
+	// Copying uncommitted records would copy aborted ones too
+	opts = append(opts, kgo.FetchIsolationLevel(kgo.ReadCommitted()))
+	session, err := kgo.NewGroupTransactSession(opts...)
+	Chk(err, "Error creating transactional client: %v", err)
+	trackClient(session.Client(), role)
+	defer closeClient(session.Client())
+
+	rng := newRand("pipeline")
+	position, err := fetchGroupCommitted(session.Client(), *pipelineGroup, nPartitions)
+	Chk(err, "Error fetching committed offsets of group %s: %v", *pipelineGroup, err)
+	done := func() bool {
+		for p := range upTo {
+			if position[p] < upTo[p] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for !done() {
+		ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+		fetches := session.PollFetches(ctx)
+		cancel()
+		if runCtx.Err() != nil {
+			return
+		}
+		fetches.EachError(func(t string, p int32, err error) {
+			log.Warnf("Pipeline fetch error on %s/%d: %v", t, p, err)
+		})
+		records := fetches.Records()
+		if len(records) == 0 {
+			continue
+		}
+
+		err := session.Begin()
+		Chk(err, "Error beginning transaction: %v", err)
+		var copies []*kgo.Record
+		for _, r := range records {
+			copies = append(copies, pipelineRecord(r, pl.sinkPartitions))
+		}
+		produced := session.ProduceSync(runCtx, copies...)
+		commit := kgo.TryCommit
+		deliberate := false
+		if err := produced.FirstErr(); err != nil {
+			log.Warnf("Pipeline produce failed, aborting: %v", err)
+			commit = kgo.TryAbort
+		} else if rng.Float64() < *pipelineAbortRate {
+			commit = kgo.TryAbort
+			deliberate = true
+		}
+
+		committed, err := session.End(runCtx, commit)
+		Chk(err, "Error ending transaction: %v", err)
+		pl.stats.Transactions += 1
+		for _, r := range records {
+			bm := pl.consumed[r.Partition]
+			if bm == nil {
+				bm = &OffsetBitmap{}
+				pl.consumed[r.Partition] = bm
+			}
+			bm.Add(r.Offset)
+		}
+		if !committed {
+			// The session rewinds to the last commit, so we will see
+			// these records again
+			log.Infof("Pipeline transaction of %d records aborted", len(records))
+			pl.stats.Aborted += 1
+			if deliberate {
+				pl.noteAborted(produced)
+			}
+			continue
+		}
+
+		pl.stats.Copied += int64(len(copies))
+		for _, r := range records {
+			if r.Offset+1 > position[r.Partition] {
+				position[r.Partition] = r.Offset + 1
+			}
+		}
+		for _, pr := range produced {
+			if pr.Record.Offset > pl.sinkUpper[pr.Record.Partition] {
+				pl.sinkUpper[pr.Record.Partition] = pr.Record.Offset
+			}
+		}
+	}
+}
+
+// Read back what the pipeline wrote to the sink, and check it holds one
+// copy of everything the pipeline consumed
+func (pl *pipeline) verify(sinkStart []int64) {
+	partOffsets := make(map[int32]kgo.Offset)
+	for p, upper := range pl.sinkUpper {
+		if upper >= 0 {
+			partOffsets[int32(p)] = kgo.NewOffset().At(sinkStart[p])
+		}
+	}
+	if len(partOffsets) == 0 {
+		log.Infof("Pipeline copied nothing to verify")
+		return
+	}
+	log.Infof("Verifying pipeline sink %s...", *pipelineSink)
+	seen := make(map[int32]*OffsetBitmap)
+	readSink(partOffsets, pl.sinkUpper, kgo.ReadCommitted(), func(r *kgo.Record) {
+		pl.verifyRecord(r, seen)
+	})
+	if runCtx.Err() != nil {
+		return
+	}
+
+	// Any aborted record read_committed returned was counted by verifyRecord
+	for p, aborted := range pl.aborted {
+		aborted.Each(func(o int64) {
+			if o >= sinkStart[p] && o <= pl.sinkUpper[p] {
+				pl.stats.CommittedSkipped += 1
+			}
+		})
+	}
+	pl.stats.CommittedSkipped -= pl.abortedLeaked
+
+	for p, consumed := range pl.consumed {
+		consumed.Each(func(o int64) {
+			if bm := seen[p]; bm == nil || !bm.Contains(o) {
+				log.Errorf("Pipeline sink has no copy of %s/%d at %d", *topic, p, o)
+				pl.stats.Missing += 1
+			}
+		})
+	}
+}
+
+// Read sink partitions from the given offsets until each has returned its
+// record at upper (or beyond), passing every record to fn
+func readSink(partOffsets map[int32]kgo.Offset, upper []int64, isolation kgo.IsolationLevel, fn func(r *kgo.Record)) {
+	client := newClient([]kgo.Opt{
+		kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{*pipelineSink: partOffsets}),
+		kgo.FetchIsolationLevel(isolation),
+	})
+	defer closeClient(client)
+
+	remaining := len(partOffsets)
+	complete := make([]bool, len(upper))
+	for remaining > 0 {
+		ctx, cancel := context.WithTimeout(runCtx, 30*time.Second)
+		fetches := client.PollFetches(ctx)
+		cancel()
+		if runCtx.Err() != nil {
+			return
+		}
+		if ctx.Err() != nil {
+			Die("No progress reading pipeline sink %s", *pipelineSink)
+		}
+		fetches.EachError(func(t string, p int32, err error) {
+			log.Warnf("Error reading pipeline sink %s/%d: %v", t, p, err)
+		})
+		fetches.EachRecord(func(r *kgo.Record) {
+			if complete[r.Partition] {
+				return
+			}
+			if r.Offset >= upper[r.Partition] {
+				complete[r.Partition] = true
+				remaining -= 1
+			}
+			fn(r)
+		})
+	}
+}
+
+// Remember where the copies in a transaction we aborted landed
+func (pl *pipeline) noteAborted(produced kgo.ProduceResults) {
+	for _, pr := range produced {
+		if pr.Err != nil {
+			continue
+		}
+		bm := pl.aborted[pr.Record.Partition]
+		if bm == nil {
+			bm = &OffsetBitmap{}
+			pl.aborted[pr.Record.Partition] = bm
+		}
+		bm.Add(pr.Record.Offset)
+		pl.stats.AbortedRecords += 1
+	}
+}
+
+// Read the offsets of aborted copies with read_uncommitted, which must
+// return every one of them
+func (pl *pipeline) verifyAbortedVisible() {
+	if len(pl.aborted) == 0 || runCtx.Err() != nil {
+		return
+	}
+	partOffsets := make(map[int32]kgo.Offset)
+	upper := make([]int64, pl.sinkPartitions)
+	for p, aborted := range pl.aborted {
+		first := int64(-1)
+		aborted.Each(func(o int64) {
+			if first < 0 {
+				first = o
+			}
+			upper[p] = o
+		})
+		partOffsets[p] = kgo.NewOffset().At(first)
+	}
+
+	log.Infof("Reading aborted records in pipeline sink %s with read_uncommitted...", *pipelineSink)
+	readSink(partOffsets, upper, kgo.ReadUncommitted(), func(r *kgo.Record) {
+		if !pl.aborted[r.Partition].Contains(r.Offset) {
+			return
+		}
+		if _, _, ok := parsePipelineKey(r.Key); !ok {
+			log.Errorf("Aborted record in pipeline sink %s/%d at %d has unknown key '%s'", *pipelineSink, r.Partition, r.Offset, r.Key)
+			return
+		}
+		pl.stats.UncommittedRead += 1
+	})
+}
+
+func (pl *pipeline) verifyRecord(r *kgo.Record, seen map[int32]*OffsetBitmap) {
+	if aborted := pl.aborted[r.Partition]; aborted != nil && aborted.Contains(r.Offset) {
+		log.Errorf("read_committed returned an aborted record in pipeline sink %s/%d at %d", *pipelineSink, r.Partition, r.Offset)
+		pl.abortedLeaked += 1
+		return
+	}
+	p, o, ok := parsePipelineKey(r.Key)
+	if !ok {
+		log.Warnf("Unknown key '%s' in pipeline sink %s/%d at %d", r.Key, *pipelineSink, r.Partition, r.Offset)
+		return
+	}
+	if consumed := pl.consumed[p]; consumed == nil || !consumed.Contains(o) {
+		log.Errorf("Pipeline sink %s/%d has a copy of %s/%d at %d at offset %d, which the pipeline never consumed",
+			*pipelineSink, r.Partition, *topic, p, o, r.Offset)
+		pl.stats.Duplicates += 1
+		return
+	}
+	bm := seen[p]
+	if bm == nil {
+		bm = &OffsetBitmap{}
+		seen[p] = bm
+	}
+	if bm.Contains(o) {
+		log.Errorf("Duplicate copy of %s/%d at %d in pipeline sink %s/%d at offset %d", *topic, p, o, *pipelineSink, r.Partition, r.Offset)
+		pl.stats.Duplicates += 1
+		return
+	}
+	bm.Add(o)
+
+	// The copy must still say which record it came from: its value starts
+	// with the source record's key, padding and all
+	if len(r.Value) < keyLen {
+		return
+	}
+	if epoch, keyOffset, parsed := parseKey(r.Value[:keyLen]); parsed && keyOffset != o {
+		log.Errorf("Pipeline sink %s/%d at %d copies %s/%d at %d, but holds key %s",
+			*pipelineSink, r.Partition, r.Offset, *topic, p, o, formatKey(epoch, keyOffset))
+		pl.stats.Mismatched += 1
+	}
+}
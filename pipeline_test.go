@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestPipelineVerifyRecord(t *testing.T) {
+	consumed := &OffsetBitmap{}
+	for o := int64(0); o < 4; o++ {
+		consumed.Add(o)
+	}
+	pl := &pipeline{sinkPartitions: 1, consumed: map[int32]*OffsetBitmap{2: consumed}}
+	seen := make(map[int32]*OffsetBitmap)
+
+	copyOf := func(o int64, keyOffset int64) *kgo.Record {
+		src := kgo.KeySliceRecord([]byte(formatKey(1, keyOffset)), []byte("payload"))
+		src.Partition, src.Offset = 2, o
+		return pipelineRecord(src, pl.sinkPartitions)
+	}
+	pl.verifyRecord(copyOf(0, 0), seen)
+	pl.verifyRecord(copyOf(1, 1), seen)
+	pl.verifyRecord(copyOf(1, 1), seen)
+	pl.verifyRecord(copyOf(2, 3), seen)
+	pl.verifyRecord(copyOf(9, 9), seen)
+
+	if pl.stats.Mismatched != 1 {
+		t.Errorf("%d mismatched, want 1", pl.stats.Mismatched)
+	}
+	if pl.stats.Duplicates != 2 {
+		t.Errorf("%d duplicates, want 2", pl.stats.Duplicates)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+	_ "net/http/pprof"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Serve net/http/pprof on --pprof_addr, so that CPU, heap and goroutine
+// profiles can be taken from long running soak tests.
+func startPprof(addr string) {
+	log.Infof("Serving pprof on http://%s/debug/pprof/", addr)
+	go func() {
+		err := http.ListenAndServe(addr, nil)
+		log.Errorf("pprof server on %s stopped: %v", addr, err)
+	}()
+}
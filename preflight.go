@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// The preflight subcommand checks, step by step, that a run has what it
+// needs, so that a misconfiguration shows up as a diagnosis rather than an
+// opaque client error part way through a run.
+
+// Requests the verifier relies on, and the minimum version of each
+var preflightAPIs = []struct {
+	key     int16
+	name    string
+	version int16
+}{
+	{0, "Produce", 3},
+	{1, "Fetch", 4},
+	{2, "ListOffsets", 1},
+	{3, "Metadata", 1},
+	{23, "OffsetForLeaderEpoch", 2},
+}
+
+type preflight struct {
+	failures int
+}
+
+func (pf *preflight) pass(check string, msg string, args ...interface{}) {
+	log.Infof("PASS %s: %s", check, fmt.Sprintf(msg, args...))
+}
+
+func (pf *preflight) fail(check string, msg string, args ...interface{}) {
+	log.Errorf("FAIL %s: %s", check, fmt.Sprintf(msg, args...))
+	pf.failures += 1
+}
+
+// Explain a request error in terms of what the user should check
+func diagnose(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, kerr.SaslAuthenticationFailed):
+		return fmt.Sprintf("%v: check the username and password", err)
+	case errors.Is(err, kerr.UnsupportedSaslMechanism):
+		return fmt.Sprintf("%v: the cluster does not accept SCRAM-SHA-256", err)
+	case errors.Is(err, kerr.TopicAuthorizationFailed), errors.Is(err, kerr.ClusterAuthorizationFailed):
+		return fmt.Sprintf("%v: check the user's ACLs", err)
+	case errors.Is(err, kerr.UnknownTopicOrPartition):
+		return fmt.Sprintf("%v: create the topic first", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Sprintf("%v: brokers unreachable, or TLS/plaintext mismatch", err)
+	case errors.As(err, &netErr):
+		return fmt.Sprintf("%v: check the broker addresses and network", err)
+	default:
+		return err.Error()
+	}
+}
+
+func (pf *preflight) checkCluster(name string, cluster *ClusterConfig, canProduce bool) {
+	log.Infof("Checking %s cluster %s...", name, cluster.Brokers)
+	client, err := newClusterClient(cluster, nil)
+	if err != nil {
+		pf.fail("client", "%s", diagnose(err))
+		return
+	}
+	defer closeClient(client)
+
+	// Connectivity (and auth, which happens on connect)
+	for _, addr := range strings.Split(cluster.Brokers, ",") {
+		dialCtx, cancel := context.WithTimeout(runCtx, 5*time.Second)
+		conn, err := dialBroker(dialCtx, addr)
+		cancel()
+		if err != nil {
+			pf.fail("connect", "%s: %s", addr, diagnose(err))
+			continue
+		}
+		conn.Close()
+		pf.pass("connect", "%s reachable", addr)
+	}
+
+	ctx, cancel := context.WithTimeout(runCtx, 15*time.Second)
+	defer cancel()
+	apiResp, err := kmsg.NewPtrApiVersionsRequest().RequestWith(ctx, client)
+	if err == nil {
+		err = kerr.ErrorForCode(apiResp.ErrorCode)
+	}
+	if err != nil {
+		pf.fail("handshake", "%s", diagnose(err))
+		return
+	}
+	if len(cluster.Username) > 0 {
+		pf.pass("auth", "authenticated as %s", cluster.Username)
+	} else {
+		pf.pass("auth", "connected without SASL")
+	}
+
+	// API versions
+	supported := make(map[int16]int16)
+	for _, k := range apiResp.ApiKeys {
+		supported[k.ApiKey] = k.MaxVersion
+	}
+	missing := 0
+	for _, api := range preflightAPIs {
+		if v, ok := supported[api.key]; !ok || v < api.version {
+			pf.fail("api", "%s v%d+ not supported (max %d)", api.name, api.version, v)
+			missing += 1
+		}
+	}
+	if missing == 0 {
+		pf.pass("api", "%d APIs supported", len(apiResp.ApiKeys))
+	}
+
+	// Topic existence and partition health
+	m, err := kadm.NewClient(client).Metadata(ctx, *topic)
+	if err != nil {
+		pf.fail("topic", "%s", diagnose(err))
+		return
+	}
+	t, ok := m.Topics[*topic]
+	if !ok || t.Err != nil {
+		err = kerr.UnknownTopicOrPartition
+		if ok {
+			err = t.Err
+		}
+		pf.fail("topic", "%s: %s", *topic, diagnose(err))
+		return
+	}
+	pf.pass("topic", "%s has %d partitions", *topic, len(t.Partitions))
+
+	leaderless := 0
+	underReplicated := 0
+	for _, p := range t.Partitions.Sorted() {
+		if p.Err != nil || p.Leader < 0 {
+			log.Errorf("  %s/%d leader=%d err=%v", *topic, p.Partition, p.Leader, p.Err)
+			leaderless += 1
+		} else if len(p.ISR) < len(p.Replicas) {
+			log.Warnf("  %s/%d is under-replicated: replicas=%v isr=%v", *topic, p.Partition, p.Replicas, p.ISR)
+			underReplicated += 1
+		}
+	}
+	if leaderless > 0 {
+		pf.fail("leadership", "%d partitions have no leader", leaderless)
+	} else {
+		pf.pass("leadership", "all partitions have leaders (%d under-replicated)", underReplicated)
+	}
+
+	if canProduce {
+		pf.checkProduce(cluster)
+	}
+}
+
+// Produce a canary record to a scratch topic, creating (and afterwards
+// deleting) it if need be
+func (pf *preflight) checkProduce(cluster *ClusterConfig) {
+	scratch := *preflightTopic
+	if len(scratch) == 0 {
+		scratch = *topic + "-preflight"
+	}
+
+	client, err := newClusterClient(cluster, []kgo.Opt{
+		kgo.DefaultProduceTopic(scratch),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.ProduceRequestTimeout(10 * time.Second),
+	})
+	if err != nil {
+		pf.fail("produce", "%s", diagnose(err))
+		return
+	}
+	defer closeClient(client)
+	ctx, cancel := context.WithTimeout(runCtx, 30*time.Second)
+	defer cancel()
+
+	createReq := kmsg.NewPtrCreateTopicsRequest()
+	createTopic := kmsg.NewCreateTopicsRequestTopic()
+	createTopic.Topic = scratch
+	createTopic.NumPartitions = 1
+	createTopic.ReplicationFactor = -1
+	createReq.Topics = append(createReq.Topics, createTopic)
+	createReq.TimeoutMillis = 10000
+	created := false
+	createResp, err := createReq.RequestWith(ctx, client)
+	if err == nil && len(createResp.Topics) == 1 {
+		err = kerr.ErrorForCode(createResp.Topics[0].ErrorCode)
+	}
+	if err == nil {
+		created = true
+	} else if !errors.Is(err, kerr.TopicAlreadyExists) {
+		pf.fail("produce", "cannot create scratch topic %s: %s", scratch, diagnose(err))
+		return
+	}
+
+	err = client.ProduceSync(ctx, kgo.StringRecord("preflight")).FirstErr()
+	if err != nil {
+		pf.fail("produce", "canary produce to %s failed: %s", scratch, diagnose(err))
+	} else {
+		pf.pass("produce", "canary produced to %s", scratch)
+	}
+
+	if created {
+		deleteReq := kmsg.NewPtrDeleteTopicsRequest()
+		deleteReq.TopicNames = []string{scratch}
+		deleteReq.TimeoutMillis = 10000
+		if _, err := deleteReq.RequestWith(ctx, client); err != nil {
+			log.Warnf("Error deleting scratch topic %s: %v", scratch, err)
+		}
+	}
+}
+
+func preflightCheck() {
+	if len(*topic) == 0 {
+		Die("preflight requires --topic")
+	}
+
+	pf := &preflight{}
+	pf.checkCluster("produce", &produceCluster, true)
+	if crossCluster() {
+		pf.checkCluster("consume", &consumeCluster, false)
+	}
+
+	if pf.failures > 0 {
+		Die("Preflight found %d problems", pf.failures)
+	}
+	log.Infof("Preflight checks passed")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Two producers sharing state would each count the other's offsets as
+// unexpected, and the last to store its ranges would silently drop the
+// other's, so producing takes an advisory lock (flock) on a file beside
+// the state: the state file's own, or in the directory layout one per
+// partition that we own, so that verifiers working on different partitions
+// of a shared state directory can still run at once.  Storing state at any
+// other time takes the same locks for as long as the write, so that e.g.
+// trimming state can't drop what a producer elsewhere is recording.  The
+// locks go when the process does, however it exits.
+
+var (
+	errLockHeld    = errors.New("lock held by another process")
+	errNoFileLocks = errors.New("file locks are not supported on this platform")
+)
+
+type ProduceLock struct {
+	files  []*os.File
+	locked map[string]bool
+}
+
+// The produce lock this process holds, if any
+var (
+	heldProduceLock     *ProduceLock
+	heldProduceLockLock sync.Mutex
+	noFileLocksWarning  sync.Once
+)
+
+func produceLockFiles(nPartitions int32) []string {
+	path := topicOffsetRangeFile()
+	if *stateLayout != stateLayoutDir {
+		return []string{path + ".lock"}
+	}
+	var files []string
+	for p := int32(0); p < nPartitions; p++ {
+		if ownsPartition(p) {
+			files = append(files, statePartitionFile(path, p)+".lock")
+		}
+	}
+	return files
+}
+
+func warnNoFileLocks() {
+	noFileLocksWarning.Do(func() {
+		log.Warnf("No file locks on this platform: concurrent producers sharing state will not be detected")
+	})
+}
+
+// Take the produce locks, or fail saying who holds them
+func LockProduce(nPartitions int32) (*ProduceLock, error) {
+	if *stateLayout == stateLayoutDir {
+		if err := os.MkdirAll(topicOffsetRangeFile(), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	pl := &ProduceLock{locked: make(map[string]bool)}
+	if err := pl.lock(nPartitions); err != nil {
+		pl.Unlock()
+		return nil, err
+	}
+	log.Debugf("Took %d produce locks", len(pl.files))
+	heldProduceLockLock.Lock()
+	heldProduceLock = pl
+	heldProduceLockLock.Unlock()
+	return pl, nil
+}
+
+// Take whichever locks for nPartitions we don't hold yet: in the directory
+// layout, those of partitions that --partition_refresh found
+func (pl *ProduceLock) lock(nPartitions int32) error {
+	hostname, _ := os.Hostname()
+	for _, name := range produceLockFiles(nPartitions) {
+		if pl.locked[name] {
+			continue
+		}
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if err := lockFile(f, false); err != nil {
+			holder, _ := ioutil.ReadAll(f)
+			f.Close()
+			if err == errNoFileLocks {
+				warnNoFileLocks()
+				pl.locked[name] = true
+				continue
+			} else if err == errLockHeld {
+				return fmt.Errorf("another verifier is producing with this state (%s held by %s): concurrent producers corrupt each other's state",
+					name, strings.TrimSpace(string(holder)))
+			}
+			return fmt.Errorf("error locking %s: %w", name, err)
+		}
+		// For the error message of whoever tries next
+		f.Truncate(0)
+		fmt.Fprintf(f, "pid %d on %s since %s\n", os.Getpid(), hostname, time.Now().Format(time.RFC3339))
+		pl.files = append(pl.files, f)
+		pl.locked[name] = true
+	}
+	return nil
+}
+
+func (pl *ProduceLock) Unlock() {
+	heldProduceLockLock.Lock()
+	if heldProduceLock == pl {
+		heldProduceLock = nil
+	}
+	heldProduceLockLock.Unlock()
+	for _, f := range pl.files {
+		unlockFile(f)
+		f.Close()
+	}
+	pl.files = nil
+}
+
+// Extend the produce lock we hold, if any, to cover nPartitions
+func extendProduceLock(nPartitions int32) error {
+	heldProduceLockLock.Lock()
+	defer heldProduceLockLock.Unlock()
+	if heldProduceLock == nil {
+		return nil
+	}
+	return heldProduceLock.lock(nPartitions)
+}
+
+// Run fn under the produce locks for nPartitions: those we hold while
+// producing, or else ones taken just for fn
+func withProduceLock(nPartitions int32, fn func() error) error {
+	if !*produceLock {
+		return fn()
+	}
+	heldProduceLockLock.Lock()
+	held := heldProduceLock != nil
+	heldProduceLockLock.Unlock()
+	if held {
+		if err := extendProduceLock(nPartitions); err != nil {
+			return err
+		}
+		return fn()
+	}
+
+	lock, err := LockProduce(nPartitions)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return fn()
+}
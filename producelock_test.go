@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProduceLock(t *testing.T) {
+	defer func(path string, layout string) { stateFilePath, *stateLayout = path, layout }(stateFilePath, *stateLayout)
+	stateFilePath = filepath.Join(t.TempDir(), "state.d")
+	*stateLayout = stateLayoutDir
+
+	lock, err := LockProduce(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Storing under the lock we hold extends it to new partitions...
+	tors := NewTopicOffsetRanges(3)
+	if err := tors.Store(); err != nil {
+		t.Fatalf("Store under our own lock: %v", err)
+	}
+	if len(lock.files) != 3 {
+		t.Errorf("holding %d partition locks, want 3", len(lock.files))
+	}
+	lock.Unlock()
+
+	// ...and with nothing held, takes its own for the write
+	other, err := LockProduce(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heldProduceLockLock.Lock()
+	heldProduceLock = nil
+	heldProduceLockLock.Unlock()
+	err = tors.Store()
+	if err == nil || !strings.Contains(err.Error(), "another verifier") {
+		t.Errorf("Store while another producer holds the lock: %v", err)
+	}
+	other.Unlock()
+	if err := tors.Store(); err != nil {
+		t.Errorf("Store once the lock is free: %v", err)
+	}
+}
+
+func TestClaimDirProduceEpoch(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state.d")
+	a := TopicOffsetRanges{ProduceEpoch: 3}
+	b := TopicOffsetRanges{ProduceEpoch: 3}
+	if err := a.claimDirProduceEpoch(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.claimDirProduceEpoch(dir); err != nil {
+		t.Fatal(err)
+	}
+	if a.ProduceEpoch != 4 || b.ProduceEpoch != 5 {
+		t.Errorf("epochs %d and %d, want 4 and 5", a.ProduceEpoch, b.ProduceEpoch)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Periodic progress reporting, so that long runs show what they are doing
+// without turning on per-record debug logs.  Counters are updated from
+// produce callbacks and validation, which run on many goroutines, so they
+// are atomics.
+
+type PartitionProgress struct {
+	Partition     int32
+	Produced      int64
+	Validated     int64
+	ProduceOffset int64
+	ReadOffset    int64
+}
+
+type Progress struct {
+	start      time.Time
+	partitions []PartitionProgress
+
+	// Errors that workloads retried or gave up on
+	errors int64
+
+	// Totals at the previous report, for instantaneous rates
+	lastTime      time.Time
+	lastProduced  int64
+	lastValidated int64
+	lastErrors    int64
+
+	// How many records sequential reads will validate, once known
+	validateTarget int64
+
+	// Whether we report progress, rather than just count it for others
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// nil unless --progress_interval or --report_interval is set: methods are
+// no-ops on nil
+var progress *Progress
+
+func NewProgress(nPartitions int32) *Progress {
+	pp := &Progress{
+		start:      time.Now(),
+		lastTime:   time.Now(),
+		partitions: make([]PartitionProgress, nPartitions),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for i := range pp.partitions {
+		pp.partitions[i].Partition = int32(i)
+		pp.partitions[i].ProduceOffset = -1
+		pp.partitions[i].ReadOffset = -1
+	}
+	return pp
+}
+
+func (pp *Progress) Produced(p int32, o int64) {
+	if pp == nil || int(p) >= len(pp.partitions) {
+		return
+	}
+	atomic.AddInt64(&pp.partitions[p].Produced, 1)
+	atomic.StoreInt64(&pp.partitions[p].ProduceOffset, o)
+}
+
+func (pp *Progress) Validated(p int32, o int64) {
+	if pp == nil || int(p) >= len(pp.partitions) {
+		return
+	}
+	atomic.AddInt64(&pp.partitions[p].Validated, 1)
+	atomic.StoreInt64(&pp.partitions[p].ReadOffset, o)
+}
+
+func (pp *Progress) Error() {
+	if pp == nil {
+		return
+	}
+	atomic.AddInt64(&pp.errors, 1)
+}
+
+// Errors so far, or zero if we are not tracking
+func (pp *Progress) Errors() int64 {
+	if pp == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&pp.errors)
+}
+
+func (pp *Progress) AddValidateTarget(n int64) {
+	if pp == nil {
+		return
+	}
+	atomic.AddInt64(&pp.validateTarget, n)
+}
+
+// Records produced and validated so far, or zeros if we are not tracking
+func (pp *Progress) Totals() (int64, int64) {
+	if pp == nil {
+		return 0, 0
+	}
+	var produced, validated int64
+	for i := range pp.partitions {
+		produced += atomic.LoadInt64(&pp.partitions[i].Produced)
+		validated += atomic.LoadInt64(&pp.partitions[i].Validated)
+	}
+	return produced, validated
+}
+
+func (pp *Progress) Start(interval time.Duration) {
+	pp.started = true
+	go func() {
+		defer close(pp.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pp.stop:
+				return
+			case <-ticker.C:
+				pp.report()
+			}
+		}
+	}()
+}
+
+func (pp *Progress) Stop() {
+	if pp == nil || !pp.started {
+		return
+	}
+	close(pp.stop)
+	<-pp.done
+	pp.report()
+}
+
+// Time left at a rate, or "?" if we can't tell
+func eta(remaining int64, rate float64) string {
+	if remaining <= 0 {
+		return "0s"
+	} else if rate <= 0 {
+		return "?"
+	}
+	return (time.Duration(float64(remaining)/rate) * time.Second).Round(time.Second).String()
+}
+
+func (pp *Progress) report() {
+	snapshot := make([]PartitionProgress, len(pp.partitions))
+	var produced, validated int64
+	for i := range pp.partitions {
+		src := &pp.partitions[i]
+		snapshot[i] = PartitionProgress{
+			Partition:     src.Partition,
+			Produced:      atomic.LoadInt64(&src.Produced),
+			Validated:     atomic.LoadInt64(&src.Validated),
+			ProduceOffset: atomic.LoadInt64(&src.ProduceOffset),
+			ReadOffset:    atomic.LoadInt64(&src.ReadOffset),
+		}
+		produced += snapshot[i].Produced
+		validated += snapshot[i].Validated
+	}
+
+	errors := atomic.LoadInt64(&pp.errors)
+	inflight := atomic.LoadInt64(&inflightRecords)
+
+	now := time.Now()
+	elapsed := now.Sub(pp.start).Seconds()
+	interval := now.Sub(pp.lastTime).Seconds()
+	var produceRate, validateRate, errorRate, produceAvg, validateAvg float64
+	if interval > 0 {
+		produceRate = float64(produced-pp.lastProduced) / interval
+		validateRate = float64(validated-pp.lastValidated) / interval
+		errorRate = float64(errors-pp.lastErrors) / interval
+	}
+	if elapsed > 0 {
+		produceAvg = float64(produced) / elapsed
+		validateAvg = float64(validated) / elapsed
+	}
+	pp.lastTime = now
+	pp.lastProduced = produced
+	pp.lastValidated = validated
+	pp.lastErrors = errors
+
+	if len(*pushgateway) > 0 {
+		// Between phases, this is the only sign of life dashboards get
+		results.pushMetrics()
+	}
+
+	validateEta := "?"
+	if target := atomic.LoadInt64(&pp.validateTarget); target > 0 {
+		validateEta = eta(target-validated, validateAvg)
+	}
+
+	if *progressJSON {
+		blob, err := json.Marshal(map[string]interface{}{
+			"Produced":        produced,
+			"Validated":       validated,
+			"ProduceRate":     produceRate,
+			"ValidateRate":    validateRate,
+			"ProduceAvgRate":  produceAvg,
+			"ValidateAvgRate": validateAvg,
+			"ProduceETA":      eta(int64(*pCount)-produced, produceAvg),
+			"ValidateETA":     validateEta,
+			"Errors":          errors,
+			"ErrorRate":       errorRate,
+			"InFlight":        inflight,
+			"Partitions":      snapshot,
+		})
+		if err != nil {
+			log.Warnf("Error encoding progress: %v", err)
+			return
+		}
+		log.Infof("Progress: %s", blob)
+		return
+	}
+
+	log.Infof("Progress: produced %d (%.0f/s, avg %.0f/s, ETA %s), validated %d (%.0f/s, avg %.0f/s, ETA %s), %d errors (%.1f/s), %d in flight",
+		produced, produceRate, produceAvg, eta(int64(*pCount)-produced, produceAvg),
+		validated, validateRate, validateAvg, validateEta, errors, errorRate, inflight)
+	for _, s := range snapshot {
+		if s.Produced == 0 && s.Validated == 0 {
+			continue
+		}
+		log.Debugf("  %s/%d produced %d (at %d), validated %d (at %d)",
+			*topic, s.Partition, s.Produced, s.ProduceOffset, s.Validated, s.ReadOffset)
+	}
+}
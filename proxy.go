@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// With --proxy, broker connections go through a SOCKS5 or HTTP CONNECT
+// proxy, e.g. to reach a cluster in a private VPC from outside it.  The
+// proxy resolves broker hostnames, so advertised names that only resolve
+// inside the VPC still work.  TLS, if enabled, runs end to end through the
+// tunnel.
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+var brokerDialTimeout = 10 * time.Second
+
+// Parsed --proxy, or nil to connect directly
+var proxyURL *url.URL
+
+func parseProxy(spec string) (*url.URL, error) {
+	if len(spec) == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("bad --proxy '%s': %w", spec, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("--proxy must be a socks5:// or http:// URL, not '%s'", spec)
+	}
+	if len(u.Port()) == 0 {
+		return nil, fmt.Errorf("--proxy '%s' has no port", spec)
+	}
+	return u, nil
+}
+
+// How to dial brokers, or nil for the client's default
+func brokerDialer(tlsConfig *tls.Config) dialFunc {
+	if proxyURL == nil && tlsConfig == nil {
+		return nil
+	}
+	dial := (&net.Dialer{Timeout: brokerDialTimeout}).DialContext
+	if proxyURL != nil {
+		dial = proxyDialer(proxyURL)
+	}
+	if tlsConfig != nil {
+		dial = tlsDialer(dial, tlsConfig)
+	}
+	return dial
+}
+
+// Dial an address directly, or through the proxy if there is one
+func dialBroker(ctx context.Context, addr string) (net.Conn, error) {
+	if proxyURL != nil {
+		return proxyDialer(proxyURL)(ctx, "tcp", addr)
+	}
+	return (&net.Dialer{Timeout: brokerDialTimeout}).DialContext(ctx, "tcp", addr)
+}
+
+func tlsDialer(dial dialFunc, tlsConfig *tls.Config) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := tlsConfig.Clone()
+		if c.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			c.ServerName = host
+		}
+		tlsConn := tls.Client(conn, c)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func proxyDialer(u *url.URL) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{Timeout: brokerDialTimeout}).DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to proxy %s: %w", u.Host, err)
+		}
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(brokerDialTimeout)
+		}
+		conn.SetDeadline(deadline)
+
+		if u.Scheme == "socks5" {
+			err = socks5Connect(conn, u.User, addr)
+		} else {
+			err = httpConnect(conn, u.User, addr)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s could not connect to %s: %w", u.Host, addr, err)
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// Ask a SOCKS5 proxy (RFC 1928) to connect us to addr, authenticating
+// with a username and password (RFC 1929) if given
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port in %s", addr)
+	}
+
+	methods := []byte{0x00}
+	if user != nil {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != methods[0] {
+		return errors.New("SOCKS5 proxy refused our authentication method")
+	}
+
+	if user != nil {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 username and password must be under 256 bytes")
+		}
+		req := []byte{0x01, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 0x01), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s too long for SOCKS5", host)
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Version, status, reserved and address type, then the bound address
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 connect failed with status %d", head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("SOCKS5 reply has unknown address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// Ask an HTTP proxy to open a tunnel to addr with CONNECT
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// Brokers never speak first, so the reader can't swallow anything
+	// past the proxy's response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP proxy CONNECT failed: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+)
+
+// Play the proxy's side of a SOCKS5 exchange, checking what the client
+// sends against the expected request bytes
+func fakeSocks5(t *testing.T, conn net.Conn, auth []byte, connect []byte, status byte) {
+	defer conn.Close()
+	expect := func(want []byte) bool {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Errorf("proxy read: %v", err)
+			return false
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("proxy got %x, want %x", got, want)
+			return false
+		}
+		return true
+	}
+	if auth == nil {
+		if !expect([]byte{0x05, 0x01, 0x00}) {
+			return
+		}
+		conn.Write([]byte{0x05, 0x00})
+	} else {
+		if !expect([]byte{0x05, 0x01, 0x02}) {
+			return
+		}
+		conn.Write([]byte{0x05, 0x02})
+		if !expect(auth) {
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+	if !expect(connect) {
+		return
+	}
+	// Bound address as a domain name, then the port
+	conn.Write([]byte{0x05, status, 0x00, 0x03, 0x04, 'h', 'o', 's', 't', 0x23, 0x84})
+}
+
+func TestSocks5Connect(t *testing.T) {
+	cases := []struct {
+		name    string
+		user    *url.Userinfo
+		addr    string
+		auth    []byte
+		connect []byte
+		status  byte
+		ok      bool
+	}{
+		{"ipv4", nil, "10.0.0.1:9092", nil,
+			[]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x23, 0x84}, 0, true},
+		{"ipv6", nil, "[::1]:9092", nil,
+			append(append([]byte{0x05, 0x01, 0x00, 0x04}, net.IPv6loopback...), 0x23, 0x84), 0, true},
+		{"hostname", nil, "broker-0.internal:9093", nil,
+			append(append([]byte{0x05, 0x01, 0x00, 0x03, 17}, "broker-0.internal"...), 0x23, 0x85), 0, true},
+		{"password", url.UserPassword("u", "pw"), "10.0.0.1:9092",
+			[]byte{0x01, 1, 'u', 2, 'p', 'w'},
+			[]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x23, 0x84}, 0, true},
+		{"refused", nil, "10.0.0.1:9092", nil,
+			[]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x23, 0x84}, 0x05, false},
+	}
+	for _, c := range cases {
+		client, proxy := net.Pipe()
+		go fakeSocks5(t, proxy, c.auth, c.connect, c.status)
+		err := socks5Connect(client, c.user, c.addr)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: socks5Connect = %v, want ok=%v", c.name, err, c.ok)
+		}
+		client.Close()
+	}
+}
+
+func TestSocks5ConnectBadAddress(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+	defer proxy.Close()
+	for _, addr := range []string{"no-port", "host:99999"} {
+		if err := socks5Connect(client, nil, addr); err == nil {
+			t.Errorf("socks5Connect(%q) succeeded", addr)
+		}
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	for spec, ok := range map[string]bool{
+		"":                         true,
+		"socks5://proxy:1080":      true,
+		"socks5://u:pw@proxy:1080": true,
+		"http://proxy:3128":        true,
+		"https://proxy:3128":       false,
+		"socks5://proxy":           false,
+		"proxy:1080":               false,
+	} {
+		if _, err := parseProxy(spec); (err == nil) != ok {
+			t.Errorf("parseProxy(%q) = %v, want ok=%v", spec, err, ok)
+		}
+	}
+}
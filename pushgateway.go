@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A short run is over before anything could scrape it, so with
+// --pushgateway the run's counters and produce latency are pushed to a
+// Prometheus Pushgateway when results are emitted, grouped by topic and run
+// ID (the seed, outside distributed mode).  The text exposition format is
+// simple enough that we write it ourselves.
+
+// Produce ack latency, updated from produce callbacks
+type LatencySummary struct {
+	count int64
+	sumUs int64
+	maxUs int64
+}
+
+var produceLatency LatencySummary
+
+func (ls *LatencySummary) Observe(d time.Duration) {
+	us := d.Microseconds()
+	atomic.AddInt64(&ls.count, 1)
+	atomic.AddInt64(&ls.sumUs, us)
+	for {
+		max := atomic.LoadInt64(&ls.maxUs)
+		if us <= max || atomic.CompareAndSwapInt64(&ls.maxUs, max, us) {
+			return
+		}
+	}
+}
+
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (mw *metricsWriter) metric(name string, kind string, help string, value float64) {
+	fmt.Fprintf(&mw.buf, "# HELP si_verifier_%s %s\n", name, help)
+	fmt.Fprintf(&mw.buf, "# TYPE si_verifier_%s %s\n", name, kind)
+	fmt.Fprintf(&mw.buf, "si_verifier_%s %g\n", name, value)
+}
+
+// A metric with a value per broker, keyed "role/id"
+func (mw *metricsWriter) brokerMetric(name string, kind string, help string, values map[string]float64) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Fprintf(&mw.buf, "# HELP si_verifier_%s %s\n", name, help)
+	fmt.Fprintf(&mw.buf, "# TYPE si_verifier_%s %s\n", name, kind)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		role, broker := k, ""
+		if i := strings.LastIndex(k, "/"); i >= 0 {
+			role, broker = k[:i], k[i+1:]
+		}
+		fmt.Fprintf(&mw.buf, "si_verifier_%s{role=\"%s\",broker=\"%s\"} %g\n", name, role, broker, values[k])
+	}
+}
+
+// A metric with a value per partition of the topic
+func (mw *metricsWriter) partitionMetric(name string, kind string, help string, values map[int32]float64) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Fprintf(&mw.buf, "# HELP si_verifier_%s %s\n", name, help)
+	fmt.Fprintf(&mw.buf, "# TYPE si_verifier_%s %s\n", name, kind)
+	partitions := make([]int32, 0, len(values))
+	for p := range values {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	for _, p := range partitions {
+		fmt.Fprintf(&mw.buf, "si_verifier_%s{partition=\"%d\"} %g\n", name, p, values[p])
+	}
+}
+
+// Push the run's metrics.  The caller must not hold r.lock, which is only
+// held while formatting them, not across the push.
+func (r *Results) pushMetrics() {
+	r.lock.Lock()
+	target, body := r.formatMetrics()
+	r.lock.Unlock()
+	putMetrics(target, body)
+}
+
+// The run's metrics in the text exposition format, and where to push them.
+// The caller holds r.lock.
+func (r *Results) formatMetrics() (string, *bytes.Buffer) {
+	r.syncTraffic()
+	mw := &metricsWriter{}
+
+	produced, validated := progress.Totals()
+	mw.metric("produced_records_total", "counter", "Records produced and acked", float64(produced))
+	mw.metric("validated_records_total", "counter", "Records read back and validated", float64(validated))
+	mw.metric("corrupt_records_total", "counter", "Records that failed validation", float64(len(r.Corruption)))
+	mw.metric("data_loss_partitions", "gauge", "Partitions that lost acknowledged data", float64(len(r.DataLoss)))
+	mw.metric("epoch_divergences", "gauge", "Partitions whose log diverged from what was acked", float64(len(r.Divergence)))
+	mw.metric("replica_divergences", "gauge", "Batches that differ between replicas", float64(len(r.ReplicaDivergence)))
+	mw.metric("cloud_storage_issues", "gauge", "Problems found in object storage", float64(len(r.CloudStorage)))
+	mw.metric("upload_lag_partitions", "gauge", "Partitions whose uploads did not catch up", float64(len(r.UploadLag)))
+	mw.metric("errors_total", "counter", "Errors that the workload retried or gave up on", float64(progress.Errors()))
+	mw.metric("records_in_flight", "gauge", "Records produced and not yet acked", float64(atomic.LoadInt64(&inflightRecords)))
+	mw.metric("unknown_key_records_total", "counter", "Records skipped for unknown keys", float64(r.UnknownKeys))
+
+	downtime := 0.0
+	for _, w := range r.Downtime {
+		downtime += w.Seconds
+	}
+	mw.metric("downtime_seconds_total", "counter", "Time spent with some part of the workload failing", downtime)
+	mw.metric("throttle_seconds_total", "counter", "Time brokers throttled our requests", float64(r.Throttle.TotalMs)/1000)
+
+	count := atomic.LoadInt64(&produceLatency.count)
+	sum := float64(atomic.LoadInt64(&produceLatency.sumUs)) / 1e6
+	fmt.Fprintf(&mw.buf, "# HELP si_verifier_produce_latency_seconds Time from produce to ack\n")
+	fmt.Fprintf(&mw.buf, "# TYPE si_verifier_produce_latency_seconds summary\n")
+	fmt.Fprintf(&mw.buf, "si_verifier_produce_latency_seconds_sum %g\n", sum)
+	fmt.Fprintf(&mw.buf, "si_verifier_produce_latency_seconds_count %d\n", count)
+	mw.metric("produce_latency_max_seconds", "gauge", "Longest time from produce to ack", float64(atomic.LoadInt64(&produceLatency.maxUs))/1e6)
+
+	opened := make(map[string]float64)
+	closed := make(map[string]float64)
+	dialFailures := make(map[string]float64)
+	written := make(map[string]float64)
+	read := make(map[string]float64)
+	for k, cs := range r.Connections {
+		opened[k] = float64(cs.Opened)
+		closed[k] = float64(cs.Closed)
+		dialFailures[k] = float64(cs.DialFailures)
+		written[k] = float64(cs.BytesWritten)
+		read[k] = float64(cs.BytesRead)
+	}
+	mw.brokerMetric("connections_opened_total", "counter", "Connections opened to each broker", opened)
+	mw.brokerMetric("connections_closed_total", "counter", "Connections to each broker that closed", closed)
+	mw.brokerMetric("dial_failures_total", "counter", "Failed attempts to connect to each broker", dialFailures)
+	mw.brokerMetric("bytes_written_total", "counter", "Bytes sent to each broker", written)
+	mw.brokerMetric("bytes_read_total", "counter", "Bytes received from each broker", read)
+
+	lag := make(map[int32]float64)
+	maxLag := make(map[int32]float64)
+	for p, ls := range r.Lag {
+		lag[p] = float64(ls.Last)
+		maxLag[p] = float64(ls.Max)
+	}
+	mw.partitionMetric("consumer_lag_records", "gauge", "How far the sequential reader was behind the HWM when last sampled", lag)
+	mw.partitionMetric("consumer_lag_max_records", "gauge", "Furthest the sequential reader fell behind the HWM", maxLag)
+
+	mw.metric("last_run_timestamp_seconds", "gauge", "When the run emitted results", float64(time.Now().Unix()))
+
+	run := thisRun().ID
+	target := fmt.Sprintf("%s/metrics/job/%s/topic/%s/run_id/%s",
+		strings.TrimSuffix(*pushgateway, "/"), url.PathEscape(*pushgatewayJob), url.PathEscape(*topic), url.PathEscape(run))
+	return target, &mw.buf
+}
+
+func putMetrics(target string, body *bytes.Buffer) {
+	// PUT replaces whatever an earlier push from this run left behind
+	req, err := http.NewRequest("PUT", target, body)
+	if err != nil {
+		log.Warnf("Bad --pushgateway: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := reportClient.Do(req)
+	if err != nil {
+		log.Warnf("Error pushing metrics to %s: %v", *pushgateway, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Warnf("Error pushing metrics to %s: %s", *pushgateway, resp.Status)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// With --quorum_check, a record that fails validation is fetched again
+// from every replica of its partition, and from object storage if
+// --s3_bucket is set, and the report includes what each copy holds.  That
+// shows at once whether one replica's disk, the cloud copy, or every copy
+// is bad, where otherwise we would only know what one fetch returned.
+
+// Past this many checks, a badly corrupted topic would just have us
+// hammering the cluster
+const maxQuorumChecks = 100
+
+var quorumChecks int64
+
+// What one copy of a record holds
+type RecordVariant struct {
+	Source   string
+	Key      string `json:",omitempty"`
+	ValueLen int
+	Checksum uint32
+	Error    string `json:",omitempty"`
+}
+
+func newVariant(source string, key []byte, value []byte) RecordVariant {
+	return RecordVariant{
+		Source:   source,
+		Key:      string(key),
+		ValueLen: len(value),
+		Checksum: contentChecksum(key, value),
+	}
+}
+
+// Find the record at offset o among a batch's uncompressed records
+func findRecord(records []byte, firstOffset int64, o int64) (*kmsg.Record, error) {
+	for len(records) > 0 {
+		length, n := binary.Varint(records)
+		if n <= 0 || length < 0 || int64(len(records)-n) < length {
+			return nil, errors.New("truncated record")
+		}
+		var rec kmsg.Record
+		if err := rec.ReadFrom(records[:n+int(length)]); err != nil {
+			return nil, err
+		}
+		if firstOffset+int64(rec.OffsetDelta) == o {
+			return &rec, nil
+		}
+		records = records[n+int(length):]
+	}
+	return nil, fmt.Errorf("no record at offset %d in batch", o)
+}
+
+// Fetch offset o of partition p from one replica
+func replicaVariant(client *kgo.Client, t kadm.TopicDetail, replica int32, p int32, o int64) RecordVariant {
+	variant := RecordVariant{Source: fmt.Sprintf("replica %d", replica)}
+	batches, err := fetchFromReplica(client, replica, t, p, o)
+	if err != nil {
+		variant.Error = err.Error()
+		return variant
+	}
+	for _, b := range batches {
+		if o < b.FirstOffset || o > b.LastOffset {
+			continue
+		}
+		var batch kmsg.RecordBatch
+		if err := batch.ReadFrom(b.Bytes); err != nil {
+			variant.Error = err.Error()
+			return variant
+		}
+		if batch.Attributes&0x07 != 0 {
+			variant.Error = "batch is compressed, not decoded"
+			return variant
+		}
+		rec, err := findRecord(batch.Records, batch.FirstOffset, o)
+		if err != nil {
+			variant.Error = err.Error()
+			return variant
+		}
+		return newVariant(variant.Source, rec.Key, rec.Value)
+	}
+	variant.Error = "no batch containing the offset"
+	return variant
+}
+
+// Redpanda's on-disk batch header, little endian, which precedes each
+// batch's records in a segment object
+const (
+	segmentBatchHeaderSize = 61
+	segmentBatchTypeData   = 1
+)
+
+// Find offset o in a segment downloaded from object storage.  Redpanda log
+// offsets run ahead of Kafka offsets by one for each record in a non-data
+// batch (e.g. raft configuration), so we translate as we go.
+func findSegmentRecord(data []byte, delta int64, o int64) (*kmsg.Record, error) {
+	for len(data) >= segmentBatchHeaderSize {
+		size := int(int32(binary.LittleEndian.Uint32(data[4:8])))
+		if size < segmentBatchHeaderSize || size > len(data) {
+			return nil, fmt.Errorf("bad batch size %d in segment", size)
+		}
+		baseOffset := int64(binary.LittleEndian.Uint64(data[8:16]))
+		batchType := data[16]
+		attrs := binary.LittleEndian.Uint16(data[21:23])
+		lastOffsetDelta := int64(int32(binary.LittleEndian.Uint32(data[23:27])))
+		records := data[segmentBatchHeaderSize:size]
+		data = data[size:]
+
+		if batchType != segmentBatchTypeData {
+			delta += lastOffsetDelta + 1
+			continue
+		}
+		first := baseOffset - delta
+		if o < first || o > first+lastOffsetDelta {
+			continue
+		}
+		if attrs&0x07 != 0 {
+			return nil, errors.New("batch is compressed, not decoded")
+		}
+		return findRecord(records, first, o)
+	}
+	return nil, fmt.Errorf("no batch containing offset %d in segment", o)
+}
+
+// Fetch offset o of partition p from object storage
+func cloudVariant(p int32, o int64) RecordVariant {
+	si := getSegmentIndex()
+	i := si.find(p, o)
+	if i < 0 {
+		return RecordVariant{Source: "cloud", Error: "offset not in any uploaded segment"}
+	}
+	span := si.partitions[p][i]
+	variant := RecordVariant{Source: fmt.Sprintf("cloud %s", span.Name)}
+	if len(span.Key) == 0 {
+		variant.Error = "segment missing from bucket"
+		return variant
+	}
+	data, err := NewS3Client().Get(span.Key)
+	if err != nil {
+		variant.Error = err.Error()
+		return variant
+	}
+	rec, err := findSegmentRecord(data, span.Delta, o)
+	if err != nil {
+		variant.Error = err.Error()
+		return variant
+	}
+	return newVariant(variant.Source, rec.Key, rec.Value)
+}
+
+// Every copy of a record we can find, starting with the one we read
+func quorumVariants(r *kgo.Record) []RecordVariant {
+	if n := atomic.AddInt64(&quorumChecks, 1); n > maxQuorumChecks {
+		if n == maxQuorumChecks+1 {
+			log.Warnf("Done %d quorum checks, skipping any more", maxQuorumChecks)
+		}
+		return nil
+	}
+
+	variants := []RecordVariant{newVariant("read", r.Key, r.Value)}
+
+	client := newClient(nil)
+	defer closeClient(client)
+	t, _, err := getTopicMetadata(client)
+	if err != nil {
+		log.Warnf("Quorum check of %s/%d at %d: %v", *topic, r.Partition, r.Offset, err)
+		return variants
+	}
+	mp, ok := t.Partitions[r.Partition]
+	if !ok {
+		log.Warnf("Quorum check of %s/%d at %d: partition not in metadata", *topic, r.Partition, r.Offset)
+		return variants
+	}
+	for _, replica := range mp.Replicas {
+		variants = append(variants, replicaVariant(client, t, replica, r.Partition, r.Offset))
+	}
+	if len(*s3Bucket) > 0 {
+		variants = append(variants, cloudVariant(r.Partition, r.Offset))
+	}
+
+	// Group the copies by content, so that the odd one out stands out
+	bySum := make(map[uint32][]string)
+	for _, v := range variants {
+		if len(v.Error) > 0 {
+			log.Warnf("Quorum check of %s/%d at %d: %s: %s", *topic, r.Partition, r.Offset, v.Source, v.Error)
+			continue
+		}
+		bySum[v.Checksum] = append(bySum[v.Checksum], v.Source)
+	}
+	var groups []string
+	for sum, sources := range bySum {
+		groups = append(groups, fmt.Sprintf("%08x from %s", sum, strings.Join(sources, ", ")))
+	}
+	sort.Strings(groups)
+	log.Errorf("Quorum check of %s/%d at %d: %d distinct copies: %s", *topic, r.Partition, r.Offset, len(bySum), strings.Join(groups, "; "))
+	return variants
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// --from_offset/--to_offset and --from_timestamp/--to_timestamp restrict
+// readers to a window of each partition, e.g. to only validate data known to
+// have been uploaded to object storage, rather than everything from the
+// start of the log to the HWM.
+
+func readWindowSet() bool {
+	return *fromOffset >= 0 || *toOffset >= 0 || len(*fromTimestamp) > 0 || len(*toTimestamp) > 0
+}
+
+// A timestamp flag's value in milliseconds: either a number of
+// milliseconds since the epoch or an RFC3339 time
+func parseTimestampFlag(name string, value string) int64 {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ms
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	Chk(err, "Bad --%s '%s': expected milliseconds or an RFC3339 time", name, value)
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Narrow per-partition read bounds [start, end) to the window.  Bounds only
+// ever shrink, and start never passes end.
+func applyReadWindow(client *kgo.Client, nPartitions int32, start []int64, end []int64) {
+	if !readWindowSet() {
+		return
+	}
+
+	raiseStart := func(p int32, o int64) {
+		if o > start[p] {
+			start[p] = o
+		}
+		if start[p] > end[p] {
+			start[p] = end[p]
+		}
+	}
+	lowerEnd := func(p int32, o int64) {
+		if o < end[p] {
+			end[p] = o
+		}
+		if end[p] < start[p] {
+			end[p] = start[p]
+		}
+	}
+
+	if len(*fromTimestamp) > 0 {
+		offsets, err := getOffsets(client, nPartitions, parseTimestampFlag("from_timestamp", *fromTimestamp))
+		ChkEmit(err, "%v", err)
+		for p := int32(0); p < nPartitions; p++ {
+			if offsets[p] < 0 {
+				// Nothing at or after the timestamp
+				raiseStart(p, end[p])
+			} else {
+				raiseStart(p, offsets[p])
+			}
+		}
+	}
+	if len(*toTimestamp) > 0 {
+		offsets, err := getOffsets(client, nPartitions, parseTimestampFlag("to_timestamp", *toTimestamp))
+		ChkEmit(err, "%v", err)
+		for p := int32(0); p < nPartitions; p++ {
+			if offsets[p] >= 0 {
+				lowerEnd(p, offsets[p])
+			}
+		}
+	}
+	for p := int32(0); p < nPartitions; p++ {
+		if *fromOffset >= 0 {
+			raiseStart(p, *fromOffset)
+		}
+		if *toOffset >= 0 {
+			lowerEnd(p, *toOffset)
+		}
+		log.Infof("Read window %s/%d %d-%d", *topic, p, start[p], end[p])
+	}
+}
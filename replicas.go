@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// A record batch as stored on a replica
+type rawBatch struct {
+	FirstOffset int64
+	LastOffset  int64
+	Bytes       []byte
+}
+
+// Split a fetch response's record batches, dropping any partial batch
+// at the end.
+func splitBatches(data []byte) ([]rawBatch, error) {
+	var batches []rawBatch
+	for len(data) >= 12 {
+		length := int(int32(binary.BigEndian.Uint32(data[8:12])))
+		if length <= 0 || len(data) < 12+length {
+			break
+		}
+		raw := data[:12+length]
+		data = data[12+length:]
+
+		var batch kmsg.RecordBatch
+		if err := batch.ReadFrom(raw); err != nil {
+			return nil, err
+		}
+		batches = append(batches, rawBatch{
+			FirstOffset: batch.FirstOffset,
+			LastOffset:  batch.FirstOffset + int64(batch.LastOffsetDelta),
+			Bytes:       raw,
+		})
+	}
+	return batches, nil
+}
+
+// Fetch record batches from one specific broker, whether or not it leads
+// the partition (followers serve consumer fetches from Fetch v11, KIP-392).
+func fetchFromReplica(client *kgo.Client, broker int32, t kadm.TopicDetail, p int32, o int64) ([]rawBatch, error) {
+	req := kmsg.NewPtrFetchRequest()
+	req.ReplicaID = -1
+	req.MaxWaitMillis = 500
+	req.MinBytes = 1
+	req.MaxBytes = 1024 * 1024
+	req.IsolationLevel = readIsolationLevel()
+	req.SessionEpoch = -1
+	reqTopic := kmsg.NewFetchRequestTopic()
+	reqTopic.Topic = *topic
+	reqTopic.TopicID = t.ID
+	part := kmsg.NewFetchRequestTopicPartition()
+	part.Partition = p
+	part.FetchOffset = o
+	part.PartitionMaxBytes = 1024 * 1024
+	reqTopic.Partitions = append(reqTopic.Partitions, part)
+	req.Topics = append(req.Topics, reqTopic)
+
+	ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+	defer cancel()
+	kresp, err := client.Broker(int(broker)).Request(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := kresp.(*kmsg.FetchResponse)
+	if resp.ErrorCode != 0 {
+		return nil, kerr.ErrorForCode(resp.ErrorCode)
+	}
+	if len(resp.Topics) != 1 || len(resp.Topics[0].Partitions) != 1 {
+		return nil, fmt.Errorf("Unexpected fetch response shape from broker %d", broker)
+	}
+	rp := resp.Topics[0].Partitions[0]
+	if rp.ErrorCode != 0 {
+		return nil, kerr.ErrorForCode(rp.ErrorCode)
+	}
+	return splitBatches(rp.RecordBatches)
+}
+
+// Compare one partition across its replicas, returning the number of
+// divergent batches found.
+func compareReplicasPartition(client *kgo.Client, t kadm.TopicDetail, mp kadm.PartitionDetail, lwm int64, hwm int64) int {
+	p := mp.Partition
+	log.Infof("Comparing %s/%d replicas %v over %d-%d...", *topic, p, mp.Replicas, lwm, hwm)
+
+	divergent := 0
+	compared := 0
+	o := lwm
+	for o < hwm {
+		// Fetch the same offset from every replica, and compare the batches
+		// that all of them returned
+		var replicas []int32
+		var fetched [][]rawBatch
+		common := -1
+		for _, replica := range mp.Replicas {
+			batches, err := fetchFromReplica(client, replica, t, p, o)
+			if err != nil {
+				log.Warnf("Error fetching %s/%d at %d from replica %d: %v", *topic, p, o, replica, err)
+				continue
+			}
+			replicas = append(replicas, replica)
+			fetched = append(fetched, batches)
+			if common < 0 || len(batches) < common {
+				common = len(batches)
+			}
+		}
+		if len(replicas) < 2 {
+			Die("Could not fetch %s/%d at %d from enough replicas to compare", *topic, p, o)
+		}
+		if common == 0 {
+			Die("Replica returned no data for %s/%d at %d, below hwm %d", *topic, p, o, hwm)
+		}
+
+		for i := 0; i < common; i++ {
+			reference := fetched[0][i]
+			for r := 1; r < len(replicas); r++ {
+				batch := fetched[r][i]
+				if batch.FirstOffset != reference.FirstOffset || !bytes.Equal(batch.Bytes, reference.Bytes) {
+					log.Errorf("Replica divergence on %s/%d: replica %d has batch %d-%d, replica %d has batch %d-%d (equal bytes: %v)",
+						*topic, p, replicas[0], reference.FirstOffset, reference.LastOffset,
+						replicas[r], batch.FirstOffset, batch.LastOffset, bytes.Equal(batch.Bytes, reference.Bytes))
+					results.AddReplicaDivergence(ReplicaDivergence{
+						Partition:   p,
+						Offset:      reference.FirstOffset,
+						Replica:     replicas[r],
+						Reference:   replicas[0],
+						ReplicaLast: batch.LastOffset,
+					})
+					divergent += 1
+				}
+			}
+			compared += 1
+			o = reference.LastOffset + 1
+		}
+	}
+
+	log.Infof("Compared %d batches on %s/%d, %d divergent", compared, *topic, p, divergent)
+	return divergent
+}
+
+// The compare-replicas subcommand: read each partition from every one of
+// its replicas, and check that they hold byte-identical batches.  Takes
+// an optional list of partitions to compare.
+func compareReplicas(args []string) {
+	client := newClient(nil)
+	defer closeClient(client)
+
+	t, _, err := getTopicMetadata(client)
+	Chk(err, "%v", err)
+	nPartitions := int32(len(t.Partitions))
+	lwm, hwm, err := getOffsetBounds(client, nPartitions)
+	ChkEmit(err, "%v", err)
+
+	only := make(map[int32]bool)
+	for _, a := range args {
+		p, err := strconv.ParseInt(a, 10, 32)
+		Chk(err, "Bad partition '%s'", a)
+		only[int32(p)] = true
+	}
+
+	divergent := 0
+	for _, mp := range t.Partitions.Sorted() {
+		if len(only) > 0 && !only[mp.Partition] {
+			continue
+		}
+		if len(mp.Replicas) < 2 {
+			log.Infof("Skipping %s/%d with %d replicas", *topic, mp.Partition, len(mp.Replicas))
+			continue
+		}
+		divergent += compareReplicasPartition(client, t, mp, lwm[mp.Partition], hwm[mp.Partition])
+	}
+
+	results.Emit()
+	if divergent > 0 {
+		Die("%d divergent batches between replicas of %s", divergent, *topic)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// When producing and consuming on different clusters, wait for the consume
+// cluster's log to catch up with the produce cluster's, checking offset
+// parity as we go: our keys encode offsets, so validating content on the
+// consume cluster relies on replication preserving them.
+func waitForReplication(nPartitions int32) {
+	produceClient := newProduceClient(nil)
+	defer closeClient(produceClient)
+	consumeClient := newClient(nil)
+	defer closeClient(consumeClient)
+
+	produceEnd, err := getOffsets(produceClient, nPartitions, -1)
+	ChkEmit(err, "%v", err)
+	deadline := time.Now().Add(*replicationWait)
+
+	for {
+		consumeEnd, err := getOffsets(consumeClient, nPartitions, -1)
+		ChkEmit(err, "%v", err)
+		behind := 0
+		for p := int32(0); p < nPartitions; p++ {
+			if consumeEnd[p] > produceEnd[p] {
+				Die("Offset divergence on %s/%d: consume cluster hwm %d > produce cluster hwm %d", *topic, p, consumeEnd[p], produceEnd[p])
+			} else if consumeEnd[p] < produceEnd[p] {
+				log.Debugf("Replication behind on %s/%d: %d < %d", *topic, p, consumeEnd[p], produceEnd[p])
+				behind += 1
+			}
+		}
+
+		if behind == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			Die("Consume cluster still behind on %d partitions after %v", behind, *replicationWait)
+		}
+
+		log.Infof("Waiting for replication, %d partitions behind...", behind)
+		time.Sleep(5 * time.Second)
+	}
+
+	// Retention runs independently on each cluster, so differing start
+	// offsets are not an error in themselves, but are worth knowing about
+	// when interpreting validation results.
+	produceStart, err := getOffsets(produceClient, nPartitions, -2)
+	ChkEmit(err, "%v", err)
+	consumeStart, err := getOffsets(consumeClient, nPartitions, -2)
+	ChkEmit(err, "%v", err)
+	for p := int32(0); p < nPartitions; p++ {
+		if produceStart[p] != consumeStart[p] {
+			log.Warnf("Start offsets differ on %s/%d: produce cluster %d, consume cluster %d", *topic, p, produceStart[p], consumeStart[p])
+		}
+	}
+
+	log.Infof("Consume cluster caught up with produce cluster")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// With --report_url, results are POSTed to a collector as well as printed,
+// so that fleets of verifiers can report in without anyone scraping their
+// logs.  With --report_interval, heartbeats are POSTed in between, so the
+// collector can tell a slow run from a dead one.  The X-SI-Verifier-Report
+// header says which kind of report a request carries.
+
+var reportClient = &http.Client{Timeout: 10 * time.Second}
+
+type Heartbeat struct {
+	Topic     string
+	RunId     string `json:",omitempty"`
+	Instance  string `json:",omitempty"`
+	Seed      int64
+	Elapsed   float64
+	Produced  int64
+	Validated int64
+	Errors    int64
+	InFlight  int64
+}
+
+func postReport(kind string, body []byte) {
+	req, err := http.NewRequest("POST", *reportURL, bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("Bad --report_url: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-SI-Verifier-Report", kind)
+
+	resp, err := reportClient.Do(req)
+	if err != nil {
+		log.Warnf("Error posting %s to %s: %v", kind, *reportURL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Warnf("Error posting %s to %s: %s", kind, *reportURL, resp.Status)
+	}
+}
+
+func startHeartbeats(interval time.Duration) {
+	start := time.Now()
+	go func() {
+		for range time.Tick(interval) {
+			hb := Heartbeat{
+				Topic:    *topic,
+				RunId:    thisRun().ID,
+				Instance: *instanceId,
+				Seed:     results.Seed,
+				Elapsed:  time.Since(start).Seconds(),
+			}
+			hb.Produced, hb.Validated = progress.Totals()
+			hb.Errors = progress.Errors()
+			hb.InFlight = atomic.LoadInt64(&inflightRecords)
+			body, err := json.Marshal(hb)
+			if err != nil {
+				log.Warnf("Error encoding heartbeat: %v", err)
+				continue
+			}
+			postReport("heartbeat", body)
+		}
+	}()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Every client we create is tracked until closed with closeClient, so that
+// a leaked client shows up in the results, or past --max_clients stops the
+// run, rather than as a slow climb in memory and connections.  Goroutine
+// and allocation counts at either end of the run go in the results too.
+
+var clientsLock sync.Mutex
+var liveClients = make(map[*kgo.Client]string)
+var peakClients int
+
+func trackClient(client *kgo.Client, role string) {
+	clientsLock.Lock()
+	liveClients[client] = role
+	n := len(liveClients)
+	if n > peakClients {
+		peakClients = n
+	}
+	clientsLock.Unlock()
+
+	if *maxClients > 0 && n > *maxClients {
+		Die("%d clients open, more than --max_clients=%d: are clients being leaked?", n, *maxClients)
+	}
+}
+
+func closeClient(client *kgo.Client) {
+	clientsLock.Lock()
+	delete(liveClients, client)
+	clientsLock.Unlock()
+	client.Close()
+}
+
+type ResourceUsage struct {
+	// Clients open when results were emitted, by role
+	OpenClients []string
+	PeakClients int
+
+	StartGoroutines int
+	Goroutines      int
+
+	HeapAllocBytes  uint64
+	TotalAllocBytes uint64
+	NumGC           uint32
+}
+
+var startGoroutines int
+
+// Note the baseline for the end-of-run comparison
+func startResourceTracking() {
+	startGoroutines = runtime.NumGoroutine()
+}
+
+func resourceUsage() ResourceUsage {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	clientsLock.Lock()
+	open := make([]string, 0, len(liveClients))
+	for _, role := range liveClients {
+		open = append(open, role)
+	}
+	peak := peakClients
+	clientsLock.Unlock()
+	sort.Strings(open)
+
+	return ResourceUsage{
+		OpenClients:     open,
+		PeakClients:     peak,
+		StartGoroutines: startGoroutines,
+		Goroutines:      runtime.NumGoroutine(),
+		HeapAllocBytes:  ms.HeapAlloc,
+		TotalAllocBytes: ms.TotalAlloc,
+		NumGC:           ms.NumGC,
+	}
+}
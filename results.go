@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A period during which some part of the workload was failing, e.g.
+// while a broker restarted.
+type DowntimeWindow struct {
+	What    string
+	Start   time.Time
+	End     time.Time
+	Seconds float64
+	Errors  map[string]int
+}
+
+// A partition whose log no longer contains offsets that were acked to us
+type DataLoss struct {
+	Partition    int32
+	AckedUpper   int64
+	AckedEpoch   int32
+	Lwm          int64
+	Hwm          int64
+	CurrentEpoch int32
+}
+
+// A partition whose leader disagrees with us about where an epoch ends
+type EpochDivergence struct {
+	Partition  int32
+	AckedUpper int64
+	AckedEpoch int32
+	EndOffset  int64
+	EndEpoch   int32
+}
+
+// A batch that differs between two replicas of a partition
+type ReplicaDivergence struct {
+	Partition   int32
+	Offset      int64
+	Replica     int32
+	Reference   int32
+	ReplicaLast int64
+}
+
+// A problem with a partition's uploads to object storage
+type CloudStorageIssue struct {
+	Partition int32
+	Segment   string `json:",omitempty"`
+	Lower     int64
+	Upper     int64
+	Problem   string
+}
+
+// A start offset advanced by --delete_records
+type PrefixTruncation struct {
+	Partition int32
+	PrevStart int64
+	Start     int64
+}
+
+// A partition whose uploads to object storage did not catch up with
+// the offsets acked to us
+type UploadLag struct {
+	Partition            int32
+	AckedUpper           int64
+	UploadedUpper        int64
+	LocalLastOffset      int64
+	MsSinceSegmentUpload int64
+	Error                string `json:",omitempty"`
+}
+
+// Summary of the run, printed as JSON on stdout when we finish
+type Results struct {
+	lock sync.Mutex
+	// Emit reports only once: a Die after it may time out and emit again
+	emitted bool
+
+	Seed     int64
+	Downtime []DowntimeWindow
+
+	// With --run_headers, this run's identity, and what reads found from
+	// each run whose records they read
+	Run  *RunInfo             `json:",omitempty"`
+	Runs map[string]*RunStats `json:",omitempty"`
+
+	// Whether the run gave up at --timeout
+	TimedOut bool `json:",omitempty"`
+
+	// Why the run failed, if it stopped on an error
+	Error string `json:",omitempty"`
+
+	// The topic settings that affect what a run can expect
+	TopicConfig map[string]string `json:",omitempty"`
+
+	// Records skipped by --tolerate_unknown_keys
+	UnknownKeys int64
+
+	// Records that sequential reads skipped validating, per --validate_fraction
+	Unsampled int64 `json:",omitempty"`
+
+	// Transaction markers that strict sequence reads found, by partition
+	ControlRecords map[int32]int64 `json:",omitempty"`
+
+	DataLoss   []DataLoss
+	Divergence []EpochDivergence
+
+	ReplicaDivergence []ReplicaDivergence
+	CloudStorage      []CloudStorageIssue
+	SegmentCoverage   []SegmentCoverage `json:",omitempty"`
+	UploadLag         []UploadLag
+	Throttle          ThrottleStats
+	BrokerReads       map[int32]*BrokerReadStats  `json:",omitempty"`
+	Connections       map[string]*ConnectionStats `json:",omitempty"`
+	Bench             *BenchStats                 `json:",omitempty"`
+	BenchConsume      *BenchConsumeStats          `json:",omitempty"`
+	Lag               map[int32]*LagStats         `json:",omitempty"`
+	Compaction        *CompactionStats            `json:",omitempty"`
+	LagSamples        []LagSample                 `json:",omitempty"`
+	Oversize          OversizeStats
+	BadTimestamps     *BadTimestampStats   `json:",omitempty"`
+	TimestampSweep    *TimestampSweepStats `json:",omitempty"`
+	Corruption        []Corruption
+	OffsetRegressions []OffsetRegression     `json:",omitempty"`
+	Retries           map[string]*RetryStats `json:",omitempty"`
+	StateShardErrors  []StateShardError      `json:",omitempty"`
+	PrefixTruncation  []PrefixTruncation     `json:",omitempty"`
+	Digests           []DigestCheck          `json:",omitempty"`
+	GroupChurn        *GroupChurnStats       `json:",omitempty"`
+	CommitDrift       []CommitDrift          `json:",omitempty"`
+	Pipeline          *PipelineStats         `json:",omitempty"`
+
+	// Clients, goroutines and memory, to make leaks visible
+	Resources ResourceUsage
+}
+
+var results Results
+
+func (r *Results) SetTimedOut() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.TimedOut = true
+}
+
+func (r *Results) SetError(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Error = err.Error()
+}
+
+func (r *Results) SetTopicConfig(configs map[string]string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.TopicConfig = configs
+}
+
+func (r *Results) AddDowntime(w DowntimeWindow) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Downtime = append(r.Downtime, w)
+}
+
+func (r *Results) AddDataLoss(l DataLoss) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.DataLoss = append(r.DataLoss, l)
+}
+
+func (r *Results) AddDivergence(d EpochDivergence) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Divergence = append(r.Divergence, d)
+}
+
+func (r *Results) AddReplicaDivergence(d ReplicaDivergence) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ReplicaDivergence = append(r.ReplicaDivergence, d)
+}
+
+func (r *Results) AddCloudStorageIssue(i CloudStorageIssue) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.CloudStorage = append(r.CloudStorage, i)
+}
+
+func (r *Results) AddUploadLag(l UploadLag) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.UploadLag = append(r.UploadLag, l)
+}
+
+func (r *Results) SetSegmentCoverage(c []SegmentCoverage) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.SegmentCoverage = c
+}
+
+func (r *Results) AddThrottle(role string, broker int32, ms int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Throttle.note(role, broker, ms)
+}
+
+func (r *Results) brokerReads(broker int32) *BrokerReadStats {
+	if r.BrokerReads == nil {
+		r.BrokerReads = make(map[int32]*BrokerReadStats)
+	}
+	bs, ok := r.BrokerReads[broker]
+	if !ok {
+		bs = &BrokerReadStats{}
+		r.BrokerReads[broker] = bs
+	}
+	return bs
+}
+
+func (r *Results) AddBrokerFetch(broker int32, latency time.Duration, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.brokerReads(broker).noteFetch(latency, err)
+}
+
+func (r *Results) AddBrokerPartitionError(broker int32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.brokerReads(broker).PartitionErrors += 1
+}
+
+func (r *Results) AddBrokerRecords(broker int32, records int64, bytes int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	bs := r.brokerReads(broker)
+	bs.Records += records
+	bs.Bytes += bytes
+}
+
+func (r *Results) connections(key string) *ConnectionStats {
+	if r.Connections == nil {
+		r.Connections = make(map[string]*ConnectionStats)
+	}
+	cs, ok := r.Connections[key]
+	if !ok {
+		cs = &ConnectionStats{}
+		r.Connections[key] = cs
+	}
+	return cs
+}
+
+func (r *Results) AddConnection(key string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		r.connections(key).DialFailures += 1
+	} else {
+		r.connections(key).Opened += 1
+	}
+}
+
+func (r *Results) AddDisconnection(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.connections(key).Closed += 1
+}
+
+func (r *Results) SetBench(s BenchStats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Bench = &s
+}
+
+func (r *Results) AddLag(p int32, lag int64, alert bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.Lag == nil {
+		r.Lag = make(map[int32]*LagStats)
+	}
+	ls, ok := r.Lag[p]
+	if !ok {
+		ls = &LagStats{}
+		r.Lag[p] = ls
+	}
+	ls.Last = lag
+	if lag > ls.Max {
+		ls.Max = lag
+	}
+	if alert {
+		ls.Alerts += 1
+	}
+}
+
+func (r *Results) AddLagSample(s LagSample) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.LagSamples) >= maxLagSamples {
+		thinned := r.LagSamples[:0]
+		for i := 0; i < len(r.LagSamples); i += 2 {
+			thinned = append(thinned, r.LagSamples[i])
+		}
+		r.LagSamples = thinned
+	}
+	r.LagSamples = append(r.LagSamples, s)
+}
+
+func (r *Results) AddStateShardError(e StateShardError) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.StateShardErrors = append(r.StateShardErrors, e)
+}
+
+func (r *Results) retryStats(what string) *RetryStats {
+	if r.Retries == nil {
+		r.Retries = make(map[string]*RetryStats)
+	}
+	rs, ok := r.Retries[what]
+	if !ok {
+		rs = &RetryStats{}
+		r.Retries[what] = rs
+	}
+	return rs
+}
+
+func (r *Results) AddRetry(what string, e RetryEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rs := r.retryStats(what)
+	rs.Retries += 1
+	if len(rs.History) < maxRetryHistory {
+		rs.History = append(rs.History, e)
+	}
+}
+
+func (r *Results) AddRetryWait(what string, d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.retryStats(what).WaitMs += d.Milliseconds()
+}
+
+func (r *Results) AddRetryOutcome(what string, recovered bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rs := r.retryStats(what)
+	if recovered {
+		rs.Recovered += 1
+	} else {
+		rs.GaveUp += 1
+	}
+}
+
+func (r *Results) AddOffsetRegression(or OffsetRegression) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.OffsetRegressions = append(r.OffsetRegressions, or)
+}
+
+func (r *Results) SetRun(ri RunInfo) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Run = &ri
+}
+
+func (r *Results) AddRunRecord(ri RunInfo, corrupt bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.Runs == nil {
+		r.Runs = make(map[string]*RunStats)
+	}
+	rs, ok := r.Runs[ri.ID]
+	if !ok {
+		rs = &RunStats{Version: ri.Version, Host: ri.Host}
+		r.Runs[ri.ID] = rs
+	}
+	if corrupt {
+		rs.Corrupt += 1
+	} else {
+		rs.Records += 1
+	}
+}
+
+func (r *Results) SetCompaction(s CompactionStats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Compaction = &s
+}
+
+func (r *Results) SetBenchConsume(s BenchConsumeStats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.BenchConsume = &s
+}
+
+func (r *Results) AddOversize(p int32, err error, rejected bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Oversize.Attempts += 1
+	if rejected {
+		r.Oversize.Rejected += 1
+	}
+	if err != nil {
+		if r.Oversize.Errors == nil {
+			r.Oversize.Errors = make(map[string]int64)
+		}
+		r.Oversize.Errors[err.Error()] += 1
+	}
+}
+
+func (r *Results) AddBadTimestamp(err error, rejected bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.BadTimestamps == nil {
+		r.BadTimestamps = &BadTimestampStats{}
+	}
+	bt := r.BadTimestamps
+	bt.Attempts += 1
+	if err == nil {
+		bt.Accepted += 1
+	} else if rejected {
+		bt.Rejected += 1
+	} else {
+		if bt.Errors == nil {
+			bt.Errors = make(map[string]int64)
+		}
+		bt.Errors[err.Error()] += 1
+	}
+}
+
+func (r *Results) AddBadTimestampQuery() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.BadTimestamps == nil {
+		r.BadTimestamps = &BadTimestampStats{}
+	}
+	r.BadTimestamps.Queries += 1
+}
+
+func (r *Results) AddTimeQuery(unknown bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.TimestampSweep == nil {
+		r.TimestampSweep = &TimestampSweepStats{}
+	}
+	if unknown {
+		r.TimestampSweep.Unknown += 1
+	} else {
+		r.TimestampSweep.Queries += 1
+	}
+}
+
+func (r *Results) AddTimeQueryMismatch(m TimeQueryMismatch) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.TimestampSweep.Mismatches = append(r.TimestampSweep.Mismatches, m)
+}
+
+func (r *Results) AddCorruption(c Corruption) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Corruption = append(r.Corruption, c)
+}
+
+func (r *Results) AddUnknownKey() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.UnknownKeys += 1
+}
+
+func (r *Results) AddControlRecords(p int32, n int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.ControlRecords == nil {
+		r.ControlRecords = make(map[int32]int64)
+	}
+	r.ControlRecords[p] += n
+}
+
+func (r *Results) AddPrefixTruncation(t PrefixTruncation) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.PrefixTruncation = append(r.PrefixTruncation, t)
+}
+
+func (r *Results) AddDigestCheck(c DigestCheck) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Digests = append(r.Digests, c)
+}
+
+func (r *Results) SetGroupChurn(s GroupChurnStats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.GroupChurn = &s
+}
+
+func (r *Results) AddCommitDrift(d CommitDrift) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.CommitDrift = append(r.CommitDrift, d)
+}
+
+func (r *Results) SetPipeline(s PipelineStats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Pipeline = &s
+}
+
+func (r *Results) AddUnsampled(n int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Unsampled += n
+}
+
+func (r *Results) Emit() {
+	// Snapshot everything under the lock, and report it after, so that
+	// a slow collector doesn't hold up the workload
+	r.lock.Lock()
+	if r.emitted {
+		r.lock.Unlock()
+		return
+	}
+	r.emitted = true
+	r.Resources = resourceUsage()
+	r.syncTraffic()
+	data, err := json.Marshal(r)
+	var metricsTarget string
+	var metrics *bytes.Buffer
+	if err == nil && len(*pushgateway) > 0 {
+		metricsTarget, metrics = r.formatMetrics()
+	}
+	unknownKeys, unsampled := r.UnknownKeys, r.Unsampled
+	r.lock.Unlock()
+
+	if err != nil {
+		log.Errorf("Error serializing results: %v", err)
+		return
+	}
+	fmt.Println(string(data))
+	if len(*reportURL) > 0 {
+		postReport("results", data)
+	}
+	if metrics != nil {
+		putMetrics(metricsTarget, metrics)
+	}
+	if unknownKeys > 0 {
+		log.Warnf("Skipped %d records with unknown keys", unknownKeys)
+	}
+	if unsampled > 0 {
+		log.Infof("Sequential reads validated a sample, skipping %d records", unsampled)
+	}
+}
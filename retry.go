@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Listing offsets and loading metadata are retried through disruptions
+// such as leadership changes, per the --retry_* flags: with exponential
+// backoff and jitter, up to a number of attempts and an overall deadline.
+// Every retry goes in the results, so that a cluster that is slow or
+// flaky at serving metadata shows up even when the run succeeds.
+
+// Past this many, retries are counted but not listed
+const maxRetryHistory = 100
+
+type RetryStats struct {
+	Retries int64
+	// Calls that succeeded after retrying, and calls that gave up
+	Recovered int64
+	GaveUp    int64 `json:",omitempty"`
+	WaitMs    int64
+	History   []RetryEvent `json:",omitempty"`
+}
+
+type RetryEvent struct {
+	Time    time.Time
+	Attempt int
+	Error   string
+}
+
+// Call fn until it succeeds, fails with an error that `retriable` rejects,
+// or runs out of attempts or time, returning its last error
+func retry(what string, retriable func(error) bool, fn func() error) error {
+	start := time.Now()
+	disruption := NewDisruptionTracker(what)
+	wait := *retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			disruption.Ok()
+			if attempt > 1 {
+				results.AddRetryOutcome(what, true)
+			}
+			return nil
+		}
+		if retriable != nil && !retriable(err) {
+			return err
+		}
+		if err := disruption.Error(err); err != nil {
+			results.AddRetryOutcome(what, false)
+			return err
+		}
+		results.AddRetry(what, RetryEvent{Time: time.Now(), Attempt: attempt, Error: err.Error()})
+
+		// Equal jitter: half the backoff, plus up to half again at random
+		sleep := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		outOfTime := false
+		if *retryDeadline > 0 {
+			remaining := *retryDeadline - time.Since(start)
+			outOfTime = remaining <= 0
+			if sleep > remaining {
+				sleep = remaining
+			}
+		}
+		if (*retryAttempts > 0 && attempt >= *retryAttempts) || outOfTime || runCtx.Err() != nil {
+			results.AddRetryOutcome(what, false)
+			return fmt.Errorf("%s gave up after %d attempts over %v: %w", what, attempt, time.Since(start).Round(time.Millisecond), err)
+		}
+
+		log.Warnf("Retrying %s in %v (attempt %d)", what, sleep.Round(time.Millisecond), attempt)
+		results.AddRetryWait(what, sleep)
+		select {
+		case <-time.After(sleep):
+		case <-runCtx.Done():
+			results.AddRetryOutcome(what, false)
+			return fmt.Errorf("%s interrupted after %d attempts: %w", what, attempt, err)
+		}
+		wait *= 2
+		if wait > *retryBackoffMax {
+			wait = *retryBackoffMax
+		}
+	}
+}
+
+// Topic metadata, retried unless the topic does not exist, which waiting
+// is unlikely to fix
+func getTopicMetadataRetried(client *kgo.Client) (kadm.TopicDetail, string, error) {
+	var t kadm.TopicDetail
+	var cluster string
+	err := retry("metadata", func(err error) bool {
+		return !errors.Is(err, kerr.UnknownTopicOrPartition) && classifyError(err) != "other"
+	}, func() error {
+		var err error
+		t, cluster, err = getTopicMetadata(client)
+		return err
+	})
+	return t, cluster, err
+}
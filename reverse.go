@@ -0,0 +1,41 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// With --seq_read_reverse, sequential reads work back from the end of each
+// partition: seek to --reverse_chunk records before where the last chunk
+// started, and read forwards up to it.  Every seek lands somewhere new, so
+// remote reads go through index lookups and cache misses that a forward
+// scan, which mostly reads on from where it was, never hits.
+
+func reverseRead(nPartitions int32, start []int64, end []int64, strict bool, disruption *DisruptionTracker) {
+	chunkStart := make([]int64, nPartitions)
+	chunkEnd := append([]int64{}, end...)
+	for round := 0; ; round++ {
+		remaining := false
+		for p := int32(0); p < nPartitions; p++ {
+			chunkStart[p] = chunkEnd[p] - *reverseChunk
+			if chunkStart[p] < start[p] {
+				chunkStart[p] = start[p]
+			}
+			if chunkEnd[p] > chunkStart[p] && ownsPartition(p) {
+				remaining = true
+			}
+		}
+		if !remaining {
+			break
+		}
+		log.Debugf("Reverse read round %d: %v-%v", round, chunkStart, chunkEnd)
+
+		var expectNext []int64
+		if strict {
+			// Each chunk must read back contiguously from its start
+			expectNext = append([]int64{}, chunkStart...)
+		}
+		sequentialReadRange(nPartitions, append([]int64{}, chunkStart...), chunkEnd, expectNext, disruption)
+
+		copy(chunkEnd, chunkStart)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// A topic that many runs have written to over time holds records from
+// all of them.  With --run_headers, each record we produce carries headers
+// naming the run, the verifier version and the host, and readers
+// count what they validate by run, so that problems can be traced to the
+// run that wrote the records, whichever run reads them.
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const (
+	runHeader     = "si-verifier-run"
+	versionHeader = "si-verifier-version"
+	hostHeader    = "si-verifier-host"
+)
+
+// Who wrote a run's records, and what became of them on read
+type RunStats struct {
+	Version string
+	Host    string
+	// Records validated, and those that failed
+	Records int64
+	Corrupt int64 `json:",omitempty"`
+}
+
+// This run's identity, as stamped on its records.  The ID is --run_id, or a
+// UUID if that is not set, and is the same one that payloads, heartbeats and
+// pushed metrics carry.
+type RunInfo struct {
+	ID      string
+	Version string
+	Host    string
+}
+
+var (
+	runInfoOnce sync.Once
+	runInfo     RunInfo
+	runHeaders  []kgo.RecordHeader
+)
+
+func thisRun() RunInfo {
+	runInfoOnce.Do(func() {
+		id := *runId
+		if len(id) == 0 {
+			var u [16]byte
+			if _, err := rand.Read(u[:]); err != nil {
+				log.Warnf("Error generating run ID: %v", err)
+			}
+			// A version 4 UUID
+			u[6] = u[6]&0x0f | 0x40
+			u[8] = u[8]&0x3f | 0x80
+			id = fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+		}
+		host, err := os.Hostname()
+		if err != nil {
+			host = "unknown"
+		}
+		runInfo = RunInfo{
+			ID:      id,
+			Version: version,
+			Host:    host,
+		}
+		runHeaders = []kgo.RecordHeader{
+			{Key: runHeader, Value: []byte(runInfo.ID)},
+			{Key: versionHeader, Value: []byte(runInfo.Version)},
+			{Key: hostHeader, Value: []byte(runInfo.Host)},
+		}
+	})
+	return runInfo
+}
+
+// Stamp a record with this run's headers, with --run_headers
+func stampRunHeaders(r *kgo.Record) {
+	if !*runHeadersFlag {
+		return
+	}
+	thisRun()
+	r.Headers = append(r.Headers, runHeaders...)
+}
+
+// The run a record says it came from, if it says
+func recordRun(r *kgo.Record) (RunInfo, bool) {
+	var ri RunInfo
+	found := false
+	for _, h := range r.Headers {
+		switch h.Key {
+		case runHeader:
+			ri.ID = string(h.Value)
+			found = true
+		case versionHeader:
+			ri.Version = string(h.Value)
+		case hostHeader:
+			ri.Host = string(h.Value)
+		}
+	}
+	return ri, found
+}
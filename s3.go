@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Minimal S3 client, signing requests with AWS signature V4.  This is
+// enough to list a bucket and fetch objects from AWS S3, MinIO, or GCS
+// through its S3 interoperability endpoint (storage.googleapis.com, with
+// HMAC keys), without pulling in a cloud SDK.
+type S3Client struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3Client() *S3Client {
+	if len(*s3Bucket) == 0 {
+		Die("--s3_bucket is required")
+	}
+
+	accessKey := *s3AccessKey
+	if len(accessKey) == 0 {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	secretKey := *s3SecretKey
+	if len(secretKey) == 0 {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	endpoint := *s3Endpoint
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", *s3Region)
+	} else if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "http://" + endpoint
+	}
+
+	return &S3Client{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		bucket:    *s3Bucket,
+		region:    *s3Region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Percent-encode per RFC 3986, as SigV4 requires (url.QueryEscape encodes
+// spaces as '+', which S3 will not accept in a signature)
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign a GET request with SigV4, given its escaped path and query
+func (s *S3Client) sign(req *http.Request, path string, rawQuery string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := hex.EncodeToString(sha256.New().Sum(nil))
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		"GET",
+		path,
+		rawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+s.secretKey), date), s.region), "s3"), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3Client) get(key string, query url.Values) ([]byte, error) {
+	path := "/" + s3Escape(s.bucket, false) + "/" + s3Escape(key, true)
+	if len(key) == 0 {
+		path = "/" + s3Escape(s.bucket, false)
+	}
+
+	var queryParts []string
+	for k, vs := range query {
+		for _, v := range vs {
+			queryParts = append(queryParts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(queryParts)
+	rawQuery := strings.Join(queryParts, "&")
+
+	u, err := url.Parse(s.endpoint + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = rawQuery
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.accessKey) > 0 {
+		s.sign(req, path, rawQuery, time.Now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("GET %s: %s: %s", u.String(), resp.Status, string(body))
+	}
+	return body, nil
+}
+
+type S3Object struct {
+	Key  string
+	Size int64
+}
+
+type s3ListResult struct {
+	Contents              []S3Object
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List every object in the bucket under a prefix, following continuations
+func (s *S3Client) List(prefix string) ([]S3Object, error) {
+	var objects []S3Object
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if len(prefix) > 0 {
+			query.Set("prefix", prefix)
+		}
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+
+		body, err := s.get("", query)
+		if err != nil {
+			return nil, err
+		}
+		var page s3ListResult
+		if err := xml.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		objects = append(objects, page.Contents...)
+
+		if !page.IsTruncated {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *S3Client) Get(key string) ([]byte, error) {
+	return s.get(key, nil)
+}
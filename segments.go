@@ -0,0 +1,176 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Off-by-one bugs in tiered storage cluster around segment boundaries:
+// the first and last offsets of a remote segment, and reads that start in
+// one segment and continue into the next.  With --rand_read_segments,
+// random reads target exactly those offsets, using the segment layout from
+// the partition manifests in object storage.
+
+// A remote segment's span in Kafka offsets, inclusive
+type SegmentSpan struct {
+	Name  string
+	Lower int64
+	Upper int64
+	// The segment's object key, and its first offset's delta from Redpanda
+	// log offsets to Kafka offsets
+	Key   string
+	Delta int64
+}
+
+// How much validation each segment received
+type SegmentCoverage struct {
+	Partition int32
+	Segment   string
+	Lower     int64
+	Upper     int64
+	Reads     int64
+	Records   int64
+}
+
+type SegmentIndex struct {
+	lock       sync.Mutex
+	partitions map[int32][]SegmentSpan
+	coverage   map[int32][]SegmentCoverage
+}
+
+var (
+	segmentIndex     *SegmentIndex
+	segmentIndexOnce sync.Once
+)
+
+// The segment layout of our topic, loaded on first use and shared by all
+// random readers
+func getSegmentIndex() *SegmentIndex {
+	segmentIndexOnce.Do(func() {
+		manifests, segmentKeys := loadManifests(NewS3Client())
+		si := &SegmentIndex{
+			partitions: make(map[int32][]SegmentSpan),
+			coverage:   make(map[int32][]SegmentCoverage),
+		}
+		total := 0
+		for p, m := range manifests {
+			var spans []SegmentSpan
+			for name, s := range m.Segments {
+				spans = append(spans, SegmentSpan{
+					Name:  name,
+					Lower: s.BaseOffset - s.DeltaOffset,
+					Upper: s.CommittedOffset - s.DeltaOffset,
+					Key:   segmentKeys[segmentObjectKey(p, m.Revision, name)],
+					Delta: s.DeltaOffset,
+				})
+			}
+			sort.Slice(spans, func(i, j int) bool {
+				return spans[i].Lower < spans[j].Lower
+			})
+			si.partitions[p] = spans
+			for _, s := range spans {
+				si.coverage[p] = append(si.coverage[p], SegmentCoverage{
+					Partition: p,
+					Segment:   s.Name,
+					Lower:     s.Lower,
+					Upper:     s.Upper,
+				})
+			}
+			total += len(spans)
+		}
+		log.Infof("Loaded %d remote segments across %d partitions", total, len(manifests))
+		segmentIndex = si
+	})
+	return segmentIndex
+}
+
+// Index of the segment containing an offset, or -1
+func (si *SegmentIndex) find(p int32, o int64) int {
+	spans := si.partitions[p]
+	i := sort.Search(len(spans), func(i int) bool {
+		return spans[i].Upper >= o
+	})
+	if i < len(spans) && spans[i].Lower <= o {
+		return i
+	}
+	return -1
+}
+
+// Pick a read offset at a segment boundary within [pStart, pEnd): a
+// segment's first or last offset, or (for reads of more than one record)
+// an offset from which a read of `batch` records crosses into the next
+// segment.
+func (si *SegmentIndex) choose(rng *rand.Rand, p int32, pStart int64, pEnd int64, batch int64) (int64, bool) {
+	var candidates []SegmentSpan
+	for _, s := range si.partitions[p] {
+		if s.Lower >= pStart && s.Upper < pEnd {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	s := candidates[rng.Intn(len(candidates))]
+
+	switch rng.Intn(3) {
+	case 0:
+		return s.Lower, true
+	case 1:
+		return s.Upper, true
+	default:
+		o := s.Upper - (batch-1)/2
+		if o < s.Lower {
+			o = s.Lower
+		}
+		return o, true
+	}
+}
+
+func (si *SegmentIndex) NoteRead(p int32, o int64) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	if i := si.find(p, o); i >= 0 {
+		si.coverage[p][i].Reads += 1
+	}
+}
+
+func (si *SegmentIndex) NoteRecord(p int32, o int64) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	if i := si.find(p, o); i >= 0 {
+		si.coverage[p][i].Records += 1
+	}
+}
+
+// Log how many segments were validated, and record per-segment coverage
+// in the results
+func (si *SegmentIndex) Report() {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+
+	var all []SegmentCoverage
+	covered := 0
+	for _, segments := range si.coverage {
+		for _, c := range segments {
+			if c.Records > 0 {
+				covered += 1
+			}
+			all = append(all, c)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Partition != all[j].Partition {
+			return all[i].Partition < all[j].Partition
+		}
+		return all[i].Lower < all[j].Lower
+	})
+	for _, c := range all {
+		log.Debugf("Segment %s/%d %s (%d-%d): %d reads, %d records validated",
+			*topic, c.Partition, c.Segment, c.Lower, c.Upper, c.Reads, c.Records)
+	}
+	log.Infof("Validated records in %d/%d remote segments", covered, len(all))
+	results.SetSegmentCoverage(all)
+}
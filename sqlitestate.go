@@ -0,0 +1,439 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// With --state_backend=sqlite, the valid offsets state lives in a SQLite
+// database instead of a file that is rewritten whole on every store: a
+// store writes only the rows that changed since the last one, in a single
+// transaction.  Ranges, checksums and produce times have tables of their
+// own, so the state can be queried directly, e.g. for how much of a
+// segment holding offsets [1000, 2000) of partition 3 we produced:
+//
+//	SELECT SUM(MIN(upper, 2000) - MAX(lower, 1000)) FROM ranges
+//	WHERE partition_id = 3 AND upper > 1000 AND lower < 2000;
+//
+// The rest of each partition's state is kept encoded in one row per
+// partition.  Only one process may write the database at a time, which
+// the produce lock sees to.  The driver needs cgo: builds without it have
+// only the stubs in sqlitestate_nocgo.go.
+const sqliteAvailable = true
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS topic (
+	id INTEGER PRIMARY KEY CHECK (id = 0),
+	cluster_id TEXT NOT NULL,
+	topic_id TEXT NOT NULL,
+	produce_epoch INTEGER NOT NULL,
+	partitions INTEGER NOT NULL,
+	keys BLOB
+);
+CREATE TABLE IF NOT EXISTS ranges (
+	partition_id INTEGER NOT NULL,
+	lower INTEGER NOT NULL,
+	upper INTEGER NOT NULL,
+	epoch INTEGER NOT NULL,
+	PRIMARY KEY (partition_id, lower)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS checksums (
+	partition_id INTEGER NOT NULL,
+	record_offset INTEGER NOT NULL,
+	checksum INTEGER NOT NULL,
+	PRIMARY KEY (partition_id, record_offset)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS produce_times (
+	partition_id INTEGER NOT NULL,
+	record_offset INTEGER NOT NULL,
+	sent_ms INTEGER NOT NULL,
+	acked_ms INTEGER NOT NULL,
+	PRIMARY KEY (partition_id, record_offset)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS partitions (
+	partition_id INTEGER PRIMARY KEY,
+	state BLOB NOT NULL
+);
+`
+
+// What we last read from or wrote to a database, to work out what a store
+// needs to change
+type sqliteShadow struct {
+	ranges       map[int32]map[int64]OffsetRange
+	checksummed  map[int32][]OffsetRange
+	produceTimes map[int32]map[int64]ProduceTime
+	rest         map[int32][]byte
+	keys         []byte
+}
+
+func newSqliteShadow() *sqliteShadow {
+	return &sqliteShadow{
+		ranges:       make(map[int32]map[int64]OffsetRange),
+		checksummed:  make(map[int32][]OffsetRange),
+		produceTimes: make(map[int32]map[int64]ProduceTime),
+		rest:         make(map[int32][]byte),
+	}
+}
+
+// Open databases and their shadows, by path
+var (
+	sqliteLock    sync.Mutex
+	sqliteDBs     = make(map[string]*sql.DB)
+	sqliteShadows = make(map[string]*sqliteShadow)
+)
+
+// The caller holds sqliteLock
+func openSqliteState(path string) (*sql.DB, error) {
+	if db, ok := sqliteDBs[path]; ok {
+		return db, nil
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=10000", path))
+	if err != nil {
+		return nil, err
+	}
+	// One connection, so that every store sees the last one's writes
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables in %s: %w", path, err)
+	}
+	sqliteDBs[path] = db
+	return db, nil
+}
+
+// The keyed mode maps, which are only ever needed whole
+type sqliteKeys struct {
+	KeyPartitions map[string][]int32
+	KeyLatest     map[string]KeyVersion
+}
+
+// A partition's state, less what has tables of its own
+func sqliteRest(ors *OffsetRanges) ([]byte, error) {
+	rest := *ors
+	rest.Ranges = nil
+	rest.Checksums = nil
+	rest.ProduceTimes = nil
+	return encodeState(&rest, stateFormatBinary)
+}
+
+func checksumCoverage(runs []ChecksumRun) []OffsetRange {
+	covered := make([]OffsetRange, 0, len(runs))
+	for _, cr := range runs {
+		if n := len(covered); n > 0 && covered[n-1].Upper == cr.Base {
+			covered[n-1].Upper = cr.upper()
+		} else if len(cr.Sums) > 0 {
+			covered = append(covered, OffsetRange{Lower: cr.Base, Upper: cr.upper()})
+		}
+	}
+	return covered
+}
+
+// The offsets in sorted, disjoint intervals a that are not in b
+func subtractIntervals(a []OffsetRange, b []OffsetRange) []OffsetRange {
+	var out []OffsetRange
+	j := 0
+	for _, r := range a {
+		lower := r.Lower
+		for j < len(b) && b[j].Upper <= lower {
+			j++
+		}
+		for k := j; k < len(b) && b[k].Lower < r.Upper; k++ {
+			if b[k].Lower > lower {
+				out = append(out, OffsetRange{Lower: lower, Upper: b[k].Lower})
+			}
+			if b[k].Upper > lower {
+				lower = b[k].Upper
+			}
+		}
+		if lower < r.Upper {
+			out = append(out, OffsetRange{Lower: lower, Upper: r.Upper})
+		}
+	}
+	return out
+}
+
+func readSqliteState(path string) (TopicOffsetRanges, error) {
+	sqliteLock.Lock()
+	defer sqliteLock.Unlock()
+	var tors TopicOffsetRanges
+	db, err := openSqliteState(path)
+	if err != nil {
+		return tors, err
+	}
+	shadow := newSqliteShadow()
+
+	var nPartitions int32
+	err = db.QueryRow("SELECT cluster_id, topic_id, produce_epoch, partitions, keys FROM topic WHERE id = 0").
+		Scan(&tors.ClusterID, &tors.TopicID, &tors.ProduceEpoch, &nPartitions, &shadow.keys)
+	if err == sql.ErrNoRows {
+		// Created, but nothing stored yet
+		sqliteShadows[path] = shadow
+		return tors, nil
+	} else if err != nil {
+		return tors, err
+	}
+	if len(shadow.keys) > 0 {
+		var keys sqliteKeys
+		if err := decodeState(shadow.keys, &keys); err != nil {
+			return tors, fmt.Errorf("bad keys: %w", err)
+		}
+		tors.KeyPartitions = keys.KeyPartitions
+		tors.KeyLatest = keys.KeyLatest
+	}
+	tors.PartitionRanges = make([]OffsetRanges, nPartitions)
+	inRange := func(p int32) error {
+		if p < 0 || p >= nPartitions {
+			return fmt.Errorf("row for partition %d of %d", p, nPartitions)
+		}
+		return nil
+	}
+
+	rows, err := db.Query("SELECT partition_id, state FROM partitions")
+	if err != nil {
+		return tors, err
+	}
+	for rows.Next() {
+		var p int32
+		var data []byte
+		if err := rows.Scan(&p, &data); err != nil {
+			rows.Close()
+			return tors, err
+		}
+		if err := inRange(p); err != nil {
+			rows.Close()
+			return tors, err
+		}
+		if err := decodeState(data, &tors.PartitionRanges[p]); err != nil {
+			rows.Close()
+			return tors, fmt.Errorf("bad state for partition %d: %w", p, err)
+		}
+		shadow.rest[p] = data
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT partition_id, lower, upper, epoch FROM ranges ORDER BY partition_id, lower")
+	if err != nil {
+		return tors, err
+	}
+	for rows.Next() {
+		var p int32
+		var r OffsetRange
+		if err := rows.Scan(&p, &r.Lower, &r.Upper, &r.Epoch); err != nil {
+			rows.Close()
+			return tors, err
+		}
+		if err := inRange(p); err != nil {
+			rows.Close()
+			return tors, err
+		}
+		tors.PartitionRanges[p].Ranges = append(tors.PartitionRanges[p].Ranges, r)
+		if shadow.ranges[p] == nil {
+			shadow.ranges[p] = make(map[int64]OffsetRange)
+		}
+		shadow.ranges[p][r.Lower] = r
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT partition_id, record_offset, checksum FROM checksums ORDER BY partition_id, record_offset")
+	if err != nil {
+		return tors, err
+	}
+	for rows.Next() {
+		var p int32
+		var o int64
+		var sum uint32
+		if err := rows.Scan(&p, &o, &sum); err != nil {
+			rows.Close()
+			return tors, err
+		}
+		if err := inRange(p); err != nil {
+			rows.Close()
+			return tors, err
+		}
+		tors.PartitionRanges[p].NoteChecksum(o, sum)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT partition_id, record_offset, sent_ms, acked_ms FROM produce_times ORDER BY partition_id, record_offset")
+	if err != nil {
+		return tors, err
+	}
+	for rows.Next() {
+		var p int32
+		var pt ProduceTime
+		if err := rows.Scan(&p, &pt.Offset, &pt.Sent, &pt.Acked); err != nil {
+			rows.Close()
+			return tors, err
+		}
+		if err := inRange(p); err != nil {
+			rows.Close()
+			return tors, err
+		}
+		tors.PartitionRanges[p].ProduceTimes = append(tors.PartitionRanges[p].ProduceTimes, pt)
+		if shadow.produceTimes[p] == nil {
+			shadow.produceTimes[p] = make(map[int64]ProduceTime)
+		}
+		shadow.produceTimes[p][pt.Offset] = pt
+	}
+	rows.Close()
+
+	for p := range tors.PartitionRanges {
+		shadow.checksummed[int32(p)] = checksumCoverage(tors.PartitionRanges[p].Checksums)
+	}
+	sqliteShadows[path] = shadow
+	return tors, nil
+}
+
+func (tors *TopicOffsetRanges) storeSqlite(path string) error {
+	sqliteLock.Lock()
+	shadow := sqliteShadows[path]
+	sqliteLock.Unlock()
+	if shadow == nil {
+		// Find out what is there already
+		if _, err := readSqliteState(path); err != nil {
+			return err
+		}
+	}
+
+	sqliteLock.Lock()
+	defer sqliteLock.Unlock()
+	db, err := openSqliteState(path)
+	if err != nil {
+		return err
+	}
+	shadow = sqliteShadows[path]
+	// The shadow only becomes what we stored once the transaction commits
+	next := newSqliteShadow()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	keys, err := encodeState(&sqliteKeys{KeyPartitions: tors.KeyPartitions, KeyLatest: tors.KeyLatest}, stateFormatBinary)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(keys, shadow.keys) {
+		_, err = tx.Exec(`INSERT INTO topic (id, cluster_id, topic_id, produce_epoch, partitions) VALUES (0, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET cluster_id = excluded.cluster_id, topic_id = excluded.topic_id,
+			produce_epoch = excluded.produce_epoch, partitions = excluded.partitions`,
+			tors.ClusterID, tors.TopicID, tors.ProduceEpoch, len(tors.PartitionRanges))
+	} else {
+		_, err = tx.Exec("INSERT OR REPLACE INTO topic (id, cluster_id, topic_id, produce_epoch, partitions, keys) VALUES (0, ?, ?, ?, ?, ?)",
+			tors.ClusterID, tors.TopicID, tors.ProduceEpoch, len(tors.PartitionRanges), keys)
+	}
+	if err != nil {
+		return err
+	}
+	next.keys = keys
+
+	for i := range tors.PartitionRanges {
+		p := int32(i)
+		ors := &tors.PartitionRanges[p]
+
+		rest, err := sqliteRest(ors)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(rest, shadow.rest[p]) {
+			if _, err := tx.Exec("INSERT OR REPLACE INTO partitions (partition_id, state) VALUES (?, ?)", p, rest); err != nil {
+				return err
+			}
+		}
+		next.rest[p] = rest
+
+		// Ranges mostly grow at the end, so few rows change
+		ranges := make(map[int64]OffsetRange, len(ors.Ranges))
+		for _, r := range ors.Ranges {
+			ranges[r.Lower] = r
+			if old, ok := shadow.ranges[p][r.Lower]; ok && old == r {
+				continue
+			}
+			if _, err := tx.Exec("INSERT OR REPLACE INTO ranges (partition_id, lower, upper, epoch) VALUES (?, ?, ?, ?)",
+				p, r.Lower, r.Upper, r.Epoch); err != nil {
+				return err
+			}
+		}
+		for lower := range shadow.ranges[p] {
+			if _, ok := ranges[lower]; !ok {
+				if _, err := tx.Exec("DELETE FROM ranges WHERE partition_id = ? AND lower = ?", p, lower); err != nil {
+					return err
+				}
+			}
+		}
+		next.ranges[p] = ranges
+
+		// The checksum of an offset never changes, so only offsets that
+		// came or went need a write
+		covered := checksumCoverage(ors.Checksums)
+		for _, gone := range subtractIntervals(shadow.checksummed[p], covered) {
+			if _, err := tx.Exec("DELETE FROM checksums WHERE partition_id = ? AND record_offset >= ? AND record_offset < ?",
+				p, gone.Lower, gone.Upper); err != nil {
+				return err
+			}
+		}
+		for _, added := range subtractIntervals(covered, shadow.checksummed[p]) {
+			for o := added.Lower; o < added.Upper; o++ {
+				sum, _ := ors.LookupChecksum(o)
+				if _, err := tx.Exec("INSERT OR REPLACE INTO checksums (partition_id, record_offset, checksum) VALUES (?, ?, ?)",
+					p, o, sum); err != nil {
+					return err
+				}
+			}
+		}
+		next.checksummed[p] = covered
+
+		times := make(map[int64]ProduceTime, len(ors.ProduceTimes))
+		for _, pt := range ors.ProduceTimes {
+			times[pt.Offset] = pt
+			if old, ok := shadow.produceTimes[p][pt.Offset]; ok && old == pt {
+				continue
+			}
+			if _, err := tx.Exec("INSERT OR REPLACE INTO produce_times (partition_id, record_offset, sent_ms, acked_ms) VALUES (?, ?, ?, ?)",
+				p, pt.Offset, pt.Sent, pt.Acked); err != nil {
+				return err
+			}
+		}
+		for o := range shadow.produceTimes[p] {
+			if _, ok := times[o]; !ok {
+				if _, err := tx.Exec("DELETE FROM produce_times WHERE partition_id = ? AND record_offset = ?", p, o); err != nil {
+					return err
+				}
+			}
+		}
+		next.produceTimes[p] = times
+	}
+
+	// Partitions beyond the ones we have, e.g. from a merge that shrank
+	for _, table := range []string{"ranges", "checksums", "produce_times", "partitions"} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE partition_id >= ?", table), len(tors.PartitionRanges)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	sqliteShadows[path] = next
+	return nil
+}
+
+// Forget a database, e.g. before deleting it
+func closeSqliteState(path string) {
+	sqliteLock.Lock()
+	defer sqliteLock.Unlock()
+	if db, ok := sqliteDBs[path]; ok {
+		db.Close()
+		delete(sqliteDBs, path)
+	}
+	delete(sqliteShadows, path)
+}
@@ -0,0 +1,24 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"errors"
+)
+
+// The SQLite driver needs cgo, so without it --state_backend=sqlite is
+// rejected at startup, and databases found on load can't be read
+const sqliteAvailable = false
+
+var errNoSqlite = errors.New("this build has no SQLite support: rebuild with CGO_ENABLED=1")
+
+func readSqliteState(path string) (TopicOffsetRanges, error) {
+	return TopicOffsetRanges{}, errNoSqlite
+}
+
+func (tors *TopicOffsetRanges) storeSqlite(path string) error {
+	return errNoSqlite
+}
+
+func closeSqliteState(path string) {}
@@ -0,0 +1,109 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSubtractIntervals(t *testing.T) {
+	r := func(lower, upper int64) OffsetRange { return OffsetRange{Lower: lower, Upper: upper} }
+	cases := []struct {
+		name string
+		a, b []OffsetRange
+		want []OffsetRange
+	}{
+		{"nothing to take away", []OffsetRange{r(0, 10)}, nil, []OffsetRange{r(0, 10)}},
+		{"all taken away", []OffsetRange{r(0, 10)}, []OffsetRange{r(0, 10)}, nil},
+		{"grown at the end", []OffsetRange{r(0, 15)}, []OffsetRange{r(0, 10)}, []OffsetRange{r(10, 15)}},
+		{"trimmed at the start", []OffsetRange{r(0, 10)}, []OffsetRange{r(4, 10)}, []OffsetRange{r(0, 4)}},
+		{"hole in the middle", []OffsetRange{r(0, 10)}, []OffsetRange{r(3, 5)}, []OffsetRange{r(0, 3), r(5, 10)}},
+		{"several", []OffsetRange{r(0, 10), r(20, 30)}, []OffsetRange{r(5, 25)}, []OffsetRange{r(0, 5), r(25, 30)}},
+		{"disjoint", []OffsetRange{r(10, 20)}, []OffsetRange{r(0, 5), r(25, 30)}, []OffsetRange{r(10, 20)}},
+	}
+	for _, c := range cases {
+		if got := subtractIntervals(c.a, c.b); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func sqliteRowCount(t *testing.T, path string, table string) int {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSqliteStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.sqlite")
+	defer closeSqliteState(path)
+
+	tors := TopicOffsetRanges{ClusterID: "c", TopicID: "t", ProduceEpoch: 3, PartitionRanges: make([]OffsetRanges, 2)}
+	for o := int64(0); o < 10; o++ {
+		tors.Insert(0, o)
+		tors.PartitionRanges[0].NoteChecksum(o, uint32(o*7))
+	}
+	tors.Insert(1, 20)
+	tors.PartitionRanges[1].Tombstones = []int64{20}
+	tors.PartitionRanges[1].ProduceTimes = []ProduceTime{{Offset: 20, Sent: 1000, Acked: 1005}}
+	tors.KeyLatest = map[string]KeyVersion{"k": {Partition: 1, Offset: 20}}
+	if err := tors.storeSqlite(path); err != nil {
+		t.Fatal(err)
+	}
+	if !isSqliteFile(path) {
+		t.Fatalf("%s not detected as SQLite", path)
+	}
+
+	// Read back through a fresh shadow, as another process would
+	closeSqliteState(path)
+	loaded, shardErrs, err := readState(path)
+	if err != nil || shardErrs != nil {
+		t.Fatalf("readState: %v %v", err, shardErrs)
+	}
+	if !reflect.DeepEqual(loaded, tors) {
+		t.Fatalf("loaded %+v, stored %+v", loaded, tors)
+	}
+
+	// Growing and trimming only touches the rows that changed
+	for o := int64(10); o < 15; o++ {
+		loaded.Insert(0, o)
+		loaded.PartitionRanges[0].NoteChecksum(o, uint32(o*7))
+	}
+	loaded.PartitionRanges[0].TrimBelow(4)
+	loaded.ProduceEpoch = 4
+	if err := loaded.storeSqlite(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := sqliteRowCount(t, path, "checksums"); n != 11 {
+		t.Errorf("%d checksum rows, want 11", n)
+	}
+	if n := sqliteRowCount(t, path, "ranges"); n != 2 {
+		t.Errorf("%d range rows, want 2", n)
+	}
+
+	closeSqliteState(path)
+	reloaded, _, err := readState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reloaded, loaded) {
+		t.Fatalf("reloaded %+v, stored %+v", reloaded, loaded)
+	}
+	if sum, ok := reloaded.PartitionRanges[0].LookupChecksum(12); !ok || sum != 84 {
+		t.Errorf("checksum at 12: %d %v", sum, ok)
+	}
+	if _, ok := reloaded.PartitionRanges[0].LookupChecksum(3); ok {
+		t.Errorf("checksum at 3 survived the trim")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// With --state_layout=dir, the valid offsets state is a directory rather
+// than one file: "topic" holds the topic-wide state (identity, produce
+// epoch, keys), and "partition-N" the ranges of partition N.  Verifiers
+// sharing a topic through --partitions or distributed mode each write only
+// the partitions they own, so they don't overwrite one another's ranges,
+// and a damaged partition file costs only that partition: it is reported,
+// left as it is for inspection, and not produced to or validated.
+const (
+	stateLayoutFile = "file"
+	stateLayoutDir  = "dir"
+
+	stateTopicFile      = "topic"
+	statePartitionStart = "partition-"
+)
+
+type StateShardError struct {
+	Partition int32
+	File      string
+	Error     string
+}
+
+// Partitions whose state files we could not read this run
+var (
+	corruptStateShards     = make(map[int32]error)
+	corruptStateShardsLock sync.Mutex
+)
+
+func isStateDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+func statePartitionFile(dir string, p int32) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d", statePartitionStart, p))
+}
+
+// Replace a file via a rename, so that readers (and other verifiers) never
+// see it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := fmt.Sprintf("%s.tmp.%d", path, os.Getpid())
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (tors *TopicOffsetRanges) storeDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := tors.storeTopicFile(dir); err != nil {
+		return err
+	}
+
+	corruptStateShardsLock.Lock()
+	defer corruptStateShardsLock.Unlock()
+	for i := range tors.PartitionRanges {
+		p := int32(i)
+		if !ownsPartition(p) || corruptStateShards[p] != nil {
+			continue
+		}
+		data, err := encodeState(&tors.PartitionRanges[p], *stateFormat)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(statePartitionFile(dir, p), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Take the lock that serializes updates of a state directory's topic file
+func lockStateTopic(dir string) (func(), error) {
+	name := filepath.Join(dir, stateTopicFile+".lock")
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, true); err == errNoFileLocks {
+		warnNoFileLocks()
+		f.Close()
+		return func() {}, nil
+	} else if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking %s: %w", name, err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// The topic-wide state in a state directory, empty if there is none yet
+func readTopicFile(dir string) (TopicOffsetRanges, error) {
+	var tors TopicOffsetRanges
+	path := filepath.Join(dir, stateTopicFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return tors, nil
+	} else if err != nil {
+		return tors, err
+	}
+	if err := decodeState(data, &tors); err != nil {
+		return tors, fmt.Errorf("%s: %w", path, err)
+	}
+	return tors, nil
+}
+
+// Every verifier sharing the directory rewrites the topic file, so we do
+// it under a lock, merged with what is already there: the produce epoch
+// never goes backwards, and keys others have written are kept.
+func (tors *TopicOffsetRanges) storeTopicFile(dir string) error {
+	unlock, err := lockStateTopic(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return tors.writeTopicFile(dir)
+}
+
+// Take the next produce epoch in a state directory, which other verifiers
+// may be taking at the same time, and store it
+func (tors *TopicOffsetRanges) claimDirProduceEpoch(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	unlock, err := lockStateTopic(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	onDisk, err := readTopicFile(dir)
+	if err != nil {
+		return err
+	}
+	if onDisk.ProduceEpoch > tors.ProduceEpoch {
+		tors.ProduceEpoch = onDisk.ProduceEpoch
+	}
+	tors.ProduceEpoch += 1
+	keyPartitionsLock.Lock()
+	defer keyPartitionsLock.Unlock()
+	return tors.writeTopicFile(dir)
+}
+
+// As storeTopicFile, with the lock already held.  The caller also holds
+// keyPartitionsLock, as the key maps are encoded, and merged into.
+func (tors *TopicOffsetRanges) writeTopicFile(dir string) error {
+	topicState := *tors
+	topicState.PartitionRanges = nil
+	if onDisk, err := readTopicFile(dir); err != nil {
+		log.Warnf("Replacing unreadable state: %v", err)
+	} else {
+		if onDisk.ProduceEpoch > topicState.ProduceEpoch {
+			topicState.ProduceEpoch = onDisk.ProduceEpoch
+		}
+		mergeKeyPartitions(&topicState, &onDisk)
+	}
+	data, err := encodeState(&topicState, *stateFormat)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, stateTopicFile), data)
+}
+
+// Read state in either layout.  In the directory layout, partition files
+// that can't be read are returned as errors by partition, rather than
+// failing the whole load.
+func readState(path string) (TopicOffsetRanges, map[int32]error, error) {
+	var tors TopicOffsetRanges
+	if isSqliteFile(path) {
+		tors, err := readSqliteState(path)
+		return tors, nil, err
+	} else if !isStateDir(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return tors, nil, err
+		}
+		if len(data) > 0 {
+			err = decodeState(data, &tors)
+		}
+		return tors, nil, err
+	}
+
+	tors, err := readTopicFile(path)
+	if err != nil {
+		return tors, nil, err
+	}
+	tors.PartitionRanges = nil
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return tors, nil, err
+	}
+	var shardErrs map[int32]error
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), statePartitionStart) {
+			continue
+		}
+		p, err := strconv.ParseInt(strings.TrimPrefix(e.Name(), statePartitionStart), 10, 32)
+		if err != nil || p < 0 {
+			// e.g. a temporary file left by a verifier that died mid-write
+			continue
+		}
+		for int64(len(tors.PartitionRanges)) <= p {
+			tors.PartitionRanges = append(tors.PartitionRanges, OffsetRanges{})
+		}
+		data, err := ioutil.ReadFile(filepath.Join(path, e.Name()))
+		if err == nil {
+			err = decodeState(data, &tors.PartitionRanges[p])
+		}
+		if err != nil {
+			if shardErrs == nil {
+				shardErrs = make(map[int32]error)
+			}
+			shardErrs[int32(p)] = err
+			tors.PartitionRanges[p] = OffsetRanges{}
+		}
+	}
+	return tors, shardErrs, nil
+}
+
+// Stop working on a partition whose state we lost, the first time we see it
+func dropCorruptStateShard(nPartitions int32, dir string, p int32, err error) {
+	corruptStateShardsLock.Lock()
+	defer corruptStateShardsLock.Unlock()
+	if corruptStateShards[p] != nil {
+		return
+	}
+	corruptStateShards[p] = err
+
+	file := statePartitionFile(dir, p)
+	log.Errorf("Bad state file %s, not producing to or validating %s/%d: %v", file, *topic, p, err)
+	results.AddStateShardError(StateShardError{Partition: p, File: file, Error: err.Error()})
+
+	remaining := make([]int32, 0)
+	for q := int32(0); q < nPartitions; q++ {
+		if q != p && ownsPartition(q) {
+			remaining = append(remaining, q)
+		}
+	}
+	if len(remaining) == 0 {
+		Die("No partitions left to work on with readable state")
+	}
+	ownedPartitionsLock.Lock()
+	ownedPartitions = remaining
+	ownedPartitionsLock.Unlock()
+}
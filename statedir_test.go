@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeStateFile(t *testing.T, path string, v interface{}) {
+	data, err := encodeState(v, stateFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadStateDir(t *testing.T) {
+	dir := t.TempDir()
+	writeStateFile(t, filepath.Join(dir, stateTopicFile), &TopicOffsetRanges{ProduceEpoch: 4})
+	good := OffsetRanges{Ranges: []OffsetRange{{Lower: 0, Upper: 10, Epoch: 4}}}
+	writeStateFile(t, statePartitionFile(dir, 0), &good)
+	writeStateFile(t, statePartitionFile(dir, 2), &good)
+	ioutil.WriteFile(statePartitionFile(dir, 1), []byte("{not json"), 0644)
+	// Siblings that aren't partition files: a write in progress, locks
+	ioutil.WriteFile(statePartitionFile(dir, 0)+".tmp.123", []byte("{"), 0644)
+	ioutil.WriteFile(statePartitionFile(dir, 5)+".lock", nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, stateTopicFile+".lock"), nil, 0644)
+
+	tors, shardErrs, err := readState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tors.ProduceEpoch != 4 {
+		t.Errorf("epoch %d, want 4", tors.ProduceEpoch)
+	}
+	if len(tors.PartitionRanges) != 3 {
+		t.Fatalf("%d partitions, want 3", len(tors.PartitionRanges))
+	}
+	if len(shardErrs) != 1 || shardErrs[1] == nil {
+		t.Errorf("shard errors %v, want partition 1 only", shardErrs)
+	}
+	if _, ok := tors.Lookup(2, 5); !ok {
+		t.Errorf("partition 2 ranges not loaded")
+	}
+	if len(tors.PartitionRanges[1].Ranges) != 0 {
+		t.Errorf("corrupt partition 1 has ranges %v", tors.PartitionRanges[1].Ranges)
+	}
+}
+
+func TestReadStateDirEmptyTopicFile(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, stateTopicFile), nil, 0644)
+	writeStateFile(t, statePartitionFile(dir, 0), &OffsetRanges{Ranges: []OffsetRange{{Lower: 0, Upper: 1}}})
+	tors, shardErrs, err := readState(dir)
+	if err != nil || shardErrs != nil {
+		t.Fatalf("readState: %v %v", err, shardErrs)
+	}
+	if tors.ProduceEpoch != 0 || len(tors.PartitionRanges) != 1 {
+		t.Errorf("loaded %+v", tors)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, stateTopicFile), []byte("garbage"), 0644)
+	if _, _, err := readState(dir); err == nil {
+		t.Errorf("corrupt topic file read without error")
+	}
+}
+
+// A verifier storing an older epoch must not take the topic file back
+func TestStoreTopicFileKeepsNewerEpoch(t *testing.T) {
+	dir := t.TempDir()
+	newer := TopicOffsetRanges{ProduceEpoch: 7, KeyLatest: map[string]KeyVersion{"a": {Partition: 0, Offset: 3}}}
+	if err := newer.storeTopicFile(dir); err != nil {
+		t.Fatal(err)
+	}
+	older := TopicOffsetRanges{ProduceEpoch: 5, KeyLatest: map[string]KeyVersion{"b": {Partition: 1, Offset: 1}}}
+	if err := older.storeTopicFile(dir); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTopicFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ProduceEpoch != 7 {
+		t.Errorf("epoch went back to %d", got.ProduceEpoch)
+	}
+	if len(got.KeyLatest) != 2 {
+		t.Errorf("keys %v, want both verifiers'", got.KeyLatest)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// Encodings for the offset-range state file.  Plain JSON is the default
+// and easiest to inspect, but gets very large on long runs against topics
+// with many partitions.  On load we detect the format from the content, so
+// changing --state_format between runs is safe.
+const (
+	stateFormatJSON   = "json"
+	stateFormatJSONGz = "json.gz"
+	// gzip-compressed encoding/gob: compact, and unlike a hand-rolled
+	// format it tolerates fields being added to the state structure.
+	stateFormatBinary = "binary"
+)
+
+// Where state is kept: in files, per --state_layout, or in a SQLite
+// database (see sqlitestate.go)
+const (
+	stateBackendFile   = "file"
+	stateBackendSqlite = "sqlite"
+)
+
+func validStateFormat(f string) bool {
+	return f == stateFormatJSON || f == stateFormatJSONGz || f == stateFormatBinary
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeState(v interface{}, format string) ([]byte, error) {
+	switch format {
+	case stateFormatJSONGz:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return gzipBytes(data)
+	case stateFormatBinary:
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+			return nil, err
+		}
+		return gzipBytes(buf.Bytes())
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func decodeState(data []byte, v interface{}) error {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		data, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return err
+		}
+	}
+
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return json.Unmarshal(data, v)
+	} else {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	}
+}
+
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// Databases are told apart from state files by their header, even in a
+// build that can't open them
+func isSqliteFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, len(sqliteMagic))
+	if _, err := f.Read(header); err != nil {
+		return false
+	}
+	return bytes.Equal(header, sqliteMagic)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStateFormatsRoundTrip(t *testing.T) {
+	tors := TopicOffsetRanges{
+		ClusterID:    "cluster",
+		TopicID:      "topic",
+		ProduceEpoch: 7,
+		PartitionRanges: []OffsetRanges{
+			{Ranges: []OffsetRange{{Lower: 0, Upper: 10, Epoch: 1}, {Lower: 12, Upper: 20, Epoch: 7}}, AckedUpper: 20, AckedEpoch: 3},
+			{Tombstones: []int64{4}, ValueSizes: []SizeRun{{Base: 0, Count: 5, Size: 100}}},
+		},
+		KeyLatest: map[string]KeyVersion{"k": {Partition: 1, Offset: 4, Tombstone: true}},
+	}
+
+	for _, format := range []string{stateFormatJSON, stateFormatJSONGz, stateFormatBinary} {
+		data, err := encodeState(&tors, format)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", format, err)
+		}
+		var decoded TopicOffsetRanges
+		if err := decodeState(data, &decoded); err != nil {
+			t.Fatalf("%s: decode: %v", format, err)
+		}
+		if !reflect.DeepEqual(decoded, tors) {
+			t.Errorf("%s: decoded %+v, want %+v", format, decoded, tors)
+		}
+	}
+}
+
+func TestDecodeStateDetectsFormat(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"json", []byte(`{"ProduceEpoch": 2}`), true},
+		{"json with leading whitespace", []byte("\n  {\"ProduceEpoch\": 2}"), true},
+		{"truncated gzip", []byte{0x1f, 0x8b, 0x08}, false},
+		{"garbage", []byte("not a state file"), false},
+	}
+	for _, c := range cases {
+		var tors TopicOffsetRanges
+		err := decodeState(c.data, &tors)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err %v, want ok=%v", c.name, err, c.ok)
+		} else if c.ok && tors.ProduceEpoch != 2 {
+			t.Errorf("%s: ProduceEpoch %d", c.name, tors.ProduceEpoch)
+		}
+	}
+}
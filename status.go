@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SIGQUIT writes everything we know about the run's progress to a file in
+// --status_dir and carries on, instead of Go's default of dumping stacks
+// and exiting, so that a run that is hung or crawling can be looked at in
+// place: reader positions, records in flight, what the state file holds,
+// the results so far and every goroutine's stack.
+
+// Records handed to the client and not yet acked
+var inflightRecords int64
+
+// Every watchdog whose reader is running, for reader positions
+var (
+	watchdogsLock sync.Mutex
+	watchdogs     = make(map[*Watchdog]struct{})
+)
+
+func handleStatusSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGQUIT)
+	go func() {
+		for range signals {
+			path, err := dumpStatus()
+			if err != nil {
+				log.Errorf("Error dumping status (SIGQUIT): %v", err)
+			} else {
+				log.Infof("Dumped status to %s (SIGQUIT)", path)
+			}
+		}
+	}()
+}
+
+func dumpStatus() (string, error) {
+	dir := *statusDir
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	now := time.Now()
+	path := filepath.Join(dir, fmt.Sprintf("si-verifier-status-%d-%s.txt", os.Getpid(), now.Format("20060102T150405")))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	fmt.Fprintf(w, "Status of si-verifier %s (pid %d) at %s\n", version, os.Getpid(), now.Format(time.RFC3339))
+	fmt.Fprintf(w, "Flags:%s\n", redactedFlags())
+	fmt.Fprintf(w, "Topic: %s\n", *topic)
+	fmt.Fprintf(w, "Records in flight: %d\n", atomic.LoadInt64(&inflightRecords))
+	fmt.Fprintf(w, "Production paused: %v\n", producePause.Paused())
+
+	fmt.Fprintf(w, "\n== Progress\n")
+	if progress == nil {
+		fmt.Fprintf(w, "Not tracked (--progress_interval unset)\n")
+	} else {
+		for i := range progress.partitions {
+			pp := &progress.partitions[i]
+			produced, validated := atomic.LoadInt64(&pp.Produced), atomic.LoadInt64(&pp.Validated)
+			if produced == 0 && validated == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "%s/%d produced %d (at %d), validated %d (at %d)\n", *topic, pp.Partition,
+				produced, atomic.LoadInt64(&pp.ProduceOffset), validated, atomic.LoadInt64(&pp.ReadOffset))
+		}
+	}
+
+	fmt.Fprintf(w, "\n== Readers\n")
+	watchdogsLock.Lock()
+	for wd := range watchdogs {
+		wd.lock.Lock()
+		fmt.Fprintf(w, "%s: last progress %v ago\n", wd.what, time.Since(wd.lastProgress).Round(time.Millisecond))
+		var partitions []int
+		for p := range wd.positions {
+			partitions = append(partitions, int(p))
+		}
+		sort.Ints(partitions)
+		for _, p := range partitions {
+			fmt.Fprintf(w, "  %s/%d position %d\n", *topic, p, wd.positions[int32(p)])
+		}
+		for _, e := range wd.recentErrors {
+			fmt.Fprintf(w, "  Recent fetch error: %s\n", e)
+		}
+		wd.lock.Unlock()
+	}
+	watchdogsLock.Unlock()
+
+	fmt.Fprintf(w, "\n== State file %s\n", topicOffsetRangeFile())
+	dumpStateSummary(w)
+
+	fmt.Fprintf(w, "\n== Results so far\n")
+	results.lock.Lock()
+	results.syncTraffic()
+	data, err := json.MarshalIndent(&results, "", "  ")
+	results.lock.Unlock()
+	if err != nil {
+		fmt.Fprintf(w, "Error serializing results: %v\n", err)
+	} else {
+		w.Write(data)
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "\n== Goroutines\n")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Flags that hold credentials, which status dumps must not reveal
+var secretFlags = map[string]bool{
+	"password":         true,
+	"produce_password": true,
+	"consume_password": true,
+	"s3_secret_key":    true,
+}
+
+// The flags set on the command line, with secrets masked
+func redactedFlags() string {
+	var b strings.Builder
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && len(value) > 0 {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(&b, " --%s=%s", f.Name, value)
+	})
+	return b.String()
+}
+
+// Per-partition statistics of the ranges last stored, which is as far as
+// we can look without racing with produce acks
+func dumpStateSummary(w *bufio.Writer) {
+	tors, shardErrs, err := readState(topicOffsetRangeFile())
+	if err != nil {
+		fmt.Fprintf(w, "Not readable: %v\n", err)
+		return
+	}
+	for p, err := range shardErrs {
+		fmt.Fprintf(w, "%s/%d not readable: %v\n", *topic, p, err)
+	}
+	fmt.Fprintf(w, "Produce epoch %d, %d partitions, %d keys\n", tors.ProduceEpoch, len(tors.PartitionRanges), len(tors.KeyLatest))
+	for p := range tors.PartitionRanges {
+		ors := &tors.PartitionRanges[p]
+		ranges := ors.AllRanges()
+		if len(ranges) == 0 {
+			continue
+		}
+		offsets := int64(0)
+		for _, r := range ranges {
+			offsets += r.Upper - r.Lower
+		}
+		fmt.Fprintf(w, "%s/%d %d ranges, %d offsets in [%d, %d), acked to %d, %d unexpected\n", *topic, p,
+			len(ranges), offsets, ranges[0].Lower, ranges[len(ranges)-1].Upper, ors.AckedUpper, len(ors.Unexpected))
+	}
+}
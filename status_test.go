@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestRedactedFlags(t *testing.T) {
+	defer func(p, s, u string) { *password, *s3SecretKey, *username = p, s, u }(*password, *s3SecretKey, *username)
+	flagSet := func(name, value string) {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flagSet("password", "hunter2")
+	flagSet("s3_secret_key", "wJalrXUtnFEMI")
+	flagSet("username", "admin")
+
+	got := redactedFlags()
+	for _, secret := range []string{"hunter2", "wJalrXUtnFEMI"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("flags %q reveal %q", got, secret)
+		}
+	}
+	for _, want := range []string{"--password=<redacted>", "--s3_secret_key=<redacted>", "--username=admin"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("flags %q missing %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Throttling imposed on us by quotas, accumulated across all clients.
+// Responses carry the throttle time but not what kind of request was
+// throttled, so we attribute it by the cluster the client talks to: in
+// the usual case the produce cluster's throttling is from produce quotas
+// and the consume cluster's from fetch quotas.
+type ThrottleStats struct {
+	Count    int64
+	TotalMs  int64
+	MaxMs    int64
+	ByBroker map[string]int64
+}
+
+type throttleHook struct {
+	role string
+}
+
+func (h throttleHook) OnBrokerThrottle(meta kgo.BrokerMetadata, interval time.Duration, _ bool) {
+	ms := interval.Milliseconds()
+	if ms <= 0 {
+		return
+	}
+	log.Debugf("Throttled %dms by %s broker %d", ms, h.role, meta.NodeID)
+	results.AddThrottle(h.role, meta.NodeID, ms)
+}
+
+func (ts *ThrottleStats) note(role string, broker int32, ms int64) {
+	ts.Count += 1
+	ts.TotalMs += ms
+	if ms > ts.MaxMs {
+		ts.MaxMs = ms
+	}
+	if ts.ByBroker == nil {
+		ts.ByBroker = make(map[string]int64)
+	}
+	ts.ByBroker[fmt.Sprintf("%s/%d", role, broker)] += ms
+}
+
+// Fail the run if we were throttled for longer than --max_throttle in total
+func checkThrottle() {
+	results.lock.Lock()
+	total := time.Duration(results.Throttle.TotalMs) * time.Millisecond
+	count := results.Throttle.Count
+	results.lock.Unlock()
+
+	if count > 0 {
+		log.Infof("Throttled %d times for %v in total", count, total)
+	}
+	if *maxThrottle > 0 && total > *maxThrottle {
+		results.Emit()
+		Die("Throttled for %v, more than --max_throttle %v", total, *maxThrottle)
+	}
+}
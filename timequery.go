@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Timestamps (in milliseconds) of the first and last records in a partition
+type TimeRange struct {
+	First int64
+	Last  int64
+}
+
+// Read the single record at an offset, or return an error if the read
+// fails or comes back empty within a few seconds.
+func readRecordAt(p int32, o int64) (*kgo.Record, error) {
+	offsets := map[string]map[int32]kgo.Offset{
+		*topic: {p: kgo.NewOffset().At(o)},
+	}
+	client := newClient([]kgo.Opt{kgo.ConsumePartitions(offsets)})
+	defer closeClient(client)
+
+	ctx, cancel := context.WithTimeout(runCtx, time.Second*5)
+	defer cancel()
+	fetches := client.PollRecords(ctx, 1)
+
+	var r_err error
+	fetches.EachError(func(t string, p int32, err error) {
+		r_err = err
+	})
+	if r_err != nil {
+		return nil, r_err
+	}
+
+	records := fetches.Records()
+	if len(records) == 0 {
+		return nil, errors.New("Empty response")
+	}
+	return records[0], nil
+}
+
+// Resolve a timestamp to the earliest offset whose timestamp is >= it
+// with a ListOffsets request.  Returns -1 if there is no such offset.
+func listOffsetForTimestamp(p int32, ts int64) (int64, error) {
+	client := newClient(nil)
+	defer closeClient(client)
+
+	req := kmsg.NewPtrListOffsetsRequest()
+	req.ReplicaID = -1
+	req.IsolationLevel = readIsolationLevel()
+	reqTopic := kmsg.NewListOffsetsRequestTopic()
+	reqTopic.Topic = *topic
+	part := kmsg.NewListOffsetsRequestTopicPartition()
+	part.Partition = p
+	part.Timestamp = ts
+	reqTopic.Partitions = append(reqTopic.Partitions, part)
+	req.Topics = append(req.Topics, reqTopic)
+
+	resp, err := req.RequestWith(runCtx, client)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Topics) != 1 || len(resp.Topics[0].Partitions) != 1 {
+		return 0, errors.New("Unexpected ListOffsets response shape")
+	}
+	rp := resp.Topics[0].Partitions[0]
+	if rp.ErrorCode != 0 {
+		return 0, kerr.ErrorForCode(rp.ErrorCode)
+	}
+	return rp.Offset, nil
+}
+
+// Learn a partition's time range by reading its first and last records
+func loadTimeRange(p int32, pStart int64, pEnd int64) (TimeRange, error) {
+	first, err := readRecordAt(p, pStart)
+	if err != nil {
+		return TimeRange{}, err
+	}
+	last, err := readRecordAt(p, pEnd-1)
+	if err != nil {
+		return TimeRange{}, err
+	}
+	return TimeRange{
+		First: first.Timestamp.UnixMilli(),
+		Last:  last.Timestamp.UnixMilli(),
+	}, nil
+}
+
+// Pick a random timestamp in the partition's time range and resolve it
+// to an offset.  Returns the offset, the queried timestamp, and false if
+// no read should be done this time around.
+func chooseTimestampOffset(rng *rand.Rand, p int32, pStart int64, pEnd int64, timeRanges map[int32]TimeRange) (int64, int64, bool) {
+	tr, ok := timeRanges[p]
+	if !ok {
+		var err error
+		tr, err = loadTimeRange(p, pStart, pEnd)
+		if err != nil {
+			log.Warnf("Error loading time range for %s/%d: %v", *topic, p, err)
+			return 0, 0, false
+		}
+		log.Debugf("Time range for %s/%d: %d-%d", *topic, p, tr.First, tr.Last)
+		timeRanges[p] = tr
+	}
+
+	ts := tr.First
+	if tr.Last > tr.First {
+		ts += rng.Int63n(tr.Last - tr.First + 1)
+	}
+
+	o, err := listOffsetForTimestamp(p, ts)
+	if err != nil {
+		log.Warnf("Error listing offset for %s/%d at t=%d: %v", *topic, p, ts, err)
+		return 0, 0, false
+	}
+	if o < 0 || o >= pEnd {
+		// Timestamps needn't be monotonic, but every timestamp up to that of
+		// the last record must resolve to an offset at or before it.
+		Die("No offset found for t=%d on %s/%d, last record has t=%d", ts, *topic, p, tr.Last)
+	}
+	log.Debugf("Resolved t=%d to offset %d on %s/%d", ts, o, *topic, p)
+	return o, ts, true
+}
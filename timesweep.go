@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// With --timestamp_sweep, we keep the timestamp of every record we produce,
+// and before reading, check that timestamp queries across each partition's
+// time range resolve exactly: to the earliest offset whose timestamp is at
+// or after the query.  Random reads with --rand_read_timestamp only check
+// that a query doesn't land too early; knowing every timestamp, we can
+// also tell when one lands too late, skipping records a time index missed.
+//
+// Timestamps are kept in runs over consecutive offsets, as millisecond
+// deltas from the run's first timestamp, so each record costs a delta in
+// state rather than a full timestamp.
+
+// Timestamps of the records at consecutive offsets from Base, as deltas
+// from First
+type TimestampRun struct {
+	Base   int64
+	First  int64
+	Deltas []int32
+}
+
+func (tr *TimestampRun) upper() int64 {
+	return tr.Base + int64(len(tr.Deltas))
+}
+
+type TimestampSweepStats struct {
+	Queries int64
+	// Queries that resolved to a record we have no timestamp for, and
+	// which we could only check against the record itself
+	Unknown    int64
+	Mismatches []TimeQueryMismatch `json:",omitempty"`
+}
+
+// A timestamp query that resolved to the wrong offset
+type TimeQueryMismatch struct {
+	Partition int32
+	Timestamp int64
+	Expected  int64
+	Found     int64
+}
+
+func (ors *OffsetRanges) NoteTimestamp(o int64, ts time.Time) {
+	ms := ts.UnixMilli()
+	if n := len(ors.Timestamps); n > 0 && ors.Timestamps[n-1].upper() == o {
+		last := &ors.Timestamps[n-1]
+		if delta := ms - last.First; delta >= math.MinInt32 && delta <= math.MaxInt32 {
+			last.Deltas = append(last.Deltas, int32(delta))
+			return
+		}
+	}
+	ors.Timestamps = append(ors.Timestamps, TimestampRun{Base: o, First: ms, Deltas: []int32{0}})
+}
+
+func (ors *OffsetRanges) LookupTimestamp(o int64) (int64, bool) {
+	i := sort.Search(len(ors.Timestamps), func(i int) bool { return ors.Timestamps[i].upper() > o })
+	if i < len(ors.Timestamps) && ors.Timestamps[i].Base <= o {
+		tr := &ors.Timestamps[i]
+		return tr.First + int64(tr.Deltas[o-tr.Base]), true
+	}
+	return 0, false
+}
+
+// Union of two sorted lists of runs.  Where they overlap they describe the
+// same records, so we keep the timestamps we saw first, and give the rest
+// of an overlapping run its own base time.
+func mergeTimestamps(a []TimestampRun, b []TimestampRun) []TimestampRun {
+	if len(b) == 0 {
+		return a
+	}
+	all := append(append([]TimestampRun{}, a...), b...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Base < all[j].Base })
+
+	var merged []TimestampRun
+	for _, tr := range all {
+		if n := len(merged); n > 0 && tr.Base < merged[n-1].upper() {
+			last := &merged[n-1]
+			if tr.upper() > last.upper() {
+				// Start a new run where the old one ends, as the two may not
+				// share a base time
+				skip := last.upper() - tr.Base
+				merged = append(merged, TimestampRun{Base: last.upper(), First: tr.First, Deltas: append([]int32{}, tr.Deltas[skip:]...)})
+			}
+		} else {
+			merged = append(merged, TimestampRun{Base: tr.Base, First: tr.First, Deltas: append([]int32{}, tr.Deltas...)})
+		}
+	}
+	return merged
+}
+
+func trimTimestamps(runs []TimestampRun, o int64) []TimestampRun {
+	i := sort.Search(len(runs), func(i int) bool { return runs[i].upper() > o })
+	if i == len(runs) {
+		return nil
+	}
+	runs = runs[i:]
+	if runs[0].Base < o {
+		runs[0] = TimestampRun{Base: o, First: runs[0].First, Deltas: runs[0].Deltas[o-runs[0].Base:]}
+	}
+	return runs
+}
+
+func timestampSweep(nPartitions int32) {
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+	client := newClient(nil)
+	start, err := getOffsets(client, nPartitions, -2)
+	ChkEmit(err, "%v", err)
+	closeClient(client)
+
+	rng := newRand("timestamp sweep")
+	mismatches := 0
+	log.Infof("Timestamp sweep with %d queries per partition...", *timestampSweepQueries)
+	for p := int32(0); p < nPartitions; p++ {
+		if !ownsPartition(p) {
+			continue
+		}
+		ors := &validRanges.PartitionRanges[p]
+
+		// Our records' offsets and timestamps, and the highest timestamp at
+		// or before each offset, which tells us the earliest record
+		// reaching any given time
+		var offsets, timestamps, maxTs []int64
+		highest := int64(math.MinInt64)
+		for _, tr := range trimTimestamps(ors.Timestamps, start[p]) {
+			for i, d := range tr.Deltas {
+				ts := tr.First + int64(d)
+				if ts > highest {
+					highest = ts
+				}
+				offsets = append(offsets, tr.Base+int64(i))
+				timestamps = append(timestamps, ts)
+				maxTs = append(maxTs, highest)
+			}
+		}
+		if len(offsets) == 0 {
+			continue
+		}
+		lowest := timestamps[0]
+		for _, ts := range timestamps {
+			if ts < lowest {
+				lowest = ts
+			}
+		}
+
+		for q := 0; q < *timestampSweepQueries; q++ {
+			// Half at random through the time range (and a little either
+			// side), half at records' own timestamps, where off-by-ones live
+			var ts int64
+			if q%2 == 0 {
+				ts = lowest - 1000 + rng.Int63n(highest-lowest+2001)
+			} else {
+				ts = timestamps[rng.Intn(len(timestamps))] + rng.Int63n(2)
+			}
+			expected := int64(-1)
+			if i := sort.Search(len(maxTs), func(i int) bool { return maxTs[i] >= ts }); i < len(maxTs) {
+				expected = offsets[i]
+			}
+			if !checkTimeQuery(p, ts, expected, ors) {
+				mismatches += 1
+			}
+		}
+	}
+
+	if mismatches > 0 {
+		results.Emit()
+		Die("%d timestamp queries on %s resolved to the wrong offset", mismatches, *topic)
+	}
+}
+
+// Check a timestamp query resolves to the earliest record of ours at or
+// after it, or to something earlier that we know nothing about but that
+// is itself late enough.  Returns false if it resolved wrongly.
+func checkTimeQuery(p int32, ts int64, expected int64, ors *OffsetRanges) bool {
+	o, err := listOffsetForTimestamp(p, ts)
+	if err != nil {
+		log.Warnf("Error listing offset for %s/%d at t=%d: %v", *topic, p, ts, err)
+		return true
+	}
+	results.AddTimeQuery(false)
+	if o == expected {
+		return true
+	}
+
+	mismatch := func() {
+		log.Errorf("Timestamp query t=%d on %s/%d returned offset %d, expected %d", ts, *topic, p, o, expected)
+		results.AddTimeQueryMismatch(TimeQueryMismatch{Partition: p, Timestamp: ts, Expected: expected, Found: o})
+	}
+	if o < 0 || (expected >= 0 && o > expected) {
+		// Skipped over a record of ours that was late enough
+		mismatch()
+		return false
+	}
+	if _, ours := ors.LookupTimestamp(o); ours {
+		// One of ours, so earlier than the query, or we would have expected it
+		mismatch()
+		return false
+	}
+
+	r, err := readRecordAt(p, o)
+	if err != nil {
+		log.Warnf("Error reading %s/%d at %d for t=%d: %v", *topic, p, o, ts, err)
+		return true
+	}
+	results.AddTimeQuery(true)
+	if r.Timestamp.UnixMilli() < ts {
+		log.Errorf("Timestamp query t=%d on %s/%d returned offset %d with earlier t=%d", ts, *topic, p, r.Offset, r.Timestamp.UnixMilli())
+		mismatch()
+		return false
+	}
+	return true
+}
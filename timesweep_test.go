@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func timestampRuns(base int64, ms ...int64) *OffsetRanges {
+	ors := &OffsetRanges{}
+	for i, t := range ms {
+		ors.NoteTimestamp(base+int64(i), time.UnixMilli(t))
+	}
+	return ors
+}
+
+func TestNoteTimestamp(t *testing.T) {
+	ors := timestampRuns(10, 1000, 1001, 999, 1000)
+	// A gap in offsets starts a new run, as does a delta beyond an int32
+	ors.NoteTimestamp(20, time.UnixMilli(5000))
+	ors.NoteTimestamp(21, time.UnixMilli(5000+1<<32))
+	want := []TimestampRun{
+		{Base: 10, First: 1000, Deltas: []int32{0, 1, -1, 0}},
+		{Base: 20, First: 5000, Deltas: []int32{0}},
+		{Base: 21, First: 5000 + 1<<32, Deltas: []int32{0}},
+	}
+	if !reflect.DeepEqual(ors.Timestamps, want) {
+		t.Fatalf("runs %+v, want %+v", ors.Timestamps, want)
+	}
+	for o, want := range map[int64]int64{10: 1000, 12: 999, 13: 1000, 20: 5000, 21: 5000 + 1<<32} {
+		if ts, ok := ors.LookupTimestamp(o); !ok || ts != want {
+			t.Errorf("LookupTimestamp(%d) = %d %v, want %d", o, ts, ok, want)
+		}
+	}
+	for _, o := range []int64{9, 14, 19, 22} {
+		if _, ok := ors.LookupTimestamp(o); ok {
+			t.Errorf("LookupTimestamp(%d) found a timestamp", o)
+		}
+	}
+}
+
+func TestMergeTimestamps(t *testing.T) {
+	a := timestampRuns(0, 100, 101, 102, 103)
+	b := timestampRuns(2, 900, 901, 902, 903)
+	merged := &OffsetRanges{Timestamps: mergeTimestamps(a.Timestamps, b.Timestamps)}
+	// The overlap keeps a's timestamps, and the rest keeps b's
+	for o, want := range []int64{100, 101, 102, 103, 902, 903} {
+		if ts, ok := merged.LookupTimestamp(int64(o)); !ok || ts != want {
+			t.Errorf("merged timestamp at %d = %d %v, want %d", o, ts, ok, want)
+		}
+	}
+	if _, ok := merged.LookupTimestamp(6); ok {
+		t.Errorf("merged timestamp past the end")
+	}
+	if got := mergeTimestamps(a.Timestamps, nil); !reflect.DeepEqual(got, a.Timestamps) {
+		t.Errorf("merge with nothing = %+v", got)
+	}
+	// Contained entirely within a
+	inner := timestampRuns(1, 500)
+	if got := mergeTimestamps(a.Timestamps, inner.Timestamps); !reflect.DeepEqual(got, a.Timestamps) {
+		t.Errorf("merge with contained run = %+v", got)
+	}
+}
+
+func TestTrimTimestamps(t *testing.T) {
+	ors := timestampRuns(0, 100, 101, 102)
+	ors.NoteTimestamp(10, time.UnixMilli(200))
+	trimmed := &OffsetRanges{Timestamps: trimTimestamps(ors.Timestamps, 1)}
+	for o, want := range map[int64]int64{1: 101, 2: 102, 10: 200} {
+		if ts, ok := trimmed.LookupTimestamp(o); !ok || ts != want {
+			t.Errorf("trimmed timestamp at %d = %d %v, want %d", o, ts, ok, want)
+		}
+	}
+	if _, ok := trimmed.LookupTimestamp(0); ok {
+		t.Errorf("timestamp below the trim point survived")
+	}
+	if got := trimTimestamps(ors.Timestamps, 11); got != nil {
+		t.Errorf("trim past the end = %+v", got)
+	}
+}
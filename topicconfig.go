@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Look at the topic's configuration before starting, and refuse to run
+// modes that it makes meaningless (e.g. contiguous sequential validation of
+// a compacted topic), or warn where it changes what a run can expect (e.g.
+// retention trimming records before they are read back).  Problems that
+// would otherwise stop the run are only warnings with
+// --ignore_topic_config.
+
+// The settings that matter to us
+var checkedTopicConfigs = []string{
+	"cleanup.policy",
+	"retention.ms",
+	"retention.bytes",
+	"redpanda.remote.write",
+	"redpanda.remote.read",
+	"message.timestamp.type",
+}
+
+func checkTopicConfig(nPartitions int32) {
+	client := newClient(nil)
+	configs, err := getTopicConfigs(client)
+	closeClient(client)
+	Chk(err, "%v", err)
+
+	values := make(map[string]string)
+	for _, name := range checkedTopicConfigs {
+		if c, ok := configs[name]; ok && c.Value != nil {
+			values[name] = *c.Value
+			log.Infof("Topic %s %s=%s (%s)", *topic, name, *c.Value, c.Source)
+		}
+	}
+	results.SetTopicConfig(values)
+	logAppendTime = values["message.timestamp.type"] == "LogAppendTime"
+
+	refuse := func(msg string, args ...interface{}) {
+		if *ignoreTopicConfig {
+			log.Warnf(msg, args...)
+		} else {
+			Die(msg+" (--ignore_topic_config to run anyway)", args...)
+		}
+	}
+
+	compacted := strings.Contains(values["cleanup.policy"], "compact")
+	if *compactionTiered && !compacted {
+		refuse("--compaction_tiered needs a compacted topic, but %s has cleanup.policy=%s", *topic, values["cleanup.policy"])
+	}
+	if compacted && *compactionTiered && !*strictSequence {
+		// Keyed validation is made for this
+		log.Infof("Topic %s is compacted: reads will skip over compacted offsets", *topic)
+	} else if compacted {
+		if *strictSequence {
+			refuse("--strict_sequence cannot hold on compacted topic %s", *topic)
+		} else if *keyed {
+			refuse("--keyed reuses keys, which compaction of %s will remove", *topic)
+		} else if *seqRead && !readWindowSet() {
+			refuse("Sequential validation of compacted topic %s from start to HWM will find compaction gaps: use --seq_read=false or a read window", *topic)
+		} else {
+			log.Warnf("Topic %s is compacted: reads will skip over compacted offsets", *topic)
+		}
+	}
+
+	// Redpanda only reports these where tiered storage is available
+	remoteWrite, hasRemote := values["redpanda.remote.write"]
+	if hasRemote && remoteWrite != "true" {
+		if *localTrimMode {
+			refuse("--local_trim on %s would lose data: redpanda.remote.write is off", *topic)
+		}
+		if *uploadTimeout > 0 {
+			refuse("--upload_timeout on %s will time out: redpanda.remote.write is off", *topic)
+		}
+	}
+
+	if hasRemote && values["redpanda.remote.read"] == "true" {
+		// Trimmed data is still readable from object storage
+		return
+	}
+	if ms, err := strconv.ParseInt(values["retention.ms"], 10, 64); err == nil && ms >= 0 {
+		retention := time.Duration(ms) * time.Millisecond
+		if d, ok := expectedProduceDuration(); ok && d > retention {
+			log.Warnf("Topic %s retention.ms (%v) is shorter than this run's produce phase (about %v): early records may be trimmed before they are read",
+				*topic, retention, d.Round(time.Second))
+		} else {
+			log.Infof("Topic %s has time-based retention of %v: records older than that may be trimmed before they are read", *topic, retention)
+		}
+	}
+	if bytes, err := strconv.ParseInt(values["retention.bytes"], 10, 64); err == nil && bytes >= 0 {
+		produceBytes := int64(*pCount) * int64(*mSize)
+		if produceBytes > bytes*int64(nPartitions) {
+			log.Warnf("Topic %s retention.bytes (%d per partition) is less than the %d bytes this run produces: early records may be trimmed before they are read",
+				*topic, bytes, produceBytes)
+		}
+	}
+}
+
+// How long producing will take, if it is paced
+func expectedProduceDuration() (time.Duration, bool) {
+	if len(*ramp) > 0 || len(*rampSchedule) > 0 || *produceRate <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(*pCount) / *produceRate * float64(time.Second)), true
+}
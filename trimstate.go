@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The trim-state subcommand: forget ranges in this topic's state file that
+// retention has since removed from the log, and join up ranges that
+// adjoin, so that a long soak test's state file stays small and only
+// describes records that can still be read.
+
+// Join ranges that adjoin and share a produce epoch, returning how many
+// were folded into their neighbours
+func (ors *OffsetRanges) Compact() int {
+	if len(ors.Ranges) < 2 {
+		return 0
+	}
+	sort.Slice(ors.Ranges, func(i, j int) bool {
+		return ors.Ranges[i].Lower < ors.Ranges[j].Lower
+	})
+	compacted := []OffsetRange{ors.Ranges[0]}
+	for _, r := range ors.Ranges[1:] {
+		last := &compacted[len(compacted)-1]
+		if r.Lower == last.Upper && r.Epoch == last.Epoch {
+			last.Upper = r.Upper
+		} else {
+			compacted = append(compacted, r)
+		}
+	}
+	folded := len(ors.Ranges) - len(compacted)
+	ors.Ranges = compacted
+	return folded
+}
+
+func trimState() {
+	if len(*topic) == 0 {
+		Die("trim-state requires --topic")
+	}
+
+	client := newClient(nil)
+	t, cid, err := getTopicMetadata(client)
+	Chk(err, "%v", err)
+	clusterID = cid
+	topicID = formatTopicID(t.ID)
+	nPartitions := int32(len(t.Partitions))
+	lwm, hwm, err := getOffsetBounds(client, nPartitions)
+	ChkEmit(err, "%v", err)
+	closeClient(client)
+
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+
+	totalBefore, totalAfter := 0, 0
+	for p := int32(0); p < nPartitions; p++ {
+		ors := &validRanges.PartitionRanges[p]
+		before := len(ors.Ranges)
+		ors.TrimBelow(lwm[p])
+		folded := ors.Compact()
+		totalBefore += before
+		totalAfter += len(ors.Ranges)
+
+		all := ors.AllRanges()
+		if n := len(all); n > 0 && all[n-1].Upper > hwm[p] {
+			// Not ours to tidy away: reads will report it
+			log.Warnf("State for %s/%d extends to %d, beyond the HWM %d", *topic, p, all[n-1].Upper, hwm[p])
+		}
+		if before != len(ors.Ranges) {
+			log.Infof("Partition %s/%d: %d ranges now %d (start offset %d, %d joined up)",
+				*topic, p, before, len(ors.Ranges), lwm[p], folded)
+		}
+	}
+
+	log.Infof("Trimmed state for %s from %d ranges to %d", *topic, totalBefore, totalAfter)
+	err = validRanges.Store()
+	Chk(err, "Error writing trimmed state: %v", err)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// The current leader epoch of each partition, -1 where unknown
+func getLeaderEpochs(client *kgo.Client, nPartitions int32) ([]int32, error) {
+	t, _, err := getTopicMetadata(client)
+	if err != nil {
+		return nil, err
+	}
+	epochs := make([]int32, nPartitions)
+	for i := range epochs {
+		epochs[i] = -1
+	}
+	for _, p := range t.Partitions {
+		if p.Partition < nPartitions {
+			epochs[p.Partition] = p.LeaderEpoch
+		}
+	}
+	return epochs, nil
+}
+
+// Look for partitions whose HWM has fallen below offsets we were
+// previously acked for.  Retention only ever advances the start of the
+// log, so this can only be an unclean truncation: acknowledged data loss.
+func checkAckedDataLoss(nPartitions int32, lwm []int64, hwm []int64, validRanges *TopicOffsetRanges) {
+	var epochs []int32
+	for p := int32(0); p < nPartitions; p++ {
+		ors := &validRanges.PartitionRanges[p]
+		if ors.AckedUpper == 0 || hwm[p] >= ors.AckedUpper {
+			continue
+		}
+
+		if epochs == nil {
+			client := newClient(nil)
+			var err error
+			epochs, err = getLeaderEpochs(client, nPartitions)
+			closeClient(client)
+			Chk(err, "%v", err)
+		}
+
+		loss := DataLoss{
+			Partition:    p,
+			AckedUpper:   ors.AckedUpper,
+			AckedEpoch:   ors.AckedEpoch,
+			Lwm:          lwm[p],
+			Hwm:          hwm[p],
+			CurrentEpoch: epochs[p],
+		}
+		log.Errorf("Acknowledged data loss on %s/%d: HWM %d is below acked offset %d (acked in leader epoch %d, now %d)",
+			*topic, p, hwm[p], ors.AckedUpper-1, ors.AckedEpoch, epochs[p])
+		results.AddDataLoss(loss)
+	}
+
+	if epochs != nil {
+		results.Emit()
+		Die("Acknowledged data loss detected on %s", *topic)
+	}
+}
+
+// On OffsetOutOfRange, work out whether our position was trimmed by
+// retention (fine) or was truncated away from under us (not fine).
+func checkOutOfRange(nPartitions int32, p int32, position int64, validRanges *TopicOffsetRanges) {
+	client := newClient(nil)
+	lwm, hwm, err := getOffsetBounds(client, nPartitions)
+	ChkEmit(err, "%v", err)
+	closeClient(client)
+
+	checkAckedDataLoss(nPartitions, lwm, hwm, validRanges)
+
+	if position < lwm[p] {
+		log.Infof("Offset %d on %s/%d trimmed by retention (start offset now %d)", position, *topic, p, lwm[p])
+	} else {
+		log.Warnf("OffsetOutOfRange at %d on %s/%d within log %d-%d", position, *topic, p, lwm[p], hwm[p])
+	}
+}
+
+// Ask each partition's leader where the epoch we were last acked in ends.
+// Logs are prefix-consistent across epochs, so that end offset must be at
+// least as high as anything we were acked for, and the epoch must still be
+// known to the leader.  Otherwise the log has diverged from what was acked
+// to us, even if the keys we read back look fine.  The epochs are the
+// produce cluster's, so that is the cluster we ask.
+func checkLeaderEpochs(nPartitions int32, validRanges *TopicOffsetRanges) {
+	if !leaderEpochChecks {
+		return
+	}
+	req := kmsg.NewPtrOffsetForLeaderEpochRequest()
+	req.ReplicaID = -1
+	reqTopic := kmsg.NewOffsetForLeaderEpochRequestTopic()
+	reqTopic.Topic = *topic
+	for p := int32(0); p < nPartitions; p++ {
+		ors := &validRanges.PartitionRanges[p]
+		if ors.AckedUpper == 0 || ors.AckedEpoch < 0 {
+			continue
+		}
+		part := kmsg.NewOffsetForLeaderEpochRequestTopicPartition()
+		part.Partition = p
+		part.LeaderEpoch = ors.AckedEpoch
+		reqTopic.Partitions = append(reqTopic.Partitions, part)
+	}
+	if len(reqTopic.Partitions) == 0 {
+		return
+	}
+	req.Topics = append(req.Topics, reqTopic)
+
+	client := newProduceClient(nil)
+	defer closeClient(client)
+	resp, err := req.RequestWith(runCtx, client)
+	if err != nil {
+		log.Warnf("OffsetForLeaderEpoch request failed, skipping divergence check: %v", err)
+		return
+	}
+
+	diverged := false
+	for _, t := range resp.Topics {
+		for _, rp := range t.Partitions {
+			if rp.ErrorCode != 0 {
+				log.Warnf("OffsetForLeaderEpoch error on %s/%d: %v", *topic, rp.Partition, kerr.ErrorForCode(rp.ErrorCode))
+				continue
+			}
+			if rp.Partition < 0 || rp.Partition >= nPartitions {
+				continue
+			}
+			ors := &validRanges.PartitionRanges[rp.Partition]
+			if rp.LeaderEpoch == -1 && rp.EndOffset == -1 {
+				// Epoch is older than anything in the log, e.g. retention has
+				// removed all its data: nothing to compare against.
+				log.Infof("Epoch %d no longer present on %s/%d", ors.AckedEpoch, *topic, rp.Partition)
+				continue
+			}
+			if rp.LeaderEpoch < ors.AckedEpoch || rp.EndOffset < ors.AckedUpper {
+				log.Errorf("Log divergence on %s/%d: acked up to %d in epoch %d, but leader says epoch %d ends at %d",
+					*topic, rp.Partition, ors.AckedUpper, ors.AckedEpoch, rp.LeaderEpoch, rp.EndOffset)
+				results.AddDivergence(EpochDivergence{
+					Partition:  rp.Partition,
+					AckedUpper: ors.AckedUpper,
+					AckedEpoch: ors.AckedEpoch,
+					EndOffset:  rp.EndOffset,
+					EndEpoch:   rp.LeaderEpoch,
+				})
+				diverged = true
+			} else {
+				log.Debugf("Epoch %d on %s/%d ends at %d, consistent with acks up to %d", ors.AckedEpoch, *topic, rp.Partition, rp.EndOffset, ors.AckedUpper)
+			}
+		}
+	}
+
+	if diverged {
+		results.Emit()
+		Die("Log divergence detected on %s", *topic)
+	}
+}
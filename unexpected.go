@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// A record acked at an offset other than the one we wrote into its key
+// (e.g. because something else wrote to the partition meanwhile) is still
+// in the log, just not where its key says.  We note where it landed and
+// what its key says, so that reads can check it is still there and intact
+// rather than skip it as outside our ranges.
+
+type UnexpectedRecord struct {
+	Offset int64
+	// The produce epoch and offset in the record's key
+	Epoch     int64
+	KeyOffset int64
+}
+
+func (ors *OffsetRanges) NoteUnexpected(o int64, epoch int64, keyOffset int64) {
+	// Acks are applied in offset order on each partition, so this stays sorted
+	ors.Unexpected = append(ors.Unexpected, UnexpectedRecord{Offset: o, Epoch: epoch, KeyOffset: keyOffset})
+}
+
+func (ors *OffsetRanges) LookupUnexpected(o int64) (UnexpectedRecord, bool) {
+	i := sort.Search(len(ors.Unexpected), func(i int) bool { return ors.Unexpected[i].Offset >= o })
+	if i < len(ors.Unexpected) && ors.Unexpected[i].Offset == o {
+		return ors.Unexpected[i], true
+	}
+	return UnexpectedRecord{}, false
+}
+
+// Sorted union of two sorted lists of unexpected records
+func mergeUnexpected(a []UnexpectedRecord, b []UnexpectedRecord) []UnexpectedRecord {
+	if len(b) == 0 {
+		return a
+	}
+	merged := append(append([]UnexpectedRecord{}, a...), b...)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Offset < merged[j].Offset })
+	deduped := merged[:0]
+	for _, u := range merged {
+		if len(deduped) == 0 || deduped[len(deduped)-1].Offset != u.Offset {
+			deduped = append(deduped, u)
+		}
+	}
+	return deduped
+}
+
+func trimUnexpected(unexpected []UnexpectedRecord, o int64) []UnexpectedRecord {
+	i := sort.Search(len(unexpected), func(i int) bool { return unexpected[i].Offset >= o })
+	if i == len(unexpected) {
+		return nil
+	}
+	return unexpected[i:]
+}
+
+// Check a record at an offset we recorded as unexpected, returning false
+// if we have no record of one there
+func validateUnexpected(r *kgo.Record, ors *OffsetRanges, parsed bool, epoch int64, keyOffset int64) bool {
+	u, ok := ors.LookupUnexpected(r.Offset)
+	if !ok {
+		return false
+	}
+	if !parsed || epoch != u.Epoch || keyOffset != u.KeyOffset {
+		expected := formatKey(u.Epoch, u.KeyOffset)
+		badRecord(r, ors, expected, string(r.Key), "Bad read at unexpected offset %d on partition %s/%d.  Expect '%s', found '%s'",
+			r.Offset, *topic, r.Partition, expected, r.Key)
+		return true
+	}
+	validateChecksum(r, ors)
+	validateLogAppendTime(r, ors)
+	log.Debugf("Read OK (%s) at unexpected offset on p=%d at o=%d", r.Key, r.Partition, r.Offset)
+	return true
+}
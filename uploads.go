@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// After producing, wait for tiered storage to upload everything we were
+// acked for, using the admin API's per-partition cloud storage status.
+// Only closed segments are uploaded, so this relies on the cluster
+// eventually uploading the active segment too (e.g. with
+// cloud_storage_segment_max_upload_interval_sec set).
+func waitForUploads(nPartitions int32) {
+	admin := NewAdminClient(*adminApi)
+	validRanges, err := LoadTopicOffsetRanges(nPartitions)
+	Chk(err, "%v", err)
+	deadline := time.Now().Add(*uploadTimeout)
+
+	for {
+		var lagging []UploadLag
+		for p := int32(0); p < nPartitions; p++ {
+			ors := &validRanges.PartitionRanges[p]
+			if !ownsPartition(p) || ors.AckedUpper == 0 {
+				continue
+			}
+
+			status, err := admin.GetCloudStorageStatus(*topic, p)
+			if err != nil {
+				log.Warnf("Error getting cloud storage status of %s/%d: %v", *topic, p, err)
+				lagging = append(lagging, UploadLag{Partition: p, AckedUpper: ors.AckedUpper, Error: err.Error()})
+				continue
+			}
+
+			uploaded := int64(-1)
+			if status.CloudLogLastOffset != nil {
+				uploaded = *status.CloudLogLastOffset
+			}
+			if uploaded < ors.AckedUpper-1 {
+				log.Debugf("Uploads behind on %s/%d: uploaded to %d, acked to %d", *topic, p, uploaded, ors.AckedUpper-1)
+				lagging = append(lagging, UploadLag{
+					Partition:            p,
+					AckedUpper:           ors.AckedUpper,
+					UploadedUpper:        uploaded + 1,
+					LocalLastOffset:      status.LocalLogLastOffset,
+					MsSinceSegmentUpload: status.MsSinceSegmentUpload,
+				})
+			}
+		}
+
+		if len(lagging) == 0 {
+			log.Infof("Uploads caught up on all partitions")
+			return
+		} else if time.Now().After(deadline) {
+			log.Errorf("Uploads still behind on %d partitions after %v:", len(lagging), *uploadTimeout)
+			for _, l := range lagging {
+				log.Errorf("  %s/%d uploaded to %d, acked to %d, local log to %d, last segment upload %dms ago %s",
+					*topic, l.Partition, l.UploadedUpper-1, l.AckedUpper-1, l.LocalLastOffset, l.MsSinceSegmentUpload, l.Error)
+				results.AddUploadLag(l)
+			}
+			dumpTopicMetadata()
+			results.Emit()
+			Die("Uploads did not catch up on %s", *topic)
+		}
+
+		log.Infof("Waiting for uploads, %d partitions behind...", len(lagging))
+		time.Sleep(5 * time.Second)
+	}
+}
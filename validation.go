@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// What to do about a record that fails validation: abort the run at once,
+// or record it and carry on, so that the run reports the full extent of
+// the corruption rather than just the first instance of it.
+const (
+	validationAbort    = "abort"
+	validationContinue = "continue"
+)
+
+// A record that failed validation
+type Corruption struct {
+	Partition int32
+	Offset    int64
+	Expected  string
+	Found     string
+	// The broker we last fetched this partition from, -1 if unknown
+	Broker int32
+	// The broker and leader epoch that acked the record, if the state has it
+	ProducedBy *LeaderRun `json:",omitempty"`
+	// With --quorum_check, every copy of the record we could find
+	Variants []RecordVariant `json:",omitempty"`
+}
+
+// Tracks which broker each partition was last fetched from, to attribute
+// corruption.  With several readers fetching a partition from different
+// replicas at once (follower reads), this is only a best guess.
+type fetchSourceHook struct{}
+
+var (
+	fetchSourcesLock sync.Mutex
+	fetchSources     = make(map[int32]int32)
+)
+
+func (fetchSourceHook) OnFetchBatchRead(meta kgo.BrokerMetadata, t string, p int32, _ kgo.FetchBatchMetrics) {
+	if t != *topic {
+		return
+	}
+	fetchSourcesLock.Lock()
+	defer fetchSourcesLock.Unlock()
+	fetchSources[p] = meta.NodeID
+}
+
+func fetchSource(p int32) int32 {
+	fetchSourcesLock.Lock()
+	defer fetchSourcesLock.Unlock()
+	if b, ok := fetchSources[p]; ok {
+		return b
+	}
+	return -1
+}
+
+// Report a record that failed validation, per --validation_policy.  ors
+// is the state of the record's partition, for who acked the record, or nil.
+func badRecord(r *kgo.Record, ors *OffsetRanges, expected string, found string, msg string, args ...interface{}) {
+	c := Corruption{
+		Partition: r.Partition,
+		Offset:    r.Offset,
+		Expected:  expected,
+		Found:     found,
+		Broker:    fetchSource(r.Partition),
+	}
+	if *quorumCheck {
+		c.Variants = quorumVariants(r)
+	}
+	formatted := fmt.Sprintf(msg, args...)
+	if ors != nil {
+		if lr, ok := ors.LookupLeader(r.Offset); ok {
+			c.ProducedBy = &lr
+			formatted += fmt.Sprintf(" (acked by %s)", lr)
+		}
+	}
+	if ri, ok := recordRun(r); ok {
+		results.AddRunRecord(ri, true)
+		formatted += fmt.Sprintf(" (written by run %s on %s)", ri.ID, ri.Host)
+	}
+	reportCorruption(c, formatted)
+}
+
+// Report corruption that isn't in any one record we read
+func reportCorruption(c Corruption, formatted string) {
+	results.AddCorruption(c)
+	if *validationPolicy == validationAbort {
+		Die("%s (broker %d)", formatted, c.Broker)
+	}
+	log.Errorf("%s (broker %d)", formatted, c.Broker)
+}
+
+// At the end of a run with --validation_policy=continue, summarize the
+// corruption we found and fail
+func checkCorruption() {
+	results.lock.Lock()
+	corrupt := results.Corruption
+	regressions := len(results.OffsetRegressions)
+	results.lock.Unlock()
+	if len(corrupt) == 0 && regressions == 0 {
+		return
+	} else if len(corrupt) == 0 {
+		results.Emit()
+		Die("%d records read out of order on %s", regressions, *topic)
+	}
+
+	type extent struct {
+		count  int
+		lower  int64
+		upper  int64
+		broker map[int32]int
+	}
+	extents := make(map[int32]*extent)
+	for _, c := range corrupt {
+		e := extents[c.Partition]
+		if e == nil {
+			e = &extent{lower: c.Offset, upper: c.Offset, broker: make(map[int32]int)}
+			extents[c.Partition] = e
+		}
+		e.count += 1
+		if c.Offset < e.lower {
+			e.lower = c.Offset
+		}
+		if c.Offset > e.upper {
+			e.upper = c.Offset
+		}
+		e.broker[c.Broker] += 1
+	}
+	for p, e := range extents {
+		log.Errorf("%d bad records on %s/%d between offsets %d and %d (by broker: %v)", e.count, *topic, p, e.lower, e.upper, e.broker)
+	}
+
+	results.Emit()
+	Die("%d bad records on %s", len(corrupt), *topic)
+}
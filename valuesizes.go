@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Key validation can't see a value that was cut short, and with checksums
+// off nothing else can either, so we keep the length of every value we
+// produce and check it on read.  Lengths are kept in runs over consecutive
+// offsets of the same length, so a partition produced with one
+// --msg_size costs a run per range.
+
+// Consecutive offsets from Base whose values were all Size bytes long
+type SizeRun struct {
+	Base  int64
+	Count int64
+	Size  int32
+}
+
+func (sr *SizeRun) upper() int64 {
+	return sr.Base + sr.Count
+}
+
+// Note the length of an ordinary value: tombstones and empty values are
+// checked on their own
+func (ors *OffsetRanges) NoteValueSize(o int64, kind payloadKind, size int) {
+	if kind != payloadNormal {
+		return
+	}
+	if n := len(ors.ValueSizes); n > 0 && ors.ValueSizes[n-1].upper() == o && ors.ValueSizes[n-1].Size == int32(size) {
+		ors.ValueSizes[n-1].Count += 1
+		return
+	}
+	ors.ValueSizes = append(ors.ValueSizes, SizeRun{Base: o, Count: 1, Size: int32(size)})
+}
+
+func (ors *OffsetRanges) LookupValueSize(o int64) (int, bool) {
+	i := sort.Search(len(ors.ValueSizes), func(i int) bool { return ors.ValueSizes[i].upper() > o })
+	if i < len(ors.ValueSizes) && ors.ValueSizes[i].Base <= o {
+		return int(ors.ValueSizes[i].Size), true
+	}
+	return 0, false
+}
+
+// Union of two sorted lists of runs, keeping the sizes we saw first where
+// they overlap, and joining adjacent runs of the same size.
+func mergeValueSizes(a []SizeRun, b []SizeRun) []SizeRun {
+	if len(b) == 0 {
+		return a
+	}
+	all := append(append([]SizeRun{}, a...), b...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Base < all[j].Base })
+
+	var merged []SizeRun
+	for _, sr := range all {
+		if n := len(merged); n > 0 && sr.Base < merged[n-1].upper() {
+			last := &merged[n-1]
+			if sr.upper() > last.upper() {
+				merged = append(merged, SizeRun{Base: last.upper(), Count: sr.upper() - last.upper(), Size: sr.Size})
+			}
+		} else if n > 0 && sr.Base == merged[n-1].upper() && sr.Size == merged[n-1].Size {
+			merged[n-1].Count += sr.Count
+		} else {
+			merged = append(merged, sr)
+		}
+	}
+	return merged
+}
+
+func trimValueSizes(runs []SizeRun, o int64) []SizeRun {
+	i := sort.Search(len(runs), func(i int) bool { return runs[i].upper() > o })
+	if i == len(runs) {
+		return nil
+	}
+	runs = runs[i:]
+	if runs[0].Base < o {
+		runs[0] = SizeRun{Base: o, Count: runs[0].upper() - o, Size: runs[0].Size}
+	}
+	return runs
+}
+
+func validateValueSize(r *kgo.Record, ors *OffsetRanges) {
+	size, ok := ors.LookupValueSize(r.Offset)
+	if !ok || len(r.Value) == size {
+		return
+	}
+	badRecord(r, ors, fmt.Sprintf("%d bytes", size), fmt.Sprintf("%d bytes", len(r.Value)),
+		"Bad read at offset %d on partition %s/%d: value is %d bytes, produced %d", r.Offset, *topic, r.Partition, len(r.Value), size)
+}
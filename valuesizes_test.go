@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeValueSizes(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b []SizeRun
+		want []SizeRun
+	}{
+		{"nothing to add", []SizeRun{{0, 10, 100}}, nil, []SizeRun{{0, 10, 100}}},
+		{"disjoint", []SizeRun{{0, 10, 100}}, []SizeRun{{20, 5, 50}}, []SizeRun{{0, 10, 100}, {20, 5, 50}}},
+		{"adjacent, same size", []SizeRun{{0, 10, 100}}, []SizeRun{{10, 5, 100}}, []SizeRun{{0, 15, 100}}},
+		{"adjacent, other size", []SizeRun{{0, 10, 100}}, []SizeRun{{10, 5, 50}}, []SizeRun{{0, 10, 100}, {10, 5, 50}}},
+		{"overlap keeps the first", []SizeRun{{0, 10, 100}}, []SizeRun{{5, 10, 50}}, []SizeRun{{0, 10, 100}, {10, 5, 50}}},
+		{"contained", []SizeRun{{0, 10, 100}}, []SizeRun{{2, 3, 50}}, []SizeRun{{0, 10, 100}}},
+		{"other side first", []SizeRun{{10, 5, 100}}, []SizeRun{{0, 10, 100}}, []SizeRun{{0, 15, 100}}},
+	}
+	for _, c := range cases {
+		if got := mergeValueSizes(c.a, c.b); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestValueSizes(t *testing.T) {
+	ors := &OffsetRanges{}
+	for o := int64(0); o < 5; o++ {
+		ors.NoteValueSize(o, payloadNormal, 100)
+	}
+	ors.NoteValueSize(5, payloadNull, 0)
+	ors.NoteValueSize(6, payloadNormal, 100)
+	ors.NoteValueSize(7, payloadNormal, 30)
+	want := []SizeRun{{0, 5, 100}, {6, 1, 100}, {7, 1, 30}}
+	if !reflect.DeepEqual(ors.ValueSizes, want) {
+		t.Fatalf("runs %v, want %v", ors.ValueSizes, want)
+	}
+	if size, ok := ors.LookupValueSize(7); !ok || size != 30 {
+		t.Errorf("size at 7 = %d %v", size, ok)
+	}
+	if _, ok := ors.LookupValueSize(5); ok {
+		t.Errorf("size recorded for a tombstone")
+	}
+
+	trimmed := trimValueSizes(ors.ValueSizes, 3)
+	if !reflect.DeepEqual(trimmed, []SizeRun{{3, 2, 100}, {6, 1, 100}, {7, 1, 30}}) {
+		t.Errorf("trimmed %v", trimmed)
+	}
+	if trimValueSizes(trimmed, 8) != nil {
+		t.Errorf("trim past the end kept runs")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Exit code used when --stall_action=abort fires, so that test harnesses
+// can tell a hang apart from a validation failure.
+const exitStalled = 3
+
+// How many recent fetch errors to keep for the stall report
+const watchdogErrorHistory = 16
+
+// Watches a reader for progress, and if it makes none for --stall_timeout,
+// dumps diagnostics and then either restarts or aborts.
+type Watchdog struct {
+	what    string
+	restart func()
+
+	lock         sync.Mutex
+	lastProgress time.Time
+	positions    map[int32]int64
+	recentErrors []string
+
+	stop chan struct{}
+}
+
+// `restart` is called on a stall if --stall_action=restart: it should
+// cause the reader to abandon its current client and start again.
+func NewWatchdog(what string, restart func()) *Watchdog {
+	return &Watchdog{
+		what:         what,
+		restart:      restart,
+		lastProgress: time.Now(),
+		positions:    make(map[int32]int64),
+	}
+}
+
+func (w *Watchdog) Progress(p int32, o int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.lastProgress = time.Now()
+	w.positions[p] = o
+}
+
+func (w *Watchdog) FetchError(p int32, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.recentErrors = append(w.recentErrors, fmt.Sprintf("%s p=%d: %v", time.Now().Format(time.RFC3339), p, err))
+	if len(w.recentErrors) > watchdogErrorHistory {
+		w.recentErrors = w.recentErrors[1:]
+	}
+}
+
+// Start watching in the background.  Only positions are kept, for status
+// dumps, if --stall_timeout is unset.
+func (w *Watchdog) Start() {
+	watchdogsLock.Lock()
+	watchdogs[w] = struct{}{}
+	watchdogsLock.Unlock()
+	if *stallTimeout <= 0 {
+		return
+	}
+	w.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.check()
+			}
+		}
+	}()
+}
+
+func (w *Watchdog) Stop() {
+	watchdogsLock.Lock()
+	delete(watchdogs, w)
+	watchdogsLock.Unlock()
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+}
+
+func (w *Watchdog) check() {
+	w.lock.Lock()
+	stalledFor := time.Since(w.lastProgress)
+	w.lock.Unlock()
+	if stalledFor < *stallTimeout {
+		return
+	}
+
+	log.Errorf("%s stalled: no progress for %v", w.what, stalledFor)
+	w.dump()
+
+	if *stallAction == "abort" || w.restart == nil {
+		if *stallAction == "restart" {
+			log.Warnf("%s cannot be restarted, aborting", w.what)
+		}
+		results.Emit()
+		log.Errorf("Aborting on stalled %s", w.what)
+		os.Exit(exitStalled)
+	}
+
+	log.Warnf("Restarting stalled %s", w.what)
+	w.lock.Lock()
+	w.lastProgress = time.Now()
+	w.lock.Unlock()
+	w.restart()
+}
+
+func (w *Watchdog) dump() {
+	w.lock.Lock()
+	var partitions []int
+	for p := range w.positions {
+		partitions = append(partitions, int(p))
+	}
+	sort.Ints(partitions)
+	for _, p := range partitions {
+		log.Errorf("  %s/%d position %d", *topic, p, w.positions[int32(p)])
+	}
+	for _, e := range w.recentErrors {
+		log.Errorf("  Recent fetch error: %s", e)
+	}
+	w.lock.Unlock()
+
+	dumpTopicMetadata()
+}
+
+// Log the brokers and partition leadership for our topic
+func dumpTopicMetadata() {
+	client := newClient(nil)
+	defer closeClient(client)
+
+	ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+	defer cancel()
+
+	req := kmsg.NewPtrMetadataRequest()
+	reqTopic := kmsg.NewMetadataRequestTopic()
+	reqTopic.Topic = kmsg.StringPtr(*topic)
+	req.Topics = append(req.Topics, reqTopic)
+	resp, err := req.RequestWith(ctx, client)
+	if err != nil {
+		log.Errorf("  Error loading metadata: %v", err)
+		return
+	}
+
+	for _, b := range resp.Brokers {
+		log.Errorf("  Broker %d at %s:%d", b.NodeID, b.Host, b.Port)
+	}
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			log.Errorf("  %s/%d leader=%d epoch=%d replicas=%v isr=%v err=%d", *t.Topic, p.Partition, p.Leader, p.LeaderEpoch, p.Replicas, p.ISR, p.ErrorCode)
+		}
+	}
+}